@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultExpiringWithin is the look-ahead of the expiring grants endpoint
+// if the request does not specify one.
+const defaultExpiringWithin = 7 * 24 * time.Hour
+
+// WithAdmin adds the admin API to the metrics router. The metrics port is not
+// authenticated and must not be exposed to tenants. The grant management
+// routes are only added for writable label stores.
+func (a *App) WithAdmin() *App {
+	a.i.HandleFunc("/admin/grants/expiring", a.handleExpiringGrants).Methods(http.MethodGet)
+	a.i.HandleFunc("/admin/grants/effective", a.handleEffectiveGrants).Methods(http.MethodGet)
+	a.i.HandleFunc("/admin/labelstore/version", a.handleLabelStoreVersion).Methods(http.MethodGet)
+	a.i.HandleFunc("/admin/labelstore/reload", a.handleLabelStoreReload).Methods(http.MethodPost)
+	store, ok := a.LabelStore.(GrantStore)
+	if !ok {
+		return a
+	}
+	a.i.HandleFunc("/admin/grants", handleListGrants(store)).Methods(http.MethodGet)
+	a.i.HandleFunc("/admin/grants", handleCreateGrant(store)).Methods(http.MethodPost)
+	a.i.HandleFunc("/admin/grants/{id:[0-9]+}", handleUpdateGrant(store)).Methods(http.MethodPut)
+	a.i.HandleFunc("/admin/grants/{id:[0-9]+}", handleDeleteGrant(store)).Methods(http.MethodDelete)
+	a.i.HandleFunc("/admin/labels.yaml", handleExportLabels(store)).Methods(http.MethodGet)
+	a.i.HandleFunc("/admin/labels.yaml", handleImportLabels(store)).Methods(http.MethodPut)
+	return a
+}
+
+// handleExpiringGrants lists the time-bounded grants expiring within the
+// duration given by the "within" parameter, e.g. within=24h.
+func (a *App) handleExpiringGrants(w http.ResponseWriter, r *http.Request) {
+	expirer, ok := a.LabelStore.(GrantExpirer)
+	if !ok {
+		logAndWriteError(w, http.StatusNotImplemented, nil, "label store does not support time-bounded grants")
+		return
+	}
+	within := defaultExpiringWithin
+	if value := r.URL.Query().Get("within"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			logAndWriteError(w, http.StatusBadRequest, err, fmt.Sprintf("invalid duration %s", value))
+			return
+		}
+		within = d
+	}
+	grants := expirer.ExpiringGrants(within)
+	if grants == nil {
+		grants = []ExpiringGrant{}
+	}
+	writeJSON(w, grants)
+}
+
+// handleEffectiveGrants dumps the effective grants of the user and groups
+// given by the "user" and "group" parameters, optionally for the datasource
+// given by the "datasource" parameter. Without a datasource, the grants of
+// every datasource are returned.
+func (a *App) handleEffectiveGrants(w http.ResponseWriter, r *http.Request) {
+	explainer, ok := a.LabelStore.(GrantExplainer)
+	if !ok {
+		logAndWriteError(w, http.StatusNotImplemented, nil, "label store does not support explaining grants")
+		return
+	}
+	query := r.URL.Query()
+	token := OAuthToken{PreferredUsername: query.Get("user"), Groups: query["group"]}
+	if token.PreferredUsername == "" && len(token.Groups) == 0 {
+		logAndWriteError(w, http.StatusBadRequest, nil, "user or group is required")
+		return
+	}
+	selected := datasources
+	if datasource := Datasource(query.Get("datasource")); datasource != "" {
+		if !slices.Contains(datasources, datasource) {
+			logAndWriteError(w, http.StatusBadRequest, nil, fmt.Sprintf("unknown datasource %s", datasource))
+			return
+		}
+		selected = []Datasource{datasource}
+	}
+	grants := []EffectiveGrant{}
+	for _, datasource := range selected {
+		for _, grant := range explainer.EffectiveGrants(token, datasource) {
+			// unscoped grants apply to every datasource
+			if !slices.ContainsFunc(grants, func(g EffectiveGrant) bool { return reflect.DeepEqual(g, grant) }) {
+				grants = append(grants, grant)
+			}
+		}
+	}
+	response := struct {
+		Admin   bool             `json:"admin"`
+		Version *LabelsVersion   `json:"version,omitempty"`
+		Grants  []EffectiveGrant `json:"grants"`
+	}{Admin: isAdmin(token, a), Grants: grants}
+	if reloader, ok := a.LabelStore.(Reloader); ok {
+		version := reloader.Version()
+		response.Version = &version
+	}
+	writeJSON(w, response)
+}
+
+// handleLabelStoreVersion responds with the version of the loaded grants.
+func (a *App) handleLabelStoreVersion(w http.ResponseWriter, _ *http.Request) {
+	reloader, ok := a.LabelStore.(Reloader)
+	if !ok {
+		logAndWriteError(w, http.StatusNotImplemented, nil, "label store does not support reloading")
+		return
+	}
+	writeJSON(w, reloader.Version())
+}
+
+// handleLabelStoreReload reloads the grants and responds with their new
+// version. On error the previous grants stay active.
+func (a *App) handleLabelStoreReload(w http.ResponseWriter, _ *http.Request) {
+	reloader, ok := a.LabelStore.(Reloader)
+	if !ok {
+		logAndWriteError(w, http.StatusNotImplemented, nil, "label store does not support reloading")
+		return
+	}
+	version, err := reloader.Reload()
+	if err != nil {
+		logAndWriteError(w, http.StatusUnprocessableEntity, err, fmt.Sprintf("reload failed, keeping the previous labels: %s", err))
+		return
+	}
+	writeJSON(w, version)
+}
+
+// handleListGrants lists the grants, optionally of the subject given by the
+// "subject" parameter.
+func handleListGrants(store GrantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		grants, err := store.ListGrants(r.URL.Query().Get("subject"))
+		if err != nil {
+			logAndWriteError(w, http.StatusInternalServerError, err, "")
+			return
+		}
+		writeJSON(w, grants)
+	}
+}
+
+// handleCreateGrant creates the grant of the JSON body and responds with it.
+func handleCreateGrant(store GrantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var grant Grant
+		if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		grant, err := store.CreateGrant(grant)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		writeJSON(w, grant)
+	}
+}
+
+// handleUpdateGrant replaces the grant of the path with the JSON body.
+func handleUpdateGrant(store GrantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var grant Grant
+		if err := json.NewDecoder(r.Body).Decode(&grant); err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		grant.ID, _ = strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err := store.UpdateGrant(grant); err != nil {
+			writeGrantError(w, err)
+			return
+		}
+		writeJSON(w, grant)
+	}
+}
+
+// handleDeleteGrant deletes the grant of the path.
+func handleDeleteGrant(store GrantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, _ := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+		if err := store.DeleteGrant(id); err != nil {
+			writeGrantError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleExportLabels responds with every grant in the labels.yaml format.
+func handleExportLabels(store GrantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		raw, err := store.ExportLabels()
+		if err != nil {
+			logAndWriteError(w, http.StatusInternalServerError, err, "")
+			return
+		}
+		out, err := yaml.Marshal(raw)
+		if err != nil {
+			logAndWriteError(w, http.StatusInternalServerError, err, "")
+			return
+		}
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(out)
+	}
+}
+
+// handleImportLabels replaces every grant with the labels.yaml of the body.
+func handleImportLabels(store GrantStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		var raw map[string]map[string]any
+		if err := yaml.Unmarshal(body, &raw); err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		if err := store.ImportLabels(raw); err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// writeGrantError responds with 404 for unknown grants and 400 otherwise.
+func writeGrantError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errGrantNotFound) {
+		logAndWriteError(w, http.StatusNotFound, err, "")
+		return
+	}
+	logAndWriteError(w, http.StatusBadRequest, err, "")
+}
+
+// writeJSON writes v as JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logAndWriteError(w, http.StatusInternalServerError, err, "")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpiringGrants(t *testing.T) {
+	now := time.Now()
+	cmh := &ConfigMapHandler{
+		periods: map[grantKey]grantPeriod{
+			{Subject: "contractor", Label: "payments"}:                            {Expires: now.Add(time.Hour)},
+			{Subject: "oncall", Label: "billing", Datasource: DatasourceLogs}:     {Expires: now.Add(30 * time.Minute)},
+			{Subject: "oncall", Label: "shop"}:                                    {Expires: now.Add(30 * 24 * time.Hour)},
+			{Subject: "oncall", Label: "expired"}:                                 {Expires: now.Add(-time.Hour)},
+			{Subject: "oncall", Label: "upcoming", Datasource: DatasourceMetrics}: {NotBefore: now.Add(time.Hour)},
+		},
+	}
+	app := (&App{LabelStore: cmh}).WithHealthz().WithAdmin()
+
+	cases := []struct {
+		name     string
+		query    string
+		status   int
+		expected []string
+	}{
+		{name: "Default", status: http.StatusOK, expected: []string{"billing", "payments"}},
+		{name: "Within", query: "?within=45m", status: http.StatusOK, expected: []string{"billing"}},
+		{name: "None", query: "?within=1m", status: http.StatusOK, expected: []string{}},
+		{name: "Invalid", query: "?within=soon", status: http.StatusBadRequest},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/grants/expiring"+tc.query, nil))
+			assert.Equal(t, tc.status, rr.Code)
+			if tc.status != http.StatusOK {
+				return
+			}
+			var grants []ExpiringGrant
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &grants))
+			labels := []string{}
+			for _, grant := range grants {
+				labels = append(labels, grant.Label)
+			}
+			assert.Equal(t, tc.expected, labels)
+		})
+	}
+
+	rr := httptest.NewRecorder()
+	app.LabelStore = &MySQLHandler{}
+	app.i.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/admin/grants/expiring", nil))
+	assert.Equal(t, http.StatusNotImplemented, rr.Code)
+}
+
+func TestAdminGrants(t *testing.T) {
+	app := (&App{LabelStore: newTestSQLiteHandler(t)}).WithHealthz().WithAdmin()
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.i.ServeHTTP(rr, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return rr
+	}
+
+	rr := serve(http.MethodPost, "/admin/grants", `{"subject": "group1", "label": "payments", "datasource": "metrics"}`)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+	var grant Grant
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &grant))
+	assert.Equal(t, "payments", grant.Label)
+
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, "/admin/grants", `{"subject": "group1"}`).Code)
+
+	path := fmt.Sprintf("/admin/grants/%d", grant.ID)
+	assert.Equal(t, http.StatusOK, serve(http.MethodPut, path, `{"subject": "group1", "label": "billing"}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPut, "/admin/grants/42", `{"subject": "group1", "label": "billing"}`).Code)
+
+	rr = serve(http.MethodGet, "/admin/grants?subject=group1", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, fmt.Sprintf(`[{"id": %d, "subject": "group1", "label": "billing"}]`, grant.ID), rr.Body.String())
+
+	rr = serve(http.MethodGet, "/admin/labels.yaml", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "group1:\n    billing: true\n", rr.Body.String())
+
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodPut, "/admin/labels.yaml", "group2:\n  '#logs':\n    shop:\n      expires: 2030-01-01T00:00:00Z\n").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPut, "/admin/labels.yaml", "group2: [a]").Code)
+	rr = serve(http.MethodGet, "/admin/labels.yaml", "")
+	assert.Equal(t, "group2:\n    '#logs':\n        shop:\n            expires: 2030-01-01T00:00:00Z\n", rr.Body.String())
+
+	rr = serve(http.MethodGet, "/admin/grants", "")
+	var grants []Grant
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &grants))
+	assert.Len(t, grants, 1)
+	assert.Equal(t, http.StatusNoContent, serve(http.MethodDelete, fmt.Sprintf("/admin/grants/%d", grants[0].ID), "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, fmt.Sprintf("/admin/grants/%d", grants[0].ID), "").Code)
+}
+
+func TestAdminLabelStore(t *testing.T) {
+	cmh, path := newTestConfigMapHandler(t, "group1:\n  payments: true\n  '#logs':\n    audit: true\n")
+	_, err := cmh.Reload()
+	assert.NoError(t, err)
+	app := (&App{LabelStore: cmh, Cfg: &Config{Admin: AdminConfig{Bypass: true, Group: "admins"}}}).WithHealthz().WithAdmin()
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		app.i.ServeHTTP(rr, httptest.NewRequest(method, path, nil))
+		return rr
+	}
+
+	rr := serve(http.MethodGet, "/admin/grants/effective?group=group1&group=admins")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var effective struct {
+		Admin   bool
+		Version LabelsVersion
+		Grants  []EffectiveGrant
+	}
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &effective))
+	assert.True(t, effective.Admin)
+	assert.Equal(t, cmh.Version().Hash, effective.Version.Hash)
+	assert.Equal(t, []EffectiveGrant{
+		{Label: "payments", Subject: "group1"},
+		{Label: "audit", Subject: "group1", Datasource: DatasourceLogs},
+	}, effective.Grants)
+
+	rr = serve(http.MethodGet, "/admin/grants/effective?user=bob&datasource=metrics")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), `"grants":[]`)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/admin/grants/effective").Code)
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodGet, "/admin/grants/effective?user=bob&datasource=events").Code)
+
+	version := cmh.Version()
+	assert.NoError(t, os.WriteFile(path, []byte("group1: ["), 0o600))
+	assert.Equal(t, http.StatusUnprocessableEntity, serve(http.MethodPost, "/admin/labelstore/reload").Code)
+	rr = serve(http.MethodGet, "/admin/labelstore/version")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), version.Hash)
+
+	assert.NoError(t, os.WriteFile(path, []byte("group1:\n  billing: true\n"), 0o600))
+	rr = serve(http.MethodPost, "/admin/labelstore/reload")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.NotContains(t, rr.Body.String(), version.Hash)
+
+	app.LabelStore = &MySQLHandler{}
+	assert.Equal(t, http.StatusNotImplemented, serve(http.MethodPost, "/admin/labelstore/reload").Code)
+	assert.Equal(t, http.StatusNotImplemented, serve(http.MethodGet, "/admin/grants/effective?user=bob").Code)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// alertFilterRegex splits an Alertmanager filter like namespace=~"a|b" into
+// label name, matcher type and value. Values can be quoted or unquoted.
+var alertFilterRegex = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+// silence holds the fields of an Alertmanager silence needed to decide
+// whether it belongs to the tenants of a user.
+type silence struct {
+	ID       string           `json:"id,omitempty"`
+	Matchers []silenceMatcher `json:"matchers"`
+}
+
+// silenceMatcher is a matcher of an Alertmanager silence. IsEqual defaults
+// to true if it is not set.
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
+}
+
+// silenceLookupTimeout is the time allowed to fetch an existing silence that
+// is updated or expired.
+const silenceLookupTimeout = 30 * time.Second
+
+// WithAlertmanager configures and adds the Alertmanager API routes to the App's router,
+// logging warnings if the Alertmanager URL is not set, and returns the updated App.
+//
+// Alerts and alert groups are requested with the tenant matcher injected into the filter
+// and the responses are filtered to the alerts of the allowed tenants. Silences can only be
+// listed, created, updated and expired if their matchers are confined to the allowed tenants.
+// Alerts and silences are authorized with the metrics grants and the tenancy mode of the
+// Thanos config. Only the listed paths are registered, so other /api/v2 routes, e.g. the
+// Tempo search routes, are not captured.
+func (a *App) WithAlertmanager() *App {
+	if a.Cfg.Alertmanager.URL == "" {
+		log.Warn().Msg("Alertmanager URL not set, skipping Alertmanager routes")
+		return a
+	}
+	am := &alertmanagerProxy{
+		upstream:    upstream{url: parseUpstreamURL(a.Cfg.Alertmanager.URL), tls: a.Cfg.Alertmanager.UseMutualTLS, headers: a.Cfg.Alertmanager.Headers},
+		tenantLabel: a.Cfg.Alertmanager.TenantLabel,
+		a:           a,
+	}
+
+	a.e.HandleFunc("/api/v2/alerts", am.alerts(filterAlerts)).Methods(http.MethodGet).Name("/api/v2/alerts")
+	a.e.HandleFunc("/api/v2/alerts/groups", am.alerts(filterAlertGroups)).Methods(http.MethodGet).Name("/api/v2/alerts/groups")
+	a.e.HandleFunc("/api/v2/silences", am.listSilences).Methods(http.MethodGet).Name("/api/v2/silences")
+	a.e.HandleFunc("/api/v2/silences", am.postSilence).Methods(http.MethodPost).Name("/api/v2/silences")
+	a.e.HandleFunc("/api/v2/silence/{silenceID}", am.getSilence).Methods(http.MethodGet).Name("/api/v2/silence")
+	a.e.HandleFunc("/api/v2/silence/{silenceID}", am.deleteSilence).Methods(http.MethodDelete).Name("/api/v2/silence")
+	return a
+}
+
+type alertmanagerProxy struct {
+	upstream    upstream
+	tenantLabel string
+	a           *App
+}
+
+// authorize authorizes the request with the metrics grants and applies the
+// tenancy mode of the Thanos config like the ruler does. It returns the
+// request to forward, the tenant labels of the user and whether enforcement
+// can be skipped. If the request is not authorized, the error response is
+// written and false is returned.
+func (am *alertmanagerProxy) authorize(w http.ResponseWriter, r *http.Request) (*http.Request, TenantLabels, bool, bool) {
+	_, tenantLabels, skip, ok := authorizeRequest(w, r, DatasourceMetrics, am.a)
+	if !ok {
+		return r, tenantLabels, skip, false
+	}
+	r, enforce, ok := applyTenancy(w, r, DatasourceMetrics, tenantLabels, skip, am.a)
+	return r, tenantLabels, !enforce, ok
+}
+
+// alerts returns the handler for the alert and alert group endpoints. The
+// filter of the request is enforced and the response is passed through the
+// given response filter.
+func (am *alertmanagerProxy) alerts(filter func([]byte, TenantLabels, string) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r, tenantLabels, skip, ok := am.authorize(w, r)
+		if !ok {
+			return
+		}
+		if skip {
+			am.upstream.streamUp(w, r, am.a)
+			return
+		}
+
+		values := r.URL.Query()
+		filters, err := enforceAlertFilters(values["filter"], tenantLabels, am.tenantLabel)
+		if err != nil {
+			logAndWriteError(w, http.StatusForbidden, err, "")
+			return
+		}
+		values["filter"] = filters
+		r.URL.RawQuery = values.Encode()
+
+		am.upstream.streamUpAndFilter(w, r, am.a, func(body []byte) ([]byte, error) {
+			return filter(body, tenantLabels, am.tenantLabel)
+		})
+	}
+}
+
+// listSilences lists the silences confined to the tenants of the user.
+func (am *alertmanagerProxy) listSilences(w http.ResponseWriter, r *http.Request) {
+	r, tenantLabels, skip, ok := am.authorize(w, r)
+	if !ok {
+		return
+	}
+	if skip {
+		am.upstream.streamUp(w, r, am.a)
+		return
+	}
+	am.upstream.streamUpAndFilter(w, r, am.a, func(body []byte) ([]byte, error) {
+		return filterSilences(body, tenantLabels, am.tenantLabel)
+	})
+}
+
+// getSilence returns a silence if it is confined to the tenants of the user,
+// other silences are reported as not found.
+func (am *alertmanagerProxy) getSilence(w http.ResponseWriter, r *http.Request) {
+	r, tenantLabels, skip, ok := am.authorize(w, r)
+	if !ok {
+		return
+	}
+	if skip {
+		am.upstream.streamUp(w, r, am.a)
+		return
+	}
+	am.upstream.streamUpAndFilter(w, r, am.a, func(body []byte) ([]byte, error) {
+		var s silence
+		if err := json.Unmarshal(body, &s); err != nil {
+			return nil, fmt.Errorf("invalid silence: %w", err)
+		}
+		if err := s.confinedTo(tenantLabels, am.tenantLabel); err != nil {
+			return nil, fmt.Errorf("silence %w", errNotFound)
+		}
+		return body, nil
+	})
+}
+
+// postSilence creates or updates a silence if its matchers are confined to
+// the tenants of the user. Updating a silence expires the existing one, so
+// the existing silence has to be confined to the tenants of the user too.
+func (am *alertmanagerProxy) postSilence(w http.ResponseWriter, r *http.Request) {
+	r, tenantLabels, skip, ok := am.authorize(w, r)
+	if !ok {
+		return
+	}
+	if skip {
+		am.upstream.streamUp(w, r, am.a)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "")
+		return
+	}
+	var s silence
+	if err := json.Unmarshal(body, &s); err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "")
+		return
+	}
+	if err := s.confinedTo(tenantLabels, am.tenantLabel); err != nil {
+		logAndWriteError(w, http.StatusForbidden, err, "")
+		return
+	}
+	if s.ID != "" && !am.authorizeExisting(w, r, s.ID, tenantLabels) {
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	am.upstream.streamUp(w, r, am.a)
+}
+
+// deleteSilence expires a silence if it is confined to the tenants of the user.
+func (am *alertmanagerProxy) deleteSilence(w http.ResponseWriter, r *http.Request) {
+	r, tenantLabels, skip, ok := am.authorize(w, r)
+	if !ok {
+		return
+	}
+	if !skip && !am.authorizeExisting(w, r, mux.Vars(r)["silenceID"], tenantLabels) {
+		return
+	}
+	am.upstream.streamUp(w, r, am.a)
+}
+
+// authorizeExisting fetches an existing silence from the Alertmanager with
+// the transport, headers and org ID the request is forwarded with, and checks
+// that it is confined to the tenants of the user. If it is not, the error
+// response is written and false is returned.
+func (am *alertmanagerProxy) authorizeExisting(w http.ResponseWriter, r *http.Request, id string, tenantLabels TenantLabels) bool {
+	ctx, cancel := context.WithTimeout(r.Context(), silenceLookupTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, am.upstream.url.JoinPath("/api/v2/silence").String()+"/"+url.PathEscape(id), nil)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "")
+		return false
+	}
+	setHeaders(req, am.upstream.tls, am.upstream.headers, am.a.ServiceAccountToken)
+	resp, err := am.upstream.client().Do(req)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadGateway, err, "")
+		return false
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		logAndWriteError(w, resp.StatusCode, nil, fmt.Sprintf("silence %s: %s", id, http.StatusText(resp.StatusCode)))
+		return false
+	}
+
+	var s silence
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		logAndWriteError(w, http.StatusBadGateway, err, "")
+		return false
+	}
+	if err := s.confinedTo(tenantLabels, am.tenantLabel); err != nil {
+		logAndWriteError(w, http.StatusNotFound, err, fmt.Sprintf("silence %s not found", id))
+		return false
+	}
+	return true
+}
+
+// confinedTo returns an error unless the matchers of the silence are confined
+// to the tenant labels, see TenantLabels.Confines.
+func (s silence) confinedTo(tenantLabels TenantLabels, name string) error {
+	matchers := make([]*labels.Matcher, 0, len(s.Matchers))
+	for _, m := range s.Matchers {
+		matchType := labels.MatchEqual
+		switch equal := m.IsEqual == nil || *m.IsEqual; {
+		case m.IsRegex && equal:
+			matchType = labels.MatchRegexp
+		case m.IsRegex:
+			matchType = labels.MatchNotRegexp
+		case !equal:
+			matchType = labels.MatchNotEqual
+		}
+		matcher, err := labels.NewMatcher(matchType, m.Name, m.Value)
+		if err != nil {
+			return fmt.Errorf("invalid matcher %s: %w", m.Name, err)
+		}
+		matchers = append(matchers, matcher)
+	}
+	return tenantLabels.Confines(matchers, name)
+}
+
+// enforceAlertFilters restricts the filter of an alert request to the tenant
+// labels like a selector of a query. Tuple grants that cannot be expressed as
+// a single filter are left to the filtering of the response.
+func enforceAlertFilters(filters []string, tenantLabels TenantLabels, name string) ([]string, error) {
+	matchers := make([]*labels.Matcher, 0, len(filters)+1)
+	for _, filter := range filters {
+		matcher, err := parseAlertFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, matcher)
+	}
+
+	if err := tenantLabels.CheckExclusions(matchers, name); err != nil {
+		return nil, err
+	}
+	switch {
+	case tenantLabels.ClusterWide:
+		// every value except the exclusions is granted
+	case len(tenantLabels.Tuples) > 0:
+		restricted, err := RestrictSelectors(matchers, tenantLabels.Selectors(name))
+		if err != nil {
+			return nil, err
+		}
+		if len(restricted) == 1 {
+			matchers = restricted[0]
+		}
+	default:
+		var err error
+		matchers, err = tenantLabels.RestrictMatchers(matchers, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if exclusion := tenantLabels.ExclusionMatcher(name); exclusion != nil {
+		matchers = append(matchers, exclusion)
+	}
+
+	enforced := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		enforced = append(enforced, matcher.String())
+	}
+	return enforced, nil
+}
+
+// parseAlertFilter parses a matcher of an Alertmanager filter.
+func parseAlertFilter(filter string) (*labels.Matcher, error) {
+	parts := alertFilterRegex.FindStringSubmatch(filter)
+	if parts == nil {
+		return nil, fmt.Errorf("invalid filter %s", filter)
+	}
+	value := parts[3]
+	if len(value) > 0 && value[0] == '"' {
+		var err error
+		if value, err = strconv.Unquote(value); err != nil {
+			return nil, fmt.Errorf("invalid filter %s: %w", filter, err)
+		}
+	}
+	matchType := map[string]labels.MatchType{
+		"=":  labels.MatchEqual,
+		"!=": labels.MatchNotEqual,
+		"=~": labels.MatchRegexp,
+		"!~": labels.MatchNotRegexp,
+	}[parts[2]]
+	return labels.NewMatcher(matchType, parts[1], value)
+}
+
+// filterAlerts removes the alerts of tenants that are not allowed from a
+// list of alerts.
+func filterAlerts(body []byte, tenantLabels TenantLabels, name string) ([]byte, error) {
+	var alerts []json.RawMessage
+	if err := json.Unmarshal(body, &alerts); err != nil {
+		return nil, fmt.Errorf("invalid alerts: %w", err)
+	}
+	allowed, err := allowedAlerts(alerts, tenantLabels, name)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(allowed)
+}
+
+// filterAlertGroups removes the alerts of tenants that are not allowed from
+// a list of alert groups, groups without remaining alerts are removed.
+func filterAlertGroups(body []byte, tenantLabels TenantLabels, name string) ([]byte, error) {
+	var groups []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &groups); err != nil {
+		return nil, fmt.Errorf("invalid alert groups: %w", err)
+	}
+	allowedGroups := make([]map[string]json.RawMessage, 0, len(groups))
+	for _, group := range groups {
+		var alerts []json.RawMessage
+		if err := json.Unmarshal(group["alerts"], &alerts); err != nil {
+			return nil, fmt.Errorf("invalid alert group: %w", err)
+		}
+		allowed, err := allowedAlerts(alerts, tenantLabels, name)
+		if err != nil {
+			return nil, err
+		}
+		if len(allowed) == 0 {
+			continue
+		}
+		if group["alerts"], err = json.Marshal(allowed); err != nil {
+			return nil, err
+		}
+		allowedGroups = append(allowedGroups, group)
+	}
+	return json.Marshal(allowedGroups)
+}
+
+func allowedAlerts(alerts []json.RawMessage, tenantLabels TenantLabels, name string) ([]json.RawMessage, error) {
+	allowed := make([]json.RawMessage, 0, len(alerts))
+	for _, alert := range alerts {
+		var a struct {
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(alert, &a); err != nil {
+			return nil, fmt.Errorf("invalid alert: %w", err)
+		}
+		if tenantLabels.AllowsLabelSet(a.Labels, name) {
+			allowed = append(allowed, alert)
+		}
+	}
+	return allowed, nil
+}
+
+// filterSilences removes the silences not confined to the tenant labels
+// from a list of silences.
+func filterSilences(body []byte, tenantLabels TenantLabels, name string) ([]byte, error) {
+	var silences []json.RawMessage
+	if err := json.Unmarshal(body, &silences); err != nil {
+		return nil, fmt.Errorf("invalid silences: %w", err)
+	}
+	allowed := make([]json.RawMessage, 0, len(silences))
+	for _, raw := range silences {
+		var s silence
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return nil, fmt.Errorf("invalid silence: %w", err)
+		}
+		if s.confinedTo(tenantLabels, name) == nil {
+			allowed = append(allowed, raw)
+		}
+	}
+	return json.Marshal(allowed)
+}
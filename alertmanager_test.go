@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceAlertFilters(t *testing.T) {
+	tests := []struct {
+		name         string
+		filters      []string
+		tenantLabels TenantLabels
+		want         []string
+		wantErr      bool
+	}{
+		{
+			name:         "No filter",
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         []string{`namespace=~"billing|payments"`},
+		},
+		{
+			name:         "Unquoted filters",
+			filters:      []string{"alertname=KubePodCrashLooping", "namespace=payments"},
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         []string{`alertname="KubePodCrashLooping"`, `namespace="payments"`},
+		},
+		{
+			name:         "Forbidden tenant",
+			filters:      []string{`namespace="shop"`},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Negative filter",
+			filters:      []string{`namespace!="billing"`},
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         []string{`namespace!="billing"`, `namespace=~"billing|payments"`},
+		},
+		{
+			name:         "Cluster-wide with exclusion",
+			filters:      []string{`severity="critical"`},
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			want:         []string{`severity="critical"`, `namespace!="vault"`},
+		},
+		{
+			name:         "Invalid filter",
+			filters:      []string{`namespace`},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := enforceAlertFilters(tt.filters, tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestSilenceConfinedTo(t *testing.T) {
+	notEqual := false
+	tuples := NewTenantLabels(`{cluster="prod-eu", namespace="payments"}`, "billing")
+	tests := []struct {
+		name         string
+		matchers     []silenceMatcher
+		tenantLabels TenantLabels
+		wantErr      bool
+	}{
+		{
+			name:         "Allowed tenant",
+			matchers:     []silenceMatcher{{Name: "alertname", Value: "Watchdog"}, {Name: "namespace", Value: "payments"}},
+			tenantLabels: NewTenantLabels("payments"),
+		},
+		{
+			name:         "Allowed tenants",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "payments|billing", IsRegex: true}},
+			tenantLabels: NewTenantLabels("payments", "billing"),
+		},
+		{
+			name:         "Tenant outside pattern grant",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "payments"}, {Name: "pod", Value: "api-.*", IsRegex: true, IsEqual: &notEqual}},
+			tenantLabels: NewTenantLabels("team-*"),
+			wantErr:      true,
+		},
+		{
+			name:         "Pattern grant",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "team-a|team-b", IsRegex: true}},
+			tenantLabels: NewTenantLabels("team-*"),
+		},
+		{
+			name:         "No tenant matcher",
+			matchers:     []silenceMatcher{{Name: "alertname", Value: "Watchdog"}},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Negative tenant matcher",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "billing", IsEqual: &notEqual}},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Regex tenant matcher",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "pay.*", IsRegex: true}},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Forbidden tenant",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "payments|shop", IsRegex: true}},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Tuple grant",
+			matchers:     []silenceMatcher{{Name: "cluster", Value: "prod-eu"}, {Name: "namespace", Value: "payments"}},
+			tenantLabels: tuples,
+		},
+		{
+			name:         "Tuple grant without cluster",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "payments"}},
+			tenantLabels: tuples,
+			wantErr:      true,
+		},
+		{
+			name:         "Excluded tenant",
+			matchers:     []silenceMatcher{{Name: "namespace", Value: "vault"}},
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := silence{Matchers: tt.matchers}.confinedTo(tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestFilterAlertGroups(t *testing.T) {
+	groups := `[
+		{"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[{"labels":{"namespace":"payments"}},{"labels":{"namespace":"shop"}}]},
+		{"labels":{"alertname":"B"},"receiver":{"name":"default"},"alerts":[{"labels":{"namespace":"shop"}}]}
+	]`
+	filtered, err := filterAlertGroups([]byte(groups), NewTenantLabels("payments"), "namespace")
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"labels":{"alertname":"A"},"receiver":{"name":"default"},"alerts":[{"labels":{"namespace":"payments"}}]}]`, string(filtered))
+}
+
+func TestWithAlertmanager(t *testing.T) {
+	app, tokens := setupTestMain()
+	silences := map[string]string{
+		"own":   `{"id":"own","matchers":[{"name":"tenant_id","value":"allowed_user","isRegex":false}]}`,
+		"other": `{"id":"other","matchers":[{"name":"tenant_id","value":"other","isRegex":false}]}`,
+	}
+	var filters []string
+	var deleted []string
+	var orgIDs []string
+	alertmanager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orgIDs = append(orgIDs, r.Header.Get(orgIDHeader))
+		switch {
+		case r.URL.Path == "/api/v2/alerts":
+			filters = r.URL.Query()["filter"]
+			_, _ = fmt.Fprint(w, `[{"labels":{"tenant_id":"allowed_user"}},{"labels":{"tenant_id":"other"}}]`)
+		case r.URL.Path == "/api/v2/silences" && r.Method == http.MethodGet:
+			_, _ = fmt.Fprintf(w, "[%s,%s]", silences["own"], silences["other"])
+		case r.URL.Path == "/api/v2/silences" && r.Method == http.MethodPost:
+			_, _ = fmt.Fprint(w, `{"silenceID":"new"}`)
+		case strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+			id := strings.TrimPrefix(r.URL.Path, "/api/v2/silence/")
+			s, ok := silences[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			if r.Method == http.MethodDelete {
+				deleted = append(deleted, id)
+				return
+			}
+			_, _ = fmt.Fprint(w, s)
+		}
+	}))
+	defer alertmanager.Close()
+	app.Cfg.Alertmanager.URL = alertmanager.URL
+	app.Cfg.Alertmanager.TenantLabel = "tenant_id"
+	app.WithRoutes()
+
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set(orgIDHeader, "other")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodGet, "/api/v2/alerts?filter=alertname%3DWatchdog", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{`alertname="Watchdog"`, `tenant_id=~"allowed_user|also_allowed_user"`}, filters)
+	assert.JSONEq(t, `[{"labels":{"tenant_id":"allowed_user"}}]`, rr.Body.String())
+
+	rr = serve(http.MethodGet, "/api/v2/silences", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var listed []silence
+	assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &listed))
+	assert.Len(t, listed, 1)
+	assert.Equal(t, "own", listed[0].ID)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, "/api/v2/silence/own", "").Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/api/v2/silence/other", "").Code)
+
+	rr = serve(http.MethodPost, "/api/v2/silences", `{"matchers":[{"name":"tenant_id","value":"allowed_user","isRegex":false}],"comment":"maintenance"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	body, _ := io.ReadAll(rr.Body)
+	assert.Contains(t, string(body), "new")
+	assert.Equal(t, http.StatusForbidden, serve(http.MethodPost, "/api/v2/silences", `{"matchers":[{"name":"alertname","value":"Watchdog","isRegex":false}]}`).Code)
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, "/api/v2/silences", `{"id":"other","matchers":[{"name":"tenant_id","value":"allowed_user","isRegex":false}]}`).Code)
+
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodDelete, "/api/v2/silence/other", "").Code)
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/api/v2/silence/own", "").Code)
+	assert.Equal(t, []string{"own"}, deleted)
+
+	// other /api/v2 paths are not proxied
+	orgIDs = nil
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodGet, "/api/v2/status", "").Code)
+	assert.Nil(t, orgIDs)
+
+	// the tenancy mode applies to the request and the lookup of the silence
+	app.Cfg.Thanos.TenancyMode = TenancyModeLabelAndOrgID
+	app.WithRoutes()
+	assert.Equal(t, http.StatusOK, serve(http.MethodDelete, "/api/v2/silence/own", "").Code)
+	assert.Equal(t, []string{"allowed_user|also_allowed_user", "allowed_user|also_allowed_user"}, orgIDs)
+}
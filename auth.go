@@ -7,17 +7,18 @@ import (
 	"strings"
 
 	"github.com/rs/zerolog/log"
-	"golang.org/x/exp/maps"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
 // OAuthToken represents the structure of an OAuth token.
-// It holds user-related information extracted from the token.
+// It holds user-related information extracted from the token and the raw
+// claims for label stores reading custom claims.
 type OAuthToken struct {
-	Groups            []string `json:"-,omitempty"`
-	PreferredUsername string   `json:"preferred_username"`
-	Email             string   `json:"email"`
+	Groups            []string       `json:"-,omitempty"`
+	PreferredUsername string         `json:"preferred_username"`
+	Email             string         `json:"email"`
+	Claims            map[string]any `json:"-"`
 	jwt.RegisteredClaims
 }
 
@@ -64,6 +65,7 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 	if !token.Valid {
 		log.Trace().Msg("Token is invalid")
 	}
+	oAuthToken.Claims = claimsMap
 
 	if v, ok := claimsMap["preferred_username"].(string); ok {
 		oAuthToken.PreferredUsername = v
@@ -78,6 +80,13 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 		oAuthToken.Email = v
 	}
 
+	if exp, err := claimsMap.GetExpirationTime(); err == nil {
+		oAuthToken.ExpiresAt = exp
+	}
+	if sub, err := claimsMap.GetSubject(); err == nil {
+		oAuthToken.Subject = sub
+	}
+
 	if v, ok := claimsMap[a.Cfg.Web.OAuthGroupName].([]interface{}); ok {
 		for _, item := range v {
 			if s, ok := item.(string); ok {
@@ -90,25 +99,25 @@ func parseJwtToken(tokenString string, a *App) (OAuthToken, *jwt.Token, error) {
 	return oAuthToken, token, err
 }
 
-// validateLabels validates the labels in the OAuth token.
+// validateLabels validates the labels in the OAuth token for the queried datasource.
 // It checks if the user is an admin and skips label enforcement if true.
 // Returns a map representing valid labels, a boolean indicating whether label enforcement should be skipped,
 // and any error that occurred during validation.
-func validateLabels(token OAuthToken, a *App) (map[string]bool, bool, error) {
+func validateLabels(token OAuthToken, datasource Datasource, a *App) (TenantLabels, bool, error) {
 	if isAdmin(token, a) {
 		log.Debug().Str("user", token.PreferredUsername).Bool("Admin", true).Msg("Skipping label enforcement")
-		return nil, true, nil
+		return TenantLabels{}, true, nil
 	}
 
-	tenantLabels, skip := a.LabelStore.GetLabels(token)
+	tenantLabels, skip := a.LabelStore.GetLabels(token, datasource)
 	if skip {
 		log.Debug().Str("user", token.PreferredUsername).Bool("Admin", false).Msg("Skipping label enforcement")
-		return nil, true, nil
+		return TenantLabels{}, true, nil
 	}
-	log.Debug().Str("user", token.PreferredUsername).Strs("labels", maps.Keys(tenantLabels)).Msg("")
+	log.Debug().Str("user", token.PreferredUsername).Str("datasource", string(datasource)).Strs("labels", tenantLabels.Strings()).Msg("")
 
-	if len(tenantLabels) < 1 {
-		return nil, false, fmt.Errorf("no tenant labels found")
+	if tenantLabels.Empty() {
+		return TenantLabels{}, false, fmt.Errorf("no tenant labels found")
 	}
 	return tenantLabels, false, nil
 }
@@ -50,6 +50,7 @@ func TestParseJwtToken_ValidToken(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, "not-a-user", oauthToken.PreferredUsername)
 	assert.Equal(t, "test@email.com", oauthToken.Email)
+	assert.Equal(t, "not-a-user", oauthToken.Claims["preferred_username"])
 }
 
 func TestParseJwtToken_InvalidToken(t *testing.T) {
@@ -71,11 +72,11 @@ func TestValidateLabels_AdminUser(t *testing.T) {
 	app.Cfg.Admin.Group = "admins"
 	app.Cfg.Admin.Bypass = true
 
-	tenantLabels, skip, err := validateLabels(oauthToken, &app)
+	tenantLabels, skip, err := validateLabels(oauthToken, DatasourceMetrics, &app)
 
 	assert.NoError(t, err)
 	assert.True(t, skip)
-	assert.Nil(t, tenantLabels)
+	assert.Nil(t, tenantLabels.Values)
 }
 
 func TestValidateLabels_NonAdminUserWithValidLabels(t *testing.T) {
@@ -84,12 +85,12 @@ func TestValidateLabels_NonAdminUserWithValidLabels(t *testing.T) {
 
 	oauthToken, _, _ := parseJwtToken(tokenString, &app)
 
-	tenantLabels, skip, err := validateLabels(oauthToken, &app)
+	tenantLabels, skip, err := validateLabels(oauthToken, DatasourceMetrics, &app)
 
 	assert.NoError(t, err)
 	assert.False(t, skip)
-	assert.NotNil(t, tenantLabels)
-	assert.Contains(t, tenantLabels, "allowed_user")
+	assert.NotNil(t, tenantLabels.Values)
+	assert.Contains(t, tenantLabels.Values, "allowed_user")
 }
 
 func TestValidateLabels_NonAdminUserWithoutLabels(t *testing.T) {
@@ -98,11 +99,11 @@ func TestValidateLabels_NonAdminUserWithoutLabels(t *testing.T) {
 
 	oauthToken, _, _ := parseJwtToken(tokenString, &app)
 
-	tenantLabels, skip, err := validateLabels(oauthToken, &app)
+	tenantLabels, skip, err := validateLabels(oauthToken, DatasourceMetrics, &app)
 
 	assert.Error(t, err)
 	assert.False(t, skip)
-	assert.Nil(t, tenantLabels)
+	assert.Nil(t, tenantLabels.Values)
 }
 
 func TestIsAdmin_ValidAdminUser(t *testing.T) {
@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 type LogConfig struct {
@@ -60,6 +61,38 @@ type DbConfig struct {
 	TokenKey     string `mapstructure:"token_key"`
 }
 
+type SQLiteConfig struct {
+	Path string `mapstructure:"path"`
+}
+
+type ClaimsConfig struct {
+	Path          string            `mapstructure:"path"`
+	ValueRegex    string            `mapstructure:"value_regex"`
+	PrefixMapping map[string]string `mapstructure:"prefix_mapping"`
+}
+
+type KubernetesConfig struct {
+	NamespaceSelectors bool          `mapstructure:"namespace_selectors"`
+	Kubeconfig         string        `mapstructure:"kubeconfig"`
+	ResyncPeriod       time.Duration `mapstructure:"resync_period"`
+}
+
+// UpstreamConfig is an upstream of a datasource serving the tenant label
+// values, literal or patterns, in Tenants. It is the default upstream of the
+// users in one of the Groups, see upstreamRouter. RemoteWriteURL and RulerURL
+// are the remote write and Mimir ruler URLs of Thanos upstreams.
+type UpstreamConfig struct {
+	URL            string            `mapstructure:"url"`
+	RemoteWriteURL string            `mapstructure:"remote_write_url"`
+	RulerURL       string            `mapstructure:"ruler_url"`
+	Tenants        []string          `mapstructure:"tenants"`
+	Groups         []string          `mapstructure:"groups"`
+	UseMutualTLS   bool              `mapstructure:"use_mutual_tls"`
+	Cert           string            `mapstructure:"cert"`
+	Key            string            `mapstructure:"key"`
+	Headers        map[string]string `mapstructure:"headers"`
+}
+
 type ThanosConfig struct {
 	URL          string            `mapstructure:"url"`
 	TenantLabel  string            `mapstructure:"tenant_label"`
@@ -68,6 +101,25 @@ type ThanosConfig struct {
 	Key          string            `mapstructure:"key"`
 	Headers      map[string]string `mapstructure:"headers"`
 	ActorHeader  string            `mapstructure:"actor_header"`
+	// FilterLabelResponses verifies the responses of the label APIs, see labelVerifier.
+	FilterLabelResponses bool `mapstructure:"filter_label_responses"`
+	// RemoteWriteURL is the URL remote write requests are forwarded to, the URL if empty.
+	RemoteWriteURL string `mapstructure:"remote_write_url"`
+	// RemoteWriteInjectTenantLabel injects the tenant label into written series without it.
+	RemoteWriteInjectTenantLabel bool `mapstructure:"remote_write_inject_tenant_label"`
+	// RulerURL is the URL of the Mimir ruler API, the ruler routes are only served if it is set.
+	RulerURL string `mapstructure:"ruler_url"`
+	// RulerUseMutualTLS, RulerCert, RulerKey and RulerHeaders configure the requests to the RulerURL.
+	RulerUseMutualTLS bool              `mapstructure:"ruler_use_mutual_tls"`
+	RulerCert         string            `mapstructure:"ruler_cert"`
+	RulerKey          string            `mapstructure:"ruler_key"`
+	RulerHeaders      map[string]string `mapstructure:"ruler_headers"`
+	// Upstreams serve the queries of some tenants instead of the URL.
+	Upstreams []UpstreamConfig `mapstructure:"upstreams"`
+	// RejectFanOut rejects queries selecting tenants of several upstreams instead of merging their responses.
+	RejectFanOut bool `mapstructure:"reject_fan_out"`
+	// TenancyMode selects between tenant label enforcement and X-Scope-OrgID headers, see TenancyMode.
+	TenancyMode TenancyMode `mapstructure:"tenancy_mode"`
 }
 
 type LokiConfig struct {
@@ -78,17 +130,72 @@ type LokiConfig struct {
 	Key          string            `mapstructure:"key"`
 	Headers      map[string]string `mapstructure:"headers"`
 	ActorHeader  string            `mapstructure:"actor_header"`
+	// FilterLabelResponses verifies the responses of the label APIs, see labelVerifier.
+	FilterLabelResponses bool `mapstructure:"filter_label_responses"`
+	// PushInjectTenantLabel injects the tenant label into pushed streams without it.
+	PushInjectTenantLabel bool `mapstructure:"push_inject_tenant_label"`
+	// TailMaxSessions limits the concurrent tail sessions per user, unlimited if 0.
+	TailMaxSessions int `mapstructure:"tail_max_sessions"`
+	// TailMaxDuration limits the duration of tail sessions, unlimited if 0.
+	TailMaxDuration time.Duration `mapstructure:"tail_max_duration"`
+	// Upstreams serve the queries of some tenants instead of the URL.
+	Upstreams []UpstreamConfig `mapstructure:"upstreams"`
+	// RejectFanOut rejects queries selecting tenants of several upstreams instead of merging their responses.
+	RejectFanOut bool `mapstructure:"reject_fan_out"`
+	// TenancyMode selects between tenant label enforcement and X-Scope-OrgID headers, see TenancyMode.
+	TenancyMode TenancyMode `mapstructure:"tenancy_mode"`
+}
+
+type TempoConfig struct {
+	URL          string            `mapstructure:"url"`
+	TenantLabel  string            `mapstructure:"tenant_label"`
+	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
+	Cert         string            `mapstructure:"cert"`
+	Key          string            `mapstructure:"key"`
+	Headers      map[string]string `mapstructure:"headers"`
+}
+
+type PyroscopeConfig struct {
+	URL          string            `mapstructure:"url"`
+	TenantLabel  string            `mapstructure:"tenant_label"`
+	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
+	Cert         string            `mapstructure:"cert"`
+	Key          string            `mapstructure:"key"`
+	Headers      map[string]string `mapstructure:"headers"`
+}
+
+type AlertmanagerConfig struct {
+	URL          string            `mapstructure:"url"`
+	TenantLabel  string            `mapstructure:"tenant_label"`
+	UseMutualTLS bool              `mapstructure:"use_mutual_tls"`
+	Cert         string            `mapstructure:"cert"`
+	Key          string            `mapstructure:"key"`
+	Headers      map[string]string `mapstructure:"headers"`
+}
+
+// OTLPConfig configures the OTLP ingestion routes. TenantAttribute is the
+// resource attribute holding the tenant label value, e.g. k8s.namespace.name.
+type OTLPConfig struct {
+	TenantAttribute   string `mapstructure:"tenant_attribute"`
+	StripUnauthorized bool   `mapstructure:"strip_unauthorized"`
 }
 
 type Config struct {
-	Log    LogConfig    `mapstructure:"log"`
-	Web    WebConfig    `mapstructure:"web"`
-	Admin  AdminConfig  `mapstructure:"admin"`
-	Alert  AlertConfig  `mapstructure:"alert"`
-	Dev    DevConfig    `mapstructure:"dev"`
-	Db     DbConfig     `mapstructure:"db"`
-	Thanos ThanosConfig `mapstructure:"thanos"`
-	Loki   LokiConfig   `mapstructure:"loki"`
+	Log          LogConfig          `mapstructure:"log"`
+	Web          WebConfig          `mapstructure:"web"`
+	Admin        AdminConfig        `mapstructure:"admin"`
+	Alert        AlertConfig        `mapstructure:"alert"`
+	Dev          DevConfig          `mapstructure:"dev"`
+	Db           DbConfig           `mapstructure:"db"`
+	SQLite       SQLiteConfig       `mapstructure:"sqlite"`
+	Claims       ClaimsConfig       `mapstructure:"claims"`
+	Kubernetes   KubernetesConfig   `mapstructure:"kubernetes"`
+	Thanos       ThanosConfig       `mapstructure:"thanos"`
+	Loki         LokiConfig         `mapstructure:"loki"`
+	Tempo        TempoConfig        `mapstructure:"tempo"`
+	Pyroscope    PyroscopeConfig    `mapstructure:"pyroscope"`
+	Alertmanager AlertmanagerConfig `mapstructure:"alertmanager"`
+	OTLP         OTLPConfig         `mapstructure:"otlp"`
 }
 
 func (a *App) WithConfig() *App {
@@ -191,6 +298,36 @@ func (a *App) WithTLSConfig() *App {
 		certificates = append(certificates, thanosCert)
 	}
 
+	if a.Cfg.Tempo.UseMutualTLS {
+		tempoCert, err := tls.LoadX509KeyPair(a.Cfg.Tempo.Cert, a.Cfg.Tempo.Key)
+		if err != nil {
+			log.Error().Err(err).Msg("Error while loading tempo certificate")
+		} else {
+			log.Debug().Str("path", a.Cfg.Tempo.Cert).Msg("Adding Tempo certificate")
+			certificates = append(certificates, tempoCert)
+		}
+	}
+
+	if a.Cfg.Pyroscope.UseMutualTLS {
+		pyroscopeCert, err := tls.LoadX509KeyPair(a.Cfg.Pyroscope.Cert, a.Cfg.Pyroscope.Key)
+		if err != nil {
+			log.Error().Err(err).Msg("Error while loading pyroscope certificate")
+		} else {
+			log.Debug().Str("path", a.Cfg.Pyroscope.Cert).Msg("Adding Pyroscope certificate")
+			certificates = append(certificates, pyroscopeCert)
+		}
+	}
+
+	if a.Cfg.Alertmanager.UseMutualTLS {
+		alertmanagerCert, err := tls.LoadX509KeyPair(a.Cfg.Alertmanager.Cert, a.Cfg.Alertmanager.Key)
+		if err != nil {
+			log.Error().Err(err).Msg("Error while loading alertmanager certificate")
+		} else {
+			log.Debug().Str("path", a.Cfg.Alertmanager.Cert).Msg("Adding Alertmanager certificate")
+			certificates = append(certificates, alertmanagerCert)
+		}
+	}
+
 	config := &tls.Config{
 		InsecureSkipVerify: a.Cfg.Web.TLSVerifySkip,
 		RootCAs:            rootCAs,
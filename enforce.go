@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strings"
 
 	"github.com/rs/zerolog/log"
@@ -12,12 +13,18 @@ import (
 // EnforceQL represents an interface that any query language enforcement should implement.
 // It contains a method to enforce queries based on tenant labels and label match.
 type EnforceQL interface {
-	Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error)
+	Enforce(query string, tenantLabels TenantLabels, labelMatch string) (string, error)
+}
+
+// SelectorEnforcer is implemented by enforcers that can enforce a series
+// selector into several selectors, one per granted alternative.
+type SelectorEnforcer interface {
+	EnforceSelectors(selector string, tenantLabels TenantLabels, labelMatch string) ([]string, error)
 }
 
 // enforceRequest enforces the incoming HTTP request based on its method (GET or POST).
 // It delegates the enforcement to enforceGet or enforcePost functions based on the HTTP method of the request.
-func enforceRequest(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool, labelMatch string, queryMatch string) error {
+func enforceRequest(r *http.Request, enforce EnforceQL, tenantLabels TenantLabels, labelMatch string, queryMatch string) error {
 	switch r.Method {
 	case http.MethodGet:
 		return enforceGet(r, enforce, tenantLabels, labelMatch, queryMatch)
@@ -30,16 +37,17 @@ func enforceRequest(r *http.Request, enforce EnforceQL, tenantLabels map[string]
 
 // enforceGet enforces the query parameters of the incoming GET HTTP request.
 // It modifies the request URL's query parameters to ensure they adhere to tenant labels and label match.
-func enforceGet(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool, labelMatch string, queryMatch string) error {
-	log.Trace().Str("kind", "urlmatch").Str("queryMatch", queryMatch).Str("query", r.URL.Query().Get("query")).Str("match[]", r.URL.Query().Get("match[]")).Msg("")
+func enforceGet(r *http.Request, enforce EnforceQL, tenantLabels TenantLabels, labelMatch string, queryMatch string) error {
+	values := r.URL.Query()
+	log.Trace().Str("kind", "urlmatch").Str("queryMatch", queryMatch).Strs("query", values["query"]).Strs("match[]", values["match[]"]).Msg("")
 
-	query, err := enforce.Enforce(r.URL.Query().Get(queryMatch), tenantLabels, labelMatch)
-	if err != nil {
+	if !values.Has(queryMatch) {
+		values.Set(queryMatch, "")
+	}
+	if err := enforceValues(values, enforce, tenantLabels, labelMatch, queryMatch); err != nil {
 		return err
 	}
 	log.Trace().Any("url", r.URL).Msg("pre enforced url")
-	values := r.URL.Query()
-	values.Set(queryMatch, query)
 	r.URL.RawQuery = values.Encode()
 	log.Trace().Any("url", r.URL).Msg("post enforced url")
 
@@ -50,23 +58,62 @@ func enforceGet(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool
 
 // enforcePost enforces the form values of the incoming POST HTTP request.
 // It modifies the request's form values to ensure they adhere to tenant labels and label match.
-func enforcePost(r *http.Request, enforce EnforceQL, tenantLabels map[string]bool, labelMatch string, queryMatch string) error {
+// Upstreams read the query from both the form and the URL, so the query parameters of the URL
+// are enforced as well. If neither carries a query, the enforced query is added to the form.
+func enforcePost(r *http.Request, enforce EnforceQL, tenantLabels TenantLabels, labelMatch string, queryMatch string) error {
 	if err := r.ParseForm(); err != nil {
 		return err
 	}
-	log.Trace().Str("kind", "bodymatch").Str("queryMatch", queryMatch).Str("query", r.PostForm.Get("query")).Str("match[]", r.PostForm.Get("match[]")).Msg("")
+	urlValues := r.URL.Query()
+	log.Trace().Str("kind", "bodymatch").Str("queryMatch", queryMatch).Strs("query", r.Form["query"]).Strs("match[]", r.Form["match[]"]).Msg("")
 
-	query := r.PostForm.Get(queryMatch)
-	query, err := enforce.Enforce(query, tenantLabels, labelMatch)
-	if err != nil {
+	if !r.PostForm.Has(queryMatch) && !urlValues.Has(queryMatch) {
+		r.PostForm.Set(queryMatch, "")
+	}
+	if err := enforceValues(r.PostForm, enforce, tenantLabels, labelMatch, queryMatch); err != nil {
+		return err
+	}
+	if err := enforceValues(urlValues, enforce, tenantLabels, labelMatch, queryMatch); err != nil {
 		return err
 	}
 
 	_ = r.Body.Close()
-	r.PostForm.Set(queryMatch, query)
 	newBody := r.PostForm.Encode()
 	r.Body = io.NopCloser(strings.NewReader(newBody))
 	r.ContentLength = int64(len(newBody))
-	r.URL.RawQuery = ""
+	r.URL.RawQuery = urlValues.Encode()
+	r.Form = nil
+	return nil
+}
+
+// enforceValues enforces every value of the queryMatch parameter, e.g. every
+// selector of a series request with several match[] parameters. Enforced
+// match[] selectors granted by several alternatives, e.g. tuple grants, are
+// passed as one match[] parameter per alternative if the enforcer supports
+// it, see SelectorEnforcer.
+func enforceValues(values url.Values, enforce EnforceQL, tenantLabels TenantLabels, labelMatch string, queryMatch string) error {
+	queries, ok := values[queryMatch]
+	if !ok {
+		return nil
+	}
+	selectorEnforcer, split := enforce.(SelectorEnforcer)
+	split = split && queryMatch == "match[]"
+	enforced := make([]string, 0, len(queries))
+	for _, query := range queries {
+		if split {
+			selectors, err := selectorEnforcer.EnforceSelectors(query, tenantLabels, labelMatch)
+			if err != nil {
+				return err
+			}
+			enforced = append(enforced, selectors...)
+			continue
+		}
+		query, err := enforce.Enforce(query, tenantLabels, labelMatch)
+		if err != nil {
+			return err
+		}
+		enforced = append(enforced, query)
+	}
+	values[queryMatch] = enforced
 	return nil
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnforceRequestMatchParameters(t *testing.T) {
+	tenantLabels := NewTenantLabels("team-a", "team-b")
+
+	t.Run("GET with several match[]", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/series?match[]=up&match[]=process_start_time_seconds{job=\"api\"}&start=1", nil)
+		assert.NoError(t, enforceRequest(r, PromQLEnforcer{}, tenantLabels, "namespace", "match[]"))
+		values := r.URL.Query()
+		assert.Equal(t, []string{
+			`up{namespace=~"team-a|team-b"}`,
+			`process_start_time_seconds{job="api",namespace=~"team-a|team-b"}`,
+		}, values["match[]"])
+		assert.Equal(t, "1", values.Get("start"))
+	})
+
+	t.Run("GET with a forbidden match[]", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/series?match[]=up&match[]=up{namespace=\"team-c\"}", nil)
+		assert.Error(t, enforceRequest(r, PromQLEnforcer{}, tenantLabels, "namespace", "match[]"))
+	})
+
+	t.Run("POST with match[] in URL and form", func(t *testing.T) {
+		form := url.Values{"match[]": {"up", `up{namespace="team-a"}`}}
+		r := httptest.NewRequest(http.MethodPost, "/federate?match[]=node_load1&start=1", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		assert.NoError(t, enforceRequest(r, PromQLEnforcer{}, tenantLabels, "namespace", "match[]"))
+
+		values := r.URL.Query()
+		assert.Equal(t, []string{`node_load1{namespace=~"team-a|team-b"}`}, values["match[]"])
+		assert.Equal(t, "1", values.Get("start"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(body)), r.ContentLength)
+		enforced, err := url.ParseQuery(string(body))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{`up{namespace=~"team-a|team-b"}`, `up{namespace="team-a"}`}, enforced["match[]"])
+	})
+
+	t.Run("POST with a forbidden match[] in URL", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/federate?match[]=up{namespace=\"team-c\"}", strings.NewReader("match[]=up"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		assert.Error(t, enforceRequest(r, PromQLEnforcer{}, tenantLabels, "namespace", "match[]"))
+	})
+
+	t.Run("GET series with tuple grants", func(t *testing.T) {
+		tuples := NewTenantLabels(`{cluster="prod-eu", namespace="payments"}`, `{cluster="prod-us", namespace="billing"}`)
+		r := httptest.NewRequest(http.MethodGet, "/api/v1/series?match[]=up&match[]=node_load1{cluster=\"prod-us\"}", nil)
+		assert.NoError(t, enforceRequest(r, PromQLEnforcer{}, tuples, "namespace", "match[]"))
+		assert.Equal(t, []string{
+			`up{cluster="prod-eu",namespace="payments"}`,
+			`up{cluster="prod-us",namespace="billing"}`,
+			`node_load1{cluster="prod-us",namespace="billing"}`,
+		}, r.URL.Query()["match[]"])
+
+		r = httptest.NewRequest(http.MethodGet, "/api/v1/labels", nil)
+		assert.NoError(t, enforceRequest(r, PromQLEnforcer{}, tuples, "namespace", "match[]"))
+		assert.Equal(t, []string{
+			`{cluster="prod-eu", namespace="payments"}`,
+			`{cluster="prod-us", namespace="billing"}`,
+		}, r.URL.Query()["match[]"])
+	})
+
+	t.Run("POST without query", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/api/v1/labels?start=1", strings.NewReader(""))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		assert.NoError(t, enforceRequest(r, PromQLEnforcer{}, tenantLabels, "namespace", "match[]"))
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, url.Values{"match[]": {`{namespace=~"team-a|team-b"}`}}.Encode(), string(body))
+		assert.Equal(t, "start=1", r.URL.RawQuery)
+	})
+}
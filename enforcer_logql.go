@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 
@@ -17,16 +18,15 @@ type LogQLEnforcer struct{}
 // If the input query is empty, a new query is constructed to match provided tenant labels.
 // If the input query is non-empty, it is parsed and modified to ensure tenant isolation.
 // Returns the modified query or an error if parsing or modification fails.
-func (LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMatch string) (string, error) {
+func (LogQLEnforcer) Enforce(query string, tenantLabels TenantLabels, labelMatch string) (string, error) {
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("input")
 	if query == "" {
-		operator := "="
-		if len(tenantLabels) > 1 {
-			operator = "=~"
+		selectors := tenantLabels.SelectorStrings(labelMatch)
+		if len(selectors) > 1 {
+			return "", fmt.Errorf("query matches multiple tuple grants, add a matcher selecting one of them")
 		}
-		query = fmt.Sprintf("{%s%s\"%s\"}", labelMatch, operator, strings.Join(MapKeysToArray(tenantLabels), "|"))
-		log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
-		return query, nil
+		log.Trace().Str("function", "enforcer").Str("query", selectors[0]).Msg("enforcing")
+		return selectors[0], nil
 	}
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
 
@@ -35,16 +35,34 @@ func (LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMa
 		return "", err
 	}
 
+	exclusion := tenantLabels.ExclusionMatcher(labelMatch)
+	if !tenantLabels.ClusterWide && len(tenantLabels.Tuples) > 0 {
+		return enforceTuplesLogQL(expr, tenantLabels, labelMatch)
+	}
+
 	errMsg := error(nil)
 
 	expr.Walk(func(expr interface{}) {
 		switch labelExpression := expr.(type) {
 		case *logqlv2.StreamMatcherExpr:
-			matchers, err := MatchTenantLabelMatchers(labelExpression.Matchers(), tenantLabels, labelMatch)
-			if err != nil {
+			if errMsg != nil {
+				return
+			}
+			matchers := labelExpression.Matchers()
+			if err := tenantLabels.CheckExclusions(matchers, labelMatch); err != nil {
 				errMsg = err
 				return
 			}
+			if !tenantLabels.ClusterWide {
+				matchers, err = MatchTenantLabelMatchers(matchers, tenantLabels, labelMatch)
+				if err != nil {
+					errMsg = err
+					return
+				}
+			}
+			if exclusion != nil {
+				matchers = append(matchers, exclusion)
+			}
 			labelExpression.SetMatchers(matchers)
 		default:
 			// Do nothing
@@ -58,34 +76,157 @@ func (LogQLEnforcer) Enforce(query string, tenantLabels map[string]bool, labelMa
 }
 
 // MatchTenantLabelMatchers ensures tenant label matchers in a LogQL query adhere to provided tenant labels.
-// It verifies that the tenant label exists in the query matchers, validating or modifying its values based on tenantLabels.
-// If the tenant label is absent in the matchers, it's added along with all values from tenantLabels.
+// Equality and regex matchers are intersected with tenantLabels, negative matchers are kept and
+// the tenant label matcher is added if no positive matcher restricts the tenant label.
 // Returns an error for an unauthorized namespace and nil on success.
-func MatchTenantLabelMatchers(queryMatches []*labels.Matcher, tenantLabels map[string]bool, labelMatch string) ([]*labels.Matcher, error) {
-	foundTenantLabel := false
-	for _, match := range queryMatches {
-		if match.Name == labelMatch {
-			foundTenantLabel = true
-			queryLabels := strings.Split(match.Value, "|")
-			for _, queryLabel := range queryLabels {
-				_, ok := tenantLabels[queryLabel]
-				if !ok {
-					return nil, fmt.Errorf("unauthorized label %s", queryLabel)
-				}
+func MatchTenantLabelMatchers(queryMatches []*labels.Matcher, tenantLabels TenantLabels, labelMatch string) ([]*labels.Matcher, error) {
+	matchers, err := tenantLabels.RestrictMatchers(queryMatches, labelMatch)
+	var unauthorized unauthorizedLabelError
+	if errors.As(err, &unauthorized) {
+		return nil, fmt.Errorf("unauthorized label %s", string(unauthorized))
+	}
+	return matchers, err
+}
+
+// enforceTuplesLogQL enforces tuple grants on a LogQL query. Every stream
+// selector is restricted to the granted label combinations it can match. If
+// more than one combination remains, range aggregations like count_over_time
+// are replaced with the union of one aggregation per combination joined by
+// "or". Log queries cannot be unioned and have to select a single combination.
+// Excluded values are rejected and excluded from every stream selector.
+func enforceTuplesLogQL(expr logqlv2.Expr, tenantLabels TenantLabels, labelMatch string) (string, error) {
+	selectors := tenantLabels.Selectors(labelMatch)
+	exclusion := tenantLabels.ExclusionMatcher(labelMatch)
+	restrict := func(stream *logqlv2.StreamMatcherExpr) ([][]*labels.Matcher, error) {
+		matchers := stream.Matchers()
+		if err := tenantLabels.CheckExclusions(matchers, labelMatch); err != nil {
+			return nil, err
+		}
+		if exclusion != nil {
+			matchers = append(matchers, exclusion)
+		}
+		return RestrictSelectors(matchers, selectors)
+	}
+
+	errMsg := error(nil)
+	handled := make(map[*logqlv2.StreamMatcherExpr]bool)
+	unions := make(map[*logqlv2.LogMetricExpr]bool)
+	expr.Walk(func(expr interface{}) {
+		if errMsg != nil {
+			return
+		}
+		switch e := expr.(type) {
+		case *logqlv2.LogMetricExpr:
+			if _, ok := e.Selector().(*logqlv2.LogRangeQueryExpr); !ok {
+				return
+			}
+			stream := streamMatcher(e.Selector())
+			if stream == nil || handled[stream] {
+				return
+			}
+			handled[stream] = true
+			restricted, err := restrict(stream)
+			if err != nil {
+				errMsg = err
+				return
+			}
+			if len(restricted) == 1 {
+				stream.SetMatchers(restricted[0])
+				return
+			}
+			union, err := logqlUnionOf(e, restricted, handled)
+			if err != nil {
+				errMsg = err
+				return
 			}
+			// an aggregation without operator only holds its parenthesized expression
+			*e = logqlv2.LogMetricExpr{Expr: union}
+			unions[e] = true
+		case *logqlv2.StreamMatcherExpr:
+			if handled[e] {
+				return
+			}
+			restricted, err := restrict(e)
+			if err != nil {
+				errMsg = err
+				return
+			}
+			if len(restricted) > 1 {
+				errMsg = fmt.Errorf("log selector %s matches multiple tuple grants, add a matcher selecting one of them", e)
+				return
+			}
+			e.SetMatchers(restricted[0])
 		}
+	})
+	if errMsg != nil {
+		return "", errMsg
+	}
+	// aggregations of unions have parentheses of their own, the parser rejects redundant ones
+	expr.Walk(func(expr interface{}) {
+		if e, ok := expr.(*logqlv2.LogMetricExpr); ok {
+			if inner, ok := e.Expr.(*logqlv2.LogMetricExpr); ok && unions[inner] {
+				e.Expr = inner.Expr
+			}
+		}
+	})
+
+	enforced := expr.String()
+	if _, err := logqlv2.ParseExpr(enforced); err != nil {
+		return "", err
 	}
-	if !foundTenantLabel {
-		matchType := labels.MatchEqual
-		if len(tenantLabels) > 1 {
-			matchType = labels.MatchRegexp
+	log.Trace().Str("function", "enforcer").Str("query", enforced).Msg("enforcing")
+	return enforced, nil
+}
+
+// streamMatcher returns the stream selector of a log selector expression.
+func streamMatcher(expr logqlv2.Expr) *logqlv2.StreamMatcherExpr {
+	var stream *logqlv2.StreamMatcherExpr
+	expr.Walk(func(expr interface{}) {
+		if s, ok := expr.(*logqlv2.StreamMatcherExpr); ok && stream == nil {
+			stream = s
 		}
+	})
+	return stream
+}
+
+// logqlUnion is the union of range aggregations joined by "or". The logqlv2
+// package does not export its binary expressions, the first part provides
+// the methods of logqlv2.Expr the union does not implement itself.
+type logqlUnion struct {
+	logqlv2.Expr
+	parts []logqlv2.Expr
+}
+
+func (u logqlUnion) String() string {
+	parts := make([]string, 0, len(u.parts))
+	for _, part := range u.parts {
+		parts = append(parts, part.String())
+	}
+	return strings.Join(parts, " or ")
+}
 
-		queryMatches = append(queryMatches, &labels.Matcher{
-			Type:  matchType,
-			Name:  labelMatch,
-			Value: strings.Join(MapKeysToArray(tenantLabels), "|"),
-		})
+func (u logqlUnion) Walk(fn logqlv2.WalkFn) {
+	fn(u)
+	for _, part := range u.parts {
+		part.Walk(fn)
+	}
+}
+
+// logqlUnionOf returns the union of copies of a range aggregation, one per
+// matcher list, whose stream selector is replaced with the matchers. The
+// stream selectors of the copies are marked as handled.
+func logqlUnionOf(e *logqlv2.LogMetricExpr, restricted [][]*labels.Matcher, handled map[*logqlv2.StreamMatcherExpr]bool) (logqlUnion, error) {
+	union := logqlUnion{parts: make([]logqlv2.Expr, 0, len(restricted))}
+	for _, matchers := range restricted {
+		part, err := logqlv2.ParseExpr(e.String())
+		if err != nil {
+			return logqlUnion{}, err
+		}
+		stream := streamMatcher(part)
+		stream.SetMatchers(matchers)
+		handled[stream] = true
+		union.parts = append(union.parts, part)
 	}
-	return queryMatches, nil
+	union.Expr = union.parts[0]
+	return union, nil
 }
@@ -11,30 +11,84 @@ func TestLogqlEnforcer(t *testing.T) {
 	tests := []struct {
 		name           string
 		query          string
-		tenantLabels   map[string]bool
+		tenantLabels   TenantLabels
 		expectedResult string
 		expectErr      bool
 	}{
 		{
 			name:           "Valid query and tenant labels",
 			query:          "{kubernetes_namespace_name=\"test\"}",
-			tenantLabels:   map[string]bool{"test": true},
+			tenantLabels:   NewTenantLabels("test"),
 			expectedResult: "{kubernetes_namespace_name=\"test\"}",
 			expectErr:      false,
 		},
 		{
 			name:           "Empty query and valid tenant labels",
 			query:          "",
-			tenantLabels:   map[string]bool{"test": true},
+			tenantLabels:   NewTenantLabels("test"),
 			expectedResult: "{kubernetes_namespace_name=\"test\"}",
 			expectErr:      false,
 		},
+		{
+			name:           "Empty query and pattern tenant labels",
+			query:          "",
+			tenantLabels:   NewTenantLabels("team-a-*", "test"),
+			expectedResult: "{kubernetes_namespace_name=~\"test|team-a-.*\"}",
+			expectErr:      false,
+		},
+		{
+			name:           "Pattern tenant labels and matching query",
+			query:          "{kubernetes_namespace_name=\"team-a-frontend\"}",
+			tenantLabels:   NewTenantLabels("team-a-*"),
+			expectedResult: "{kubernetes_namespace_name=\"team-a-frontend\"}",
+			expectErr:      false,
+		},
 		{
 			name:         "Valid query and invalid tenant labels",
 			query:        "{kubernetes_namespace_name=\"test\"}",
-			tenantLabels: map[string]bool{"invalid": true},
+			tenantLabels: NewTenantLabels("invalid"),
 			expectErr:    true,
 		},
+		{
+			name:           "Cluster-wide with exclusions",
+			query:          "{app=\"api\"} |= \"error\"",
+			tenantLabels:   NewTenantLabels("#cluster-wide", "!vault", "!kube-*"),
+			expectedResult: "{app=\"api\", kubernetes_namespace_name!~\"vault|kube-.*\"} |= \"error\"",
+			expectErr:      false,
+		},
+		{
+			name:           "Values with exclusion",
+			query:          "{kubernetes_namespace_name=\"test\"}",
+			tenantLabels:   NewTenantLabels("test", "!vault"),
+			expectedResult: "{kubernetes_namespace_name=\"test\", kubernetes_namespace_name!=\"vault\"}",
+			expectErr:      false,
+		},
+		{
+			name:         "Excluded value",
+			query:        "{kubernetes_namespace_name=\"vault\"}",
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			expectErr:    true,
+		},
+		{
+			name:           "Regex intersected with tenant labels",
+			query:          "{kubernetes_namespace_name=~\"team-a.*\"}",
+			tenantLabels:   NewTenantLabels("team-a-frontend", "team-a-backend", "team-b"),
+			expectedResult: "{kubernetes_namespace_name=~\"team-a-backend|team-a-frontend\"}",
+			expectErr:      false,
+		},
+		{
+			name:         "Regex matching no tenant label",
+			query:        "{kubernetes_namespace_name=~\"team-c.*\"}",
+			tenantLabels: NewTenantLabels("team-a-frontend", "team-b"),
+			expectErr:    true,
+		},
+		{
+			name:           "Negative matcher keeps the tenant restriction",
+			query:          "{kubernetes_namespace_name!=\"team-b\"}",
+			tenantLabels:   NewTenantLabels("team-a", "team-b"),
+			expectedResult: "{kubernetes_namespace_name!=\"team-b\", kubernetes_namespace_name=~\"team-a|team-b\"}",
+			expectErr:      false,
+		},
 	}
 
 	enforcer := LogQLEnforcer{}
@@ -56,7 +110,7 @@ func TestMatchNamespaceMatchers(t *testing.T) {
 	tests := []struct {
 		name         string
 		matchers     []*labels.Matcher
-		tenantLabels map[string]bool
+		tenantLabels TenantLabels
 		expectErr    bool
 	}{
 		{
@@ -68,7 +122,7 @@ func TestMatchNamespaceMatchers(t *testing.T) {
 					Value: "test",
 				},
 			},
-			tenantLabels: map[string]bool{"test": true},
+			tenantLabels: NewTenantLabels("test"),
 			expectErr:    false,
 		},
 		{
@@ -80,7 +134,7 @@ func TestMatchNamespaceMatchers(t *testing.T) {
 					Value: "invalid",
 				},
 			},
-			tenantLabels: map[string]bool{"test": true},
+			tenantLabels: NewTenantLabels("test"),
 			expectErr:    true,
 		},
 	}
@@ -96,3 +150,60 @@ func TestMatchNamespaceMatchers(t *testing.T) {
 		})
 	}
 }
+
+func TestLogqlEnforcerTuples(t *testing.T) {
+	tenantLabels := NewTenantLabels(
+		`{cluster="prod-eu", kubernetes_namespace_name="payments"}`,
+		`{cluster="prod-us", kubernetes_namespace_name="payments"}`,
+	)
+	tests := []struct {
+		name           string
+		query          string
+		expectedResult string
+		expectErr      bool
+	}{
+		{
+			name:           "Log query selecting one tuple",
+			query:          `{cluster="prod-eu"} |= "error"`,
+			expectedResult: `{cluster="prod-eu", kubernetes_namespace_name="payments"} |= "error"`,
+		},
+		{
+			name:      "Log query across tuples",
+			query:     `{app="api"} |= "error"`,
+			expectErr: true,
+		},
+		{
+			name:           "Metric query across tuples",
+			query:          `sum by (level) (count_over_time({app="api"}[1m]))`,
+			expectedResult: `sum by(level) (count_over_time({app="api", cluster="prod-eu", kubernetes_namespace_name="payments"}[1m]) or count_over_time({app="api", cluster="prod-us", kubernetes_namespace_name="payments"}[1m]))`,
+		},
+		{
+			name:           "Metric query in binary expression",
+			query:          `count_over_time({app="api"}[1m]) > 5`,
+			expectedResult: `(count_over_time({app="api", cluster="prod-eu", kubernetes_namespace_name="payments"}[1m]) or count_over_time({app="api", cluster="prod-us", kubernetes_namespace_name="payments"}[1m])) > 5`,
+		},
+		{
+			name:  "Metric queries on both sides of a binary expression",
+			query: `count_over_time({app="api"}[1m]) / count_over_time({app="web", cluster="prod-us"}[1m] offset 1h0m0s)`,
+			expectedResult: `(count_over_time({app="api", cluster="prod-eu", kubernetes_namespace_name="payments"}[1m]) or count_over_time({app="api", cluster="prod-us", kubernetes_namespace_name="payments"}[1m])) / ` +
+				`count_over_time({app="web", cluster="prod-us", kubernetes_namespace_name="payments"}[1m] offset 1h0m0s)`,
+		},
+		{
+			name:      "Not granted combination",
+			query:     `{cluster="prod-eu", kubernetes_namespace_name="billing"}`,
+			expectErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := LogQLEnforcer{}.Enforce(tt.query, tenantLabels, "kubernetes_namespace_name")
+			if tt.expectErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.expectedResult, result)
+			}
+		})
+	}
+}
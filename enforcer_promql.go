@@ -6,7 +6,6 @@ import (
 
 	"github.com/rs/zerolog/log"
 
-	enforcer "github.com/prometheus-community/prom-label-proxy/injectproxy"
 	"github.com/prometheus/prometheus/model/labels"
 	"github.com/prometheus/prometheus/promql/parser"
 )
@@ -17,18 +16,12 @@ type PromQLEnforcer struct{}
 // Enforce enhances a given PromQL query string with additional label matchers,
 // ensuring that the query complies with the allowed tenant labels and specified label match.
 // It returns the enhanced query or an error if the query cannot be parsed or is not compliant.
-func (PromQLEnforcer) Enforce(query string, allowedTenantLabels map[string]bool, labelMatch string) (string, error) {
+func (PromQLEnforcer) Enforce(query string, allowedTenantLabels TenantLabels, labelMatch string) (string, error) {
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("input")
 	if query == "" {
-		operator := "="
-		if len(allowedTenantLabels) > 1 {
-			operator = "=~"
-		}
-		query = fmt.Sprintf("{%s%s\"%s\"}",
-			labelMatch,
-			operator,
-			strings.Join(MapKeysToArray(allowedTenantLabels),
-				"|"))
+		query = strings.Join(allowedTenantLabels.SelectorStrings(labelMatch), " or ")
+		log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
+		return query, nil
 	}
 	log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
 	expr, err := parser.ParseExpr(query)
@@ -36,80 +29,219 @@ func (PromQLEnforcer) Enforce(query string, allowedTenantLabels map[string]bool,
 		return "", err
 	}
 
-	queryLabels, err := extractLabelsAndValues(expr)
+	err = checkExclusionsPromQL(expr, allowedTenantLabels, labelMatch)
 	if err != nil {
 		return "", err
 	}
 
-	tenantLabels, err := enforceLabels(queryLabels, allowedTenantLabels, labelMatch)
-	if err != nil {
-		return "", err
+	switch {
+	case allowedTenantLabels.ClusterWide:
+		// every value except the exclusions is granted
+	case len(allowedTenantLabels.Tuples) > 0:
+		expr, err = tupleEnforcer(allowedTenantLabels.Selectors(labelMatch)).rewrite(expr)
+	default:
+		err = enforceValuesPromQL(expr, allowedTenantLabels, labelMatch)
 	}
-
-	labelEnforcer := createEnforcer(tenantLabels, labelMatch)
-	err = labelEnforcer.EnforceNode(expr)
 	if err != nil {
 		return "", err
 	}
+
+	appendExclusionPromQL(expr, allowedTenantLabels.ExclusionMatcher(labelMatch))
 	log.Trace().Str("function", "enforcer").Str("query", expr.String()).Msg("enforcing")
 	return expr.String(), nil
 }
 
-// extractLabelsAndValues parses a PromQL expression and extracts labels and their values.
-// It returns a map where keys are label names and values are corresponding label values.
-// An error is returned if the expression cannot be parsed.
-func extractLabelsAndValues(expr parser.Expr) (map[string]string, error) {
-	l := make(map[string]string)
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
-		if vector, ok := node.(*parser.VectorSelector); ok {
-			for _, matcher := range vector.LabelMatchers {
-				l[matcher.Name] = matcher.Value
-			}
+// EnforceSelectors enforces a series selector of a match[] parameter. Unlike
+// Enforce, it returns one selector per granted alternative instead of their
+// union joined by "or", as every match[] parameter takes a single selector.
+func (e PromQLEnforcer) EnforceSelectors(selector string, allowedTenantLabels TenantLabels, labelMatch string) ([]string, error) {
+	if selector == "" {
+		return allowedTenantLabels.SelectorStrings(labelMatch), nil
+	}
+	enforced, err := e.Enforce(selector, allowedTenantLabels, labelMatch)
+	if err != nil {
+		return nil, err
+	}
+	expr, err := parser.ParseExpr(enforced)
+	if err != nil {
+		return nil, err
+	}
+	operands := unionOperands(expr)
+	selectors := make([]string, 0, len(operands))
+	for _, operand := range operands {
+		selectors = append(selectors, operand.String())
+	}
+	return selectors, nil
+}
+
+// unionOperands returns the expressions joined by "or" in an expression, or
+// the expression itself if it is no union.
+func unionOperands(expr parser.Expr) []parser.Expr {
+	switch n := expr.(type) {
+	case *parser.ParenExpr:
+		return unionOperands(n.Expr)
+	case *parser.BinaryExpr:
+		if n.Op == parser.LOR {
+			return append(unionOperands(n.LHS), unionOperands(n.RHS)...)
+		}
+	}
+	return []parser.Expr{expr}
+}
+
+// enforceValuesPromQL restricts every selector of the expression to the
+// allowed tenant labels, see TenantLabels.RestrictMatchers.
+func enforceValuesPromQL(expr parser.Expr, allowedTenantLabels TenantLabels, labelMatch string) error {
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok && err == nil {
+			vector.LabelMatchers, err = allowedTenantLabels.RestrictMatchers(vector.LabelMatchers, labelMatch)
 		}
 		return nil
 	})
-	return l, nil
+	return err
 }
 
-// enforceLabels checks if provided query labels comply with allowed tenant labels and a specified label match.
-// If the labels comply, it returns them (or all allowed tenant labels if not specified in the query) and nil.
-// If not, it returns an error indicating the non-compliant label.
-func enforceLabels(queryLabels map[string]string, allowedTenantLabels map[string]bool, labelMatch string) ([]string, error) {
-	if _, ok := queryLabels[labelMatch]; ok {
-		ok, tenantLabels := checkLabels(queryLabels, allowedTenantLabels, labelMatch)
-		if !ok {
-			return nil, fmt.Errorf("user not allowed with tenant label %s", tenantLabels[0])
+// checkExclusionsPromQL rejects expressions explicitly selecting excluded values.
+func checkExclusionsPromQL(expr parser.Expr, allowedTenantLabels TenantLabels, labelMatch string) error {
+	var err error
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok && err == nil {
+			err = allowedTenantLabels.CheckExclusions(vector.LabelMatchers, labelMatch)
 		}
-		return tenantLabels, nil
-	}
+		return nil
+	})
+	return err
+}
 
-	return MapKeysToArray(allowedTenantLabels), nil
+// appendExclusionPromQL appends the exclusion matcher to every selector of the expression.
+func appendExclusionPromQL(expr parser.Expr, exclusion *labels.Matcher) {
+	if exclusion == nil {
+		return
+	}
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vector, ok := node.(*parser.VectorSelector); ok {
+			vector.LabelMatchers = append(vector.LabelMatchers, exclusion)
+		}
+		return nil
+	})
 }
 
-// checkLabels validates if query labels are present in the allowed tenant labels and returns them.
-// If a query label is not allowed, it returns false and the non-compliant label.
-func checkLabels(queryLabels map[string]string, allowedTenantLabels map[string]bool, labelMatch string) (bool, []string) {
-	splitQueryLabels := strings.Split(queryLabels[labelMatch], "|")
-	for _, queryLabel := range splitQueryLabels {
-		_, ok := allowedTenantLabels[queryLabel]
-		if !ok {
-			return false, []string{queryLabel}
+// tupleEnforcer rewrites PromQL expressions so that their selectors only
+// select the granted label combinations. Every selector is restricted to the
+// combinations it can match. If more than one combination remains, the
+// selector is replaced with the union of the restricted selectors joined by
+// "or". Range selectors are unioned at the function call consuming them, as
+// PromQL cannot union ranges.
+type tupleEnforcer [][]*labels.Matcher
+
+func (te tupleEnforcer) rewrite(node parser.Expr) (parser.Expr, error) {
+	var err error
+	switch n := node.(type) {
+	case *parser.VectorSelector:
+		vectors, err := te.restrict(n)
+		if err != nil {
+			return nil, err
+		}
+		exprs := make([]parser.Expr, 0, len(vectors))
+		for _, vector := range vectors {
+			exprs = append(exprs, vector)
+		}
+		return unionExprs(exprs), nil
+	case *parser.MatrixSelector:
+		vectors, err := te.restrict(n.VectorSelector.(*parser.VectorSelector))
+		if err != nil {
+			return nil, err
+		}
+		if len(vectors) > 1 {
+			return nil, fmt.Errorf("range selector %s matches multiple tuple grants", n)
+		}
+		n.VectorSelector = vectors[0]
+	case *parser.Call:
+		matrixArg := -1
+		for i, arg := range n.Args {
+			if _, ok := arg.(*parser.MatrixSelector); ok {
+				matrixArg = i
+				continue
+			}
+			if n.Args[i], err = te.rewrite(arg); err != nil {
+				return nil, err
+			}
+		}
+		if matrixArg < 0 {
+			return n, nil
+		}
+		matrix := n.Args[matrixArg].(*parser.MatrixSelector)
+		vectors, err := te.restrict(matrix.VectorSelector.(*parser.VectorSelector))
+		if err != nil {
+			return nil, err
+		}
+		calls := make([]parser.Expr, 0, len(vectors))
+		for _, vector := range vectors {
+			args := append(parser.Expressions{}, n.Args...)
+			args[matrixArg] = &parser.MatrixSelector{VectorSelector: vector, Range: matrix.Range, EndPos: matrix.EndPos}
+			calls = append(calls, &parser.Call{Func: n.Func, Args: args, PosRange: n.PosRange})
 		}
+		return unionExprs(calls), nil
+	case *parser.AggregateExpr:
+		if n.Param != nil {
+			if n.Param, err = te.rewrite(n.Param); err != nil {
+				return nil, err
+			}
+		}
+		n.Expr, err = te.rewrite(n.Expr)
+	case *parser.BinaryExpr:
+		if n.LHS, err = te.rewrite(n.LHS); err != nil {
+			return nil, err
+		}
+		n.RHS, err = te.rewrite(n.RHS)
+	case *parser.SubqueryExpr:
+		n.Expr, err = te.rewrite(n.Expr)
+	case *parser.ParenExpr:
+		n.Expr, err = te.rewrite(n.Expr)
+	case *parser.UnaryExpr:
+		n.Expr, err = te.rewrite(n.Expr)
+	case *parser.StepInvariantExpr:
+		n.Expr, err = te.rewrite(n.Expr)
+	case *parser.NumberLiteral, *parser.StringLiteral:
+	default:
+		return nil, fmt.Errorf("unhandled node type %T", n)
 	}
-	return true, splitQueryLabels
+	if err != nil {
+		return nil, err
+	}
+	return node, nil
 }
 
-func createEnforcer(tenantLabels []string, labelMatch string) *enforcer.PromQLEnforcer {
-	var matchType labels.MatchType
-	if len(tenantLabels) > 1 {
-		matchType = labels.MatchRegexp
-	} else {
-		matchType = labels.MatchEqual
+// restrict returns one copy of the vector selector per granted label
+// combination it can match.
+func (te tupleEnforcer) restrict(vector *parser.VectorSelector) ([]*parser.VectorSelector, error) {
+	restricted, err := RestrictSelectors(vector.LabelMatchers, te)
+	if err != nil {
+		return nil, err
 	}
+	vectors := make([]*parser.VectorSelector, 0, len(restricted))
+	for _, matchers := range restricted {
+		v := *vector
+		v.LabelMatchers = matchers
+		vectors = append(vectors, &v)
+	}
+	return vectors, nil
+}
 
-	return enforcer.NewPromQLEnforcer(true, &labels.Matcher{
-		Name:  labelMatch,
-		Type:  matchType,
-		Value: strings.Join(tenantLabels, "|"),
-	})
+// unionExprs joins expressions with "or", which returns every series selected
+// by any of them. Series selected by overlapping grants are only returned once.
+func unionExprs(exprs []parser.Expr) parser.Expr {
+	if len(exprs) == 1 {
+		return exprs[0]
+	}
+	union := exprs[0]
+	for _, expr := range exprs[1:] {
+		union = &parser.BinaryExpr{
+			Op:             parser.LOR,
+			LHS:            union,
+			RHS:            expr,
+			VectorMatching: &parser.VectorMatching{Card: parser.CardManyToMany},
+		}
+	}
+	return &parser.ParenExpr{Expr: union}
 }
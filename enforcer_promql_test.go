@@ -3,12 +3,14 @@ package main
 import (
 	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func Test_promqlEnforcer(t *testing.T) {
 	type args struct {
 		query        string
-		tenantLabels map[string]bool
+		tenantLabels TenantLabels
 	}
 	tests := []struct {
 		name    string
@@ -20,7 +22,7 @@ func Test_promqlEnforcer(t *testing.T) {
 			name: "case 1",
 			args: args{
 				query:        "up",
-				tenantLabels: map[string]bool{"namespace1": true},
+				tenantLabels: NewTenantLabels("namespace1"),
 			},
 			want:    "up{namespace=\"namespace1\"}",
 			wantErr: false,
@@ -29,7 +31,7 @@ func Test_promqlEnforcer(t *testing.T) {
 			name: "case 2",
 			args: args{
 				query:        "{__name__=\"up\",namespace=\"namespace2\"}",
-				tenantLabels: map[string]bool{"namespace1": true},
+				tenantLabels: NewTenantLabels("namespace1"),
 			},
 			want:    "",
 			wantErr: true,
@@ -38,7 +40,7 @@ func Test_promqlEnforcer(t *testing.T) {
 			name: "case 3",
 			args: args{
 				query:        "up{namespace=\"namespace1\"}",
-				tenantLabels: map[string]bool{"namespace1": true, "namespace2": true},
+				tenantLabels: NewTenantLabels("namespace1", "namespace2"),
 			},
 			want:    "up{namespace=\"namespace1\"}",
 			wantErr: false,
@@ -47,11 +49,38 @@ func Test_promqlEnforcer(t *testing.T) {
 			name: "case 4",
 			args: args{
 				query:        "up",
-				tenantLabels: map[string]bool{"namespace": true, "grrr": true},
+				tenantLabels: NewTenantLabels("namespace", "grrr"),
 			},
 			want:    "up{namespace=~\"namespace|grrr\"}|s|up{namespace=~\"grrr|namespace\"}",
 			wantErr: false,
 		},
+		{
+			name: "pattern grant",
+			args: args{
+				query:        "up",
+				tenantLabels: NewTenantLabels("payments", "team-a-*"),
+			},
+			want:    "up{namespace=~\"payments|team-a-.*\"}|s|",
+			wantErr: false,
+		},
+		{
+			name: "pattern grant with matching query",
+			args: args{
+				query:        "up{namespace=\"team-a-frontend\"}",
+				tenantLabels: NewTenantLabels("team-a-*"),
+			},
+			want:    "up{namespace=\"team-a-frontend\"}|s|",
+			wantErr: false,
+		},
+		{
+			name: "pattern grant with forbidden query",
+			args: args{
+				query:        "up{namespace=\"team-b-frontend\"}",
+				tenantLabels: NewTenantLabels("team-a-*"),
+			},
+			want:    "",
+			wantErr: true,
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -66,3 +95,203 @@ func Test_promqlEnforcer(t *testing.T) {
 		})
 	}
 }
+
+func TestPromqlEnforcerTuples(t *testing.T) {
+	tenantLabels := NewTenantLabels(
+		`{cluster="prod-eu", namespace="payments"}`,
+		`{cluster="prod-eu", namespace="billing"}`,
+		`{cluster="prod-us", namespace="payments"}`,
+	)
+	tests := []struct {
+		name    string
+		query   string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "Union of selectors",
+			query: "up",
+			want:  `(up{cluster="prod-eu",namespace=~"billing|payments"} or up{cluster="prod-us",namespace="payments"})`,
+		},
+		{
+			name:  "Union of range function calls",
+			query: "sum(rate(http_requests_total[5m]))",
+			want:  `sum((rate(http_requests_total{cluster="prod-eu",namespace=~"billing|payments"}[5m]) or rate(http_requests_total{cluster="prod-us",namespace="payments"}[5m])))`,
+		},
+		{
+			name:  "Single tuple selected by query",
+			query: `up{cluster="prod-us"}`,
+			want:  `up{cluster="prod-us",namespace="payments"}`,
+		},
+		{
+			name:  "Tenant label selects tuples",
+			query: `up{namespace="billing"}`,
+			want:  `up{cluster="prod-eu",namespace="billing"}`,
+		},
+		{
+			name:    "Not granted combination",
+			query:   `up{cluster="prod-us", namespace="billing"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Not granted tenant",
+			query:   `up{namespace="other"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Range selector across tuples",
+			query:   `up[5m]`,
+			wantErr: true,
+		},
+		{
+			name:  "Empty query",
+			query: "",
+			want:  `{cluster="prod-eu", namespace=~"billing|payments"} or {cluster="prod-us", namespace="payments"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPromqlEnforcerExclusions(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		tenantLabels TenantLabels
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "Cluster-wide except excluded",
+			query:        "sum(rate(http_requests_total[5m]))",
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault", "!kube-*"),
+			want:         `sum(rate(http_requests_total{namespace!~"vault|kube-.*"}[5m]))`,
+		},
+		{
+			name:         "Cluster-wide and explicit value",
+			query:        `up{namespace="payments"}`,
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			want:         `up{namespace!="vault",namespace="payments"}`,
+		},
+		{
+			name:         "Excluded value",
+			query:        `up{namespace="vault"}`,
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			wantErr:      true,
+		},
+		{
+			name:         "Excluded pattern value",
+			query:        `up{namespace=~"payments|kube-system"}`,
+			tenantLabels: NewTenantLabels("#cluster-wide", "!kube-*"),
+			wantErr:      true,
+		},
+		{
+			name:         "Pattern grant with exclusion",
+			query:        "up",
+			tenantLabels: NewTenantLabels("team-a-*", "!team-a-secrets"),
+			want:         `up{namespace!="team-a-secrets",namespace=~"team-a-.*"}`,
+		},
+		{
+			name:         "Empty query",
+			query:        "",
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			want:         `{namespace=~".+", namespace!="vault"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestPromqlEnforcerMatcherTypes(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		tenantLabels TenantLabels
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "Regex intersected with tenant labels",
+			query:        `up{namespace=~"team-a.*"}`,
+			tenantLabels: NewTenantLabels("team-a-frontend", "team-a-backend", "team-b"),
+			want:         `up{namespace=~"team-a-backend|team-a-frontend"}`,
+		},
+		{
+			name:         "Regex matching a single tenant label",
+			query:        `up{namespace=~".*-b"}`,
+			tenantLabels: NewTenantLabels("team-a", "team-b"),
+			want:         `up{namespace="team-b"}`,
+		},
+		{
+			name:         "Regex matching no tenant label",
+			query:        `up{namespace=~"team-c.*"}`,
+			tenantLabels: NewTenantLabels("team-a", "team-b"),
+			wantErr:      true,
+		},
+		{
+			name:         "Regex alternatives within tenant labels",
+			query:        `up{namespace=~"team-a|team-b"}`,
+			tenantLabels: NewTenantLabels("team-a", "team-b", "team-c"),
+			want:         `up{namespace=~"team-a|team-b"}`,
+		},
+		{
+			name:         "Regex alternatives outside tenant labels",
+			query:        `up{namespace=~"team-a|team-x"}`,
+			tenantLabels: NewTenantLabels("team-a", "team-b"),
+			wantErr:      true,
+		},
+		{
+			name:         "Regex with pattern grant",
+			query:        `up{namespace=~"team-.*-frontend"}`,
+			tenantLabels: NewTenantLabels("payments", "team-a-*"),
+			want:         `up{namespace=~"team-.*-frontend",namespace=~"team-a-.*"}`,
+		},
+		{
+			name:         "Not equal keeps the tenant restriction",
+			query:        `up{namespace!="team-b"}`,
+			tenantLabels: NewTenantLabels("team-a", "team-b"),
+			want:         `up{namespace!="team-b",namespace=~"team-a|team-b"}`,
+		},
+		{
+			name:         "Not regex keeps the tenant restriction",
+			query:        `up{namespace!~"team-.*"}`,
+			tenantLabels: NewTenantLabels("payments", "team-a"),
+			want:         `up{namespace!~"team-.*",namespace=~"payments|team-a"}`,
+		},
+		{
+			name:         "Selectors are enforced independently",
+			query:        `up{namespace="team-a"} / on() count(up)`,
+			tenantLabels: NewTenantLabels("team-a", "team-b"),
+			want:         `up{namespace="team-a"} / on () count(up{namespace=~"team-a|team-b"})`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PromQLEnforcer{}.Enforce(tt.query, tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// PyroscopeEnforcer manipulates and enforces tenant isolation on Pyroscope label selectors,
+// optionally prefixed with a profile type, e.g. process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="x"}.
+type PyroscopeEnforcer struct{}
+
+// Enforce restricts the label selector of a Pyroscope query to the allowed tenant labels the same
+// way the PromQLEnforcer restricts a selector. The profile type is kept as it is. If the input query
+// is empty, a selector selecting the allowed tenant labels is returned. Pyroscope cannot union
+// selectors, so queries matching more than one tuple grant are rejected.
+func (PyroscopeEnforcer) Enforce(query string, tenantLabels TenantLabels, labelMatch string) (string, error) {
+	log.Trace().Str("function", "enforcer").Str("query", query).Msg("input")
+	if strings.TrimSpace(query) == "" {
+		selectors := tenantLabels.SelectorStrings(labelMatch)
+		if len(selectors) > 1 {
+			return "", fmt.Errorf("query matches multiple tuple grants, add a matcher selecting one of them")
+		}
+		log.Trace().Str("function", "enforcer").Str("query", selectors[0]).Msg("enforcing")
+		return selectors[0], nil
+	}
+
+	profileType, selector := query, "{}"
+	if i := strings.Index(query, "{"); i >= 0 {
+		profileType, selector = query[:i], query[i:]
+	}
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return "", err
+	}
+
+	matchers, err = tenantLabels.RestrictSelector(matchers, labelMatch)
+	if err != nil {
+		return "", err
+	}
+
+	query = strings.TrimSpace(profileType) + matchersString(matchers)
+	log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
+	return query, nil
+}
+
+// connectField is a field of a Pyroscope Connect request holding label
+// selectors, e.g. "labelSelector" of select requests, "matchers" of label and
+// series requests or "left.labelSelector" of diff requests. The path is given
+// by the JSON names and by the protobuf field numbers of the messages.
+type connectField struct {
+	name     string
+	numbers  []protowire.Number
+	repeated bool
+}
+
+// enforceConnectRequest enforces the label selectors of a Pyroscope Connect
+// request in JSON format. Lists of selectors are enforced value by value,
+// missing selectors are added.
+func enforceConnectRequest(body []byte, fields []connectField, enforce EnforceQL, tenantLabels TenantLabels, labelMatch string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var request map[string]any
+	if err := decoder.Decode(&request); err != nil {
+		return nil, fmt.Errorf("invalid request: %w", err)
+	}
+
+	for _, connectField := range fields {
+		field := connectField.name
+		path := strings.Split(field, ".")
+		message := request
+		for _, key := range path[:len(path)-1] {
+			nested, ok := message[key].(map[string]any)
+			if !ok {
+				nested = make(map[string]any)
+				message[key] = nested
+			}
+			message = nested
+		}
+		key := path[len(path)-1]
+
+		if selector, ok := message[key].(string); ok || message[key] == nil && !connectField.repeated {
+			enforced, err := enforce.Enforce(selector, tenantLabels, labelMatch)
+			if err != nil {
+				return nil, err
+			}
+			message[key] = enforced
+			continue
+		}
+		values, ok := message[key].([]any)
+		if !ok && message[key] != nil {
+			return nil, fmt.Errorf("invalid %s %v", field, message[key])
+		}
+		if len(values) == 0 {
+			values = []any{""}
+		}
+		selectors := make([]any, 0, len(values))
+		for _, value := range values {
+			selector, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid %s %v", field, value)
+			}
+			enforced, err := enforce.Enforce(selector, tenantLabels, labelMatch)
+			if err != nil {
+				return nil, err
+			}
+			selectors = append(selectors, enforced)
+		}
+		message[key] = selectors
+	}
+	return json.Marshal(request)
+}
+
+// enforceConnectProtobuf enforces the label selectors of a Pyroscope Connect
+// request in protobuf format like enforceConnectRequest. Repeated occurrences
+// of a nested message are merged and of a selector the last one is kept, as a
+// protobuf parser would do.
+func enforceConnectProtobuf(body []byte, fields []connectField, enforce EnforceQL, tenantLabels TenantLabels, labelMatch string) ([]byte, error) {
+	for _, field := range fields {
+		var err error
+		body, err = enforceProtobufField(body, field.numbers, field.repeated, func(selector string) (string, error) {
+			return enforce.Enforce(selector, tenantLabels, labelMatch)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", field.name, err)
+		}
+	}
+	return body, nil
+}
+
+// enforceProtobufField enforces the string field at the path of field
+// numbers of a protobuf message. The enforced field is appended to the
+// other fields of the message.
+func enforceProtobufField(message []byte, path []protowire.Number, repeated bool, enforce func(string) (string, error)) ([]byte, error) {
+	var kept []byte
+	var values [][]byte
+	for len(message) > 0 {
+		number, wireType, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		m := protowire.ConsumeFieldValue(number, wireType, message[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		if number != path[0] {
+			kept = append(kept, message[:n+m]...)
+		} else {
+			if wireType != protowire.BytesType {
+				return nil, fmt.Errorf("unexpected wire type %d of field %d", wireType, number)
+			}
+			value, _ := protowire.ConsumeBytes(message[n:])
+			values = append(values, value)
+		}
+		message = message[n+m:]
+	}
+
+	if len(path) > 1 {
+		nested, err := enforceProtobufField(bytes.Join(values, nil), path[1:], repeated, enforce)
+		if err != nil {
+			return nil, err
+		}
+		kept = protowire.AppendTag(kept, path[0], protowire.BytesType)
+		return protowire.AppendBytes(kept, nested), nil
+	}
+	if !repeated && len(values) > 1 {
+		values = values[len(values)-1:]
+	}
+	if len(values) == 0 {
+		values = [][]byte{nil}
+	}
+	for _, value := range values {
+		selector, err := enforce(string(value))
+		if err != nil {
+			return nil, err
+		}
+		kept = protowire.AppendTag(kept, path[0], protowire.BytesType)
+		kept = protowire.AppendString(kept, selector)
+	}
+	return kept, nil
+}
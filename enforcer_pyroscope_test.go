@@ -0,0 +1,269 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func TestPyroscopeEnforcer(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		tenantLabels TenantLabels
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "Empty query",
+			query:        "",
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         `{namespace=~"billing|payments"}`,
+		},
+		{
+			name:         "Profile type only",
+			query:        "process_cpu:cpu:nanoseconds:cpu:nanoseconds",
+			tenantLabels: NewTenantLabels("payments"),
+			want:         `process_cpu:cpu:nanoseconds:cpu:nanoseconds{namespace="payments"}`,
+		},
+		{
+			name:         "Profile type and selector",
+			query:        `memory:alloc_space:bytes:space:bytes{service_name="api"}`,
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         `memory:alloc_space:bytes:space:bytes{service_name="api", namespace=~"billing|payments"}`,
+		},
+		{
+			name:         "Allowed tenant",
+			query:        `{namespace="payments"}`,
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         `{namespace="payments"}`,
+		},
+		{
+			name:         "Forbidden tenant",
+			query:        `{namespace="shop"}`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Regex intersected with tenant labels",
+			query:        `{namespace=~"pay.*"}`,
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         `{namespace="payments"}`,
+		},
+		{
+			name:         "Cluster-wide with exclusion",
+			query:        `{service_name="api"}`,
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			want:         `{service_name="api", namespace!="vault"}`,
+		},
+		{
+			name:         "Single tuple",
+			query:        `{cluster="prod-us"}`,
+			tenantLabels: NewTenantLabels(`{cluster="prod-eu", namespace="payments"}`, `{cluster="prod-us", namespace="shop"}`),
+			want:         `{cluster="prod-us", namespace="shop"}`,
+		},
+		{
+			name:         "Selector across tuples",
+			query:        `{service_name="api"}`,
+			tenantLabels: NewTenantLabels(`{cluster="prod-eu", namespace="payments"}`, `{cluster="prod-us", namespace="shop"}`),
+			wantErr:      true,
+		},
+		{
+			name:         "Invalid selector",
+			query:        `{namespace=}`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PyroscopeEnforcer{}.Enforce(tt.query, tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestEnforceConnectRequest(t *testing.T) {
+	tenantLabels := NewTenantLabels("payments")
+	selector := connectField{name: "labelSelector", numbers: []protowire.Number{2}}
+	matchers := connectField{name: "matchers", numbers: []protowire.Number{1}, repeated: true}
+	tests := []struct {
+		name    string
+		body    string
+		fields  []connectField
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "Select request",
+			body:   `{"profileTypeID":"process_cpu:cpu:nanoseconds:cpu:nanoseconds","labelSelector":"{service_name=\"api\"}","start":"1700000000000","end":1700000360000}`,
+			fields: []connectField{selector},
+			want:   `{"profileTypeID":"process_cpu:cpu:nanoseconds:cpu:nanoseconds","labelSelector":"{service_name=\"api\", namespace=\"payments\"}","start":"1700000000000","end":1700000360000}`,
+		},
+		{
+			name:   "Select request without selector",
+			body:   `{"profileTypeID":"process_cpu:cpu:nanoseconds:cpu:nanoseconds"}`,
+			fields: []connectField{selector},
+			want:   `{"profileTypeID":"process_cpu:cpu:nanoseconds:cpu:nanoseconds","labelSelector":"{namespace=\"payments\"}"}`,
+		},
+		{
+			name:   "Label names without matchers",
+			body:   `{"start":"1700000000000"}`,
+			fields: []connectField{matchers},
+			want:   `{"start":"1700000000000","matchers":["{namespace=\"payments\"}"]}`,
+		},
+		{
+			name:   "Series with several matchers",
+			body:   `{"matchers":["{service_name=\"api\"}","{namespace=\"payments\"}"]}`,
+			fields: []connectField{matchers},
+			want:   `{"matchers":["{service_name=\"api\", namespace=\"payments\"}","{namespace=\"payments\"}"]}`,
+		},
+		{
+			name: "Diff request",
+			body: `{"left":{"labelSelector":"{}"},"right":{"labelSelector":"{service_name=\"api\"}"}}`,
+			fields: []connectField{
+				{name: "left.labelSelector", numbers: []protowire.Number{1, 2}},
+				{name: "right.labelSelector", numbers: []protowire.Number{2, 2}},
+			},
+			want: `{"left":{"labelSelector":"{namespace=\"payments\"}"},"right":{"labelSelector":"{service_name=\"api\", namespace=\"payments\"}"}}`,
+		},
+		{
+			name:    "Forbidden matcher",
+			body:    `{"matchers":["{namespace=\"payments\"}","{namespace=\"shop\"}"]}`,
+			fields:  []connectField{matchers},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid matchers",
+			body:    `{"matchers":"{namespace=\"shop\"}"}`,
+			fields:  []connectField{matchers},
+			wantErr: true,
+		},
+		{
+			name:    "Invalid JSON",
+			body:    `{`,
+			fields:  []connectField{matchers},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := enforceConnectRequest([]byte(tt.body), tt.fields, PyroscopeEnforcer{}, tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.want, string(got))
+		})
+	}
+}
+
+// protoString appends a string field to a protobuf message.
+func protoString(message []byte, number protowire.Number, value string) []byte {
+	message = protowire.AppendTag(message, number, protowire.BytesType)
+	return protowire.AppendString(message, value)
+}
+
+// protoMessage appends a message field to a protobuf message.
+func protoMessage(message []byte, number protowire.Number, nested []byte) []byte {
+	message = protowire.AppendTag(message, number, protowire.BytesType)
+	return protowire.AppendBytes(message, nested)
+}
+
+func TestEnforceConnectProtobuf(t *testing.T) {
+	tenantLabels := NewTenantLabels("payments")
+	selector := connectField{name: "labelSelector", numbers: []protowire.Number{2}}
+	matchers := connectField{name: "matchers", numbers: []protowire.Number{2}, repeated: true}
+	diff := []connectField{
+		{name: "left.labelSelector", numbers: []protowire.Number{1, 2}},
+		{name: "right.labelSelector", numbers: []protowire.Number{2, 2}},
+	}
+	start := protowire.AppendVarint(protowire.AppendTag(nil, 3, protowire.VarintType), 1700000000000)
+	tests := []struct {
+		name    string
+		body    []byte
+		fields  []connectField
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:   "Select request",
+			body:   append(protoString(protoString(nil, 1, "process_cpu"), 2, `{service_name="api"}`), start...),
+			fields: []connectField{selector},
+			want:   protoString(append(protoString(nil, 1, "process_cpu"), start...), 2, `{service_name="api", namespace="payments"}`),
+		},
+		{
+			name:   "Select request without selector",
+			body:   protoString(nil, 1, "process_cpu"),
+			fields: []connectField{selector},
+			want:   protoString(protoString(nil, 1, "process_cpu"), 2, `{namespace="payments"}`),
+		},
+		{
+			name:   "Last selector wins",
+			body:   protoString(protoString(nil, 2, `{namespace="payments"}`), 2, `{service_name="api"}`),
+			fields: []connectField{selector},
+			want:   protoString(nil, 2, `{service_name="api", namespace="payments"}`),
+		},
+		{
+			name:   "Label values with several matchers",
+			body:   protoString(protoString(protoString(nil, 1, "service_name"), 2, `{service_name="api"}`), 2, "{}"),
+			fields: []connectField{matchers},
+			want:   protoString(protoString(protoString(nil, 1, "service_name"), 2, `{service_name="api", namespace="payments"}`), 2, `{namespace="payments"}`),
+		},
+		{
+			name:   "Label values without matchers",
+			body:   protoString(nil, 1, "service_name"),
+			fields: []connectField{matchers},
+			want:   protoString(protoString(nil, 1, "service_name"), 2, `{namespace="payments"}`),
+		},
+		{
+			name:   "Diff request with split message",
+			body:   protoMessage(protoMessage(nil, 1, protoString(nil, 1, "process_cpu")), 1, protoString(nil, 2, `{service_name="api"}`)),
+			fields: diff,
+			want: protoMessage(protoMessage(nil, 1, protoString(protoString(nil, 1, "process_cpu"), 2, `{service_name="api", namespace="payments"}`)),
+				2, protoString(nil, 2, `{namespace="payments"}`)),
+		},
+		{
+			name:    "Forbidden matcher",
+			body:    protoString(protoString(nil, 2, `{namespace="payments"}`), 2, `{namespace="shop"}`),
+			fields:  []connectField{matchers},
+			wantErr: true,
+		},
+		{
+			name:    "Forbidden selector in nested message",
+			body:    protoMessage(nil, 2, protoString(nil, 2, `{namespace="shop"}`)),
+			fields:  diff,
+			wantErr: true,
+		},
+		{
+			name:    "Unexpected wire type",
+			body:    protowire.AppendVarint(protowire.AppendTag(nil, 2, protowire.VarintType), 1),
+			fields:  []connectField{selector},
+			wantErr: true,
+		},
+		{
+			name:    "Truncated message",
+			body:    protoString(nil, 2, "{}")[:3],
+			fields:  []connectField{selector},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := enforceConnectProtobuf(tt.body, tt.fields, PyroscopeEnforcer{}, tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/prometheus/prometheus/model/labels"
+)
+
+// TraceQLEnforcer manipulates and enforces tenant isolation on TraceQL queries.
+// The tenant label is a span or resource attribute, e.g. resource.k8s.namespace.name.
+type TraceQLEnforcer struct{}
+
+// Enforce adds a condition on the tenant attribute to every spanset filter of a TraceQL query,
+// so only spans of the allowed tenants can match. Conditions of the query on the tenant
+// attribute have to select allowed tenants. If the input query is empty, a spanset filter
+// selecting the allowed tenants is returned. Tuple grants are not supported for traces.
+//
+// The query is scanned instead of parsed, so every construct the scanner does not
+// understand is rejected, see spansetFilters and checkTraceQLStructure.
+func (TraceQLEnforcer) Enforce(query string, tenantLabels TenantLabels, labelMatch string) (string, error) {
+	log.Trace().Str("function", "enforcer").Str("query", query).Msg("input")
+	if !tenantLabels.ClusterWide && len(tenantLabels.Tuples) > 0 {
+		return "", fmt.Errorf("tuple grants are not supported for traces")
+	}
+	condition := traceQLCondition(tenantLabels, labelMatch)
+	if strings.TrimSpace(query) == "" {
+		query = "{ " + condition + " }"
+		log.Trace().Str("function", "enforcer").Str("query", query).Msg("enforcing")
+		return query, nil
+	}
+
+	filters, err := spansetFilters(query)
+	if err != nil {
+		return "", err
+	}
+	if len(filters) == 0 {
+		return "", fmt.Errorf("query %s contains no spanset filter", query)
+	}
+	if err := checkTraceQLStructure(query, filters); err != nil {
+		return "", err
+	}
+
+	var sb strings.Builder
+	last := 0
+	for _, filter := range filters {
+		inner := strings.TrimSpace(query[filter[0]:filter[1]])
+		if err := checkTraceQLConditions(inner, tenantLabels, labelMatch); err != nil {
+			return "", err
+		}
+		sb.WriteString(query[last:filter[0]])
+		if inner == "" {
+			sb.WriteString(" " + condition + " ")
+		} else {
+			sb.WriteString(" (" + inner + ") && " + condition + " ")
+		}
+		last = filter[1]
+	}
+	sb.WriteString(query[last:])
+	log.Trace().Str("function", "enforcer").Str("query", sb.String()).Msg("enforcing")
+	return sb.String(), nil
+}
+
+// traceQLCondition returns the TraceQL condition selecting the spans of the
+// allowed tenants, excluding the excluded ones.
+func traceQLCondition(tenantLabels TenantLabels, attribute string) string {
+	var conditions []string
+	if !tenantLabels.ClusterWide {
+		conditions = append(conditions, traceQLComparison(tenantLabels.Matcher(attribute)))
+	}
+	if exclusion := tenantLabels.ExclusionMatcher(attribute); exclusion != nil {
+		conditions = append(conditions, traceQLComparison(exclusion))
+	}
+	if len(conditions) == 0 {
+		return "true"
+	}
+	return strings.Join(conditions, " && ")
+}
+
+// traceQLComparison renders a label matcher as TraceQL comparison. Regular
+// expressions are anchored explicitly, as Tempo versions differ in anchoring.
+func traceQLComparison(matcher *labels.Matcher) string {
+	value := matcher.Value
+	if matcher.Type == labels.MatchRegexp || matcher.Type == labels.MatchNotRegexp {
+		value = "^(?:" + value + ")$"
+	}
+	return fmt.Sprintf("%s %s %s", matcher.Name, matcher.Type, strconv.Quote(value))
+}
+
+// spansetFilters returns the start and end offsets of the content of every
+// spanset filter of a TraceQL query, skipping string literals. Nested braces,
+// unbalanced parentheses within a filter, which could escape the parentheses
+// the content is wrapped in, single quotes and strings containing braces,
+// && or || are rejected.
+func spansetFilters(query string) ([][2]int, error) {
+	var filters [][2]int
+	start := -1
+	depth := 0
+	for i := 0; i < len(query); i++ {
+		switch query[i] {
+		case '"', '`':
+			end := stringEnd(query, i)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string in query %s", query)
+			}
+			if literal := query[i : end+1]; strings.ContainsAny(literal, "{}") || strings.Contains(literal, "&&") || strings.Contains(literal, "||") {
+				return nil, fmt.Errorf("string %s in query %s contains braces, && or ||, which are not supported", literal, query)
+			}
+			i = end
+		case '\'':
+			return nil, fmt.Errorf("unexpected ' in query %s", query)
+		case '{':
+			if start >= 0 {
+				return nil, fmt.Errorf("unexpected { in query %s", query)
+			}
+			start = i + 1
+			depth = 0
+		case '}':
+			if start < 0 {
+				return nil, fmt.Errorf("unexpected } in query %s", query)
+			}
+			if depth != 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in spanset filter of query %s", query)
+			}
+			filters = append(filters, [2]int{start, i})
+			start = -1
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if start >= 0 && depth < 0 {
+				return nil, fmt.Errorf("unbalanced parentheses in spanset filter of query %s", query)
+			}
+		}
+	}
+	if start >= 0 {
+		return nil, fmt.Errorf("unterminated spanset filter in query %s", query)
+	}
+	return filters, nil
+}
+
+var (
+	// traceQLBeforeFilters matches the text allowed before the first spanset filter.
+	traceQLBeforeFilters = regexp.MustCompile(`^[\s(]*$`)
+	// traceQLBetweenFilters matches the text allowed between spanset filters:
+	// parentheses and a spanset operator or pipe, no structural operator.
+	traceQLBetweenFilters = regexp.MustCompile(`^[\s()]*(?:(?:&&|\|\||\|)[\s()]*)?$`)
+	// traceQLAfterFilters matches the text allowed after the last spanset
+	// filter, a pipeline of aggregates and functions.
+	traceQLAfterFilters = regexp.MustCompile(`^[\s)]*(?:\|[^{}]*)?$`)
+)
+
+// checkTraceQLStructure returns an error unless the spanset filters of a
+// query are only combined with && and || or piped into each other. The
+// structural operators, e.g. >>, ~ or !~, and anything else between the
+// filters are rejected, as the scanner cannot tell how they relate spans of
+// different tenants.
+func checkTraceQLStructure(query string, filters [][2]int) error {
+	gaps := []string{query[:filters[0][0]-1]}
+	for i := 1; i < len(filters); i++ {
+		gaps = append(gaps, query[filters[i-1][1]+1:filters[i][0]-1])
+	}
+	gaps = append(gaps, query[filters[len(filters)-1][1]+1:])
+	for i, gap := range gaps {
+		pattern := traceQLBetweenFilters
+		switch i {
+		case 0:
+			pattern = traceQLBeforeFilters
+		case len(gaps) - 1:
+			pattern = traceQLAfterFilters
+		}
+		if !pattern.MatchString(gap) {
+			return fmt.Errorf("unsupported TraceQL %q in query %s, spanset filters can only be combined with && and ||", strings.TrimSpace(gap), query)
+		}
+	}
+	return nil
+}
+
+// stringEnd returns the offset of the closing quote of the string literal
+// starting at start, or -1 if it is not terminated.
+func stringEnd(query string, start int) int {
+	quote := query[start]
+	for i := start + 1; i < len(query); i++ {
+		switch {
+		case query[i] == '\\' && quote == '"':
+			i++
+		case query[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// checkTraceQLConditions returns an error if a condition of a spanset filter
+// compares the tenant attribute with tenants that are not allowed. The
+// attribute is matched with and without its scope, e.g. both
+// resource.k8s.namespace.name and .k8s.namespace.name.
+func checkTraceQLConditions(filter string, tenantLabels TenantLabels, attribute string) error {
+	names := []string{regexp.QuoteMeta(attribute)}
+	if _, unscoped, ok := strings.Cut(attribute, "."); ok && unscoped != "" && !strings.HasPrefix(attribute, ".") {
+		names = append(names, regexp.QuoteMeta("."+unscoped))
+	}
+	conditions := regexp.MustCompile(`(?:^|[^\w.])(?:` + strings.Join(names, "|") + `)\s*(=~|!~|!=|=)\s*("(?:[^"\\]|\\.)*"|` + "`[^`]*`" + `)`)
+	for _, condition := range conditions.FindAllStringSubmatch(filter, -1) {
+		value, err := strconv.Unquote(condition[2])
+		if err != nil {
+			return fmt.Errorf("invalid string %s: %w", condition[2], err)
+		}
+		switch condition[1] {
+		case "=":
+			if !tenantLabels.Allowed(value) {
+				return unauthorizedLabelError(value)
+			}
+		case "=~":
+			matcher, err := labels.NewMatcher(labels.MatchRegexp, attribute, value)
+			if err != nil {
+				return err
+			}
+			if tenantLabels.ClusterWide {
+				err = tenantLabels.CheckExclusions([]*labels.Matcher{matcher}, attribute)
+			} else {
+				_, err = tenantLabels.intersect(matcher)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// filterTrace removes the resource spans of tenants that are not allowed from
+// a Tempo trace in JSON format, either a v1 trace with "batches" or a v2
+// response with the trace in "trace". The attribute is the tenant label
+// without the "resource." scope. It reports whether any spans remain.
+func filterTrace(body []byte, tenantLabels TenantLabels, attribute string) ([]byte, bool, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var trace map[string]any
+	if err := decoder.Decode(&trace); err != nil {
+		return nil, false, fmt.Errorf("invalid trace: %w", err)
+	}
+	spans := trace
+	if nested, ok := trace["trace"].(map[string]any); ok {
+		spans = nested
+	}
+
+	kept := 0
+	for _, key := range []string{"batches", "resourceSpans"} {
+		batches, ok := spans[key].([]any)
+		if !ok {
+			continue
+		}
+		allowed := make([]any, 0, len(batches))
+		for _, batch := range batches {
+			if tenantLabels.Allowed(resourceAttribute(batch, attribute)) {
+				allowed = append(allowed, batch)
+			}
+		}
+		spans[key] = allowed
+		kept += len(allowed)
+	}
+	filtered, err := json.Marshal(trace)
+	return filtered, kept > 0, err
+}
+
+// resourceAttribute returns the string value of a resource attribute of
+// OTLP resource spans in JSON format.
+func resourceAttribute(batch any, key string) string {
+	spans, _ := batch.(map[string]any)
+	resource, _ := spans["resource"].(map[string]any)
+	attributes, _ := resource["attributes"].([]any)
+	for _, attribute := range attributes {
+		kv, _ := attribute.(map[string]any)
+		if kv["key"] != key {
+			continue
+		}
+		value, _ := kv["value"].(map[string]any)
+		s, _ := value["stringValue"].(string)
+		return s
+	}
+	return ""
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceqlEnforcer(t *testing.T) {
+	tests := []struct {
+		name         string
+		query        string
+		tenantLabels TenantLabels
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "Empty query",
+			query:        "",
+			tenantLabels: NewTenantLabels("payments"),
+			want:         `{ resource.k8s.namespace.name = "payments" }`,
+		},
+		{
+			name:         "Empty spanset filter",
+			query:        "{}",
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want:         `{ resource.k8s.namespace.name =~ "^(?:billing|payments)$" }`,
+		},
+		{
+			name:         "Conditions and pipeline",
+			query:        `{ span.http.status_code >= 500 || name = "x" } | count() > 2`,
+			tenantLabels: NewTenantLabels("payments"),
+			want:         `{ (span.http.status_code >= 500 || name = "x") && resource.k8s.namespace.name = "payments" } | count() > 2`,
+		},
+		{
+			name:         "Spanset operators",
+			query:        `({ status = error } || { name =~ "(a|b)" }) && { true } | count() > 1`,
+			tenantLabels: NewTenantLabels("payments"),
+			want:         `({ (status = error) && resource.k8s.namespace.name = "payments" } || { (name =~ "(a|b)") && resource.k8s.namespace.name = "payments" }) && { (true) && resource.k8s.namespace.name = "payments" } | count() > 1`,
+		},
+		{
+			name:         "Structural descendant",
+			query:        `{ resource.service.name = "api" } >> { status = error }`,
+			tenantLabels: NewTenantLabels("team-a-*"),
+			wantErr:      true,
+		},
+		{
+			name:         "Structural negated descendant",
+			query:        `{ resource.service.name = "api" } !>> { status = error }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Structural union descendant",
+			query:        `{ resource.service.name = "api" } &>> { status = error }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Structural sibling",
+			query:        `{ status = error } ~ { status = ok }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Structural not sibling",
+			query:        `{ status = error } !~ { status = ok }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Structural child",
+			query:        `{ status = error } > { status = ok }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Structural ancestor",
+			query:        `{ status = error } << { status = ok }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Negated spanset",
+			query:        `!{ status = error }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Unbalanced parentheses escaping the filter",
+			query:        `{ status = error) || (true }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Unclosed parenthesis in filter",
+			query:        `{ (status = error }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Nested braces",
+			query:        `{ name = "x" { true } }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "String containing a brace",
+			query:        `{ name = "}" }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Raw string containing a brace",
+			query:        "{ name = `}` || true }",
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "String containing &&",
+			query:        `{ name = "x && true" }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "String containing ||",
+			query:        `{ name = "x || true" }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Escaped quote",
+			query:        `{ name = "\" } || { true }" }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Single quotes",
+			query:        `{ name = '}' }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Filter in pipeline",
+			query:        `{ true } | select(span.name) { true }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Allowed tenant",
+			query:        `{ resource.k8s.namespace.name = "payments" }`,
+			tenantLabels: NewTenantLabels("payments"),
+			want:         `{ (resource.k8s.namespace.name = "payments") && resource.k8s.namespace.name = "payments" }`,
+		},
+		{
+			name:         "Forbidden tenant",
+			query:        `{ resource.k8s.namespace.name = "billing" }`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Forbidden tenant with unscoped attribute",
+			query:        "{ .k8s.namespace.name = `billing` }",
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Regex matching no tenant",
+			query:        `{ resource.k8s.namespace.name =~ "team-b.*" }`,
+			tenantLabels: NewTenantLabels("team-a", "payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Cluster-wide with exclusion",
+			query:        `{ span.db.system = "postgresql" }`,
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			want:         `{ (span.db.system = "postgresql") && resource.k8s.namespace.name != "vault" }`,
+		},
+		{
+			name:         "Excluded tenant",
+			query:        `{ resource.k8s.namespace.name = "vault" }`,
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			wantErr:      true,
+		},
+		{
+			name:         "Tuple grants",
+			query:        "{}",
+			tenantLabels: NewTenantLabels(`{cluster="prod", namespace="payments"}`),
+			wantErr:      true,
+		},
+		{
+			name:         "Unterminated filter",
+			query:        `{ name = "x"`,
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := TraceQLEnforcer{}.Enforce(tt.query, tt.tenantLabels, "resource.k8s.namespace.name")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFilterTrace(t *testing.T) {
+	trace := `{"batches":[` +
+		`{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeSpans":[{"spans":[{"name":"a"}]}]},` +
+		`{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"billing"}}]},"scopeSpans":[{"spans":[{"name":"b"}]}]},` +
+		`{"resource":{"attributes":[]},"scopeSpans":[{"spans":[{"name":"c","kind":2}]}]}]}`
+
+	filtered, found, err := filterTrace([]byte(trace), NewTenantLabels("payments"), "k8s.namespace.name")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.JSONEq(t, `{"batches":[{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeSpans":[{"spans":[{"name":"a"}]}]}]}`, string(filtered))
+
+	_, found, err = filterTrace([]byte(`{"trace":`+trace+`}`), NewTenantLabels("shop"), "k8s.namespace.name")
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	_, _, err = filterTrace([]byte("not json"), NewTenantLabels("shop"), "k8s.namespace.name")
+	assert.Error(t, err)
+}
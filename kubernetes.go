@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// namespaceSelectorPrefix marks label values of the label stores that are
+// Kubernetes label selectors on namespaces, e.g. "#namespaces team=payments".
+const namespaceSelectorPrefix = "#namespaces "
+
+// NamespaceInformer keeps a continuously updated cache of the cluster's
+// namespaces to resolve namespace label selectors into namespace names.
+type NamespaceInformer struct {
+	lister corelisters.NamespaceLister
+}
+
+// WithNamespaceInformer starts the Namespace informer if namespace selectors
+// are enabled. It uses the in-cluster config unless a kubeconfig is configured
+// and waits until the cache is synced.
+func (a *App) WithNamespaceInformer() *App {
+	if !a.Cfg.Kubernetes.NamespaceSelectors {
+		return a
+	}
+	var config *rest.Config
+	var err error
+	if a.Cfg.Kubernetes.Kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", a.Cfg.Kubernetes.Kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while loading kubernetes config")
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while creating kubernetes client")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	a.Namespaces, err = NewNamespaceInformer(ctx, client, a.Cfg.Kubernetes.ResyncPeriod)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error while starting namespace informer")
+	}
+	return a
+}
+
+// NewNamespaceInformer starts a Namespace informer for the client and waits
+// until its cache is synced or ctx is done. The informer keeps running in
+// the background.
+func NewNamespaceInformer(ctx context.Context, client kubernetes.Interface, resync time.Duration) (*NamespaceInformer, error) {
+	factory := informers.NewSharedInformerFactory(client, resync)
+	namespaces := factory.Core().V1().Namespaces()
+	lister := namespaces.Lister()
+	factory.Start(make(chan struct{}))
+	if !cache.WaitForCacheSync(ctx.Done(), namespaces.Informer().HasSynced) {
+		return nil, fmt.Errorf("namespace informer cache not synced")
+	}
+	log.Info().Msg("Namespace informer synced")
+	return &NamespaceInformer{lister: lister}, nil
+}
+
+// Select returns the sorted names of the namespaces matching the label selector.
+func (n *NamespaceInformer) Select(selector string) ([]string, error) {
+	sel, err := k8slabels.Parse(selector)
+	if err != nil {
+		return nil, err
+	}
+	namespaces, err := n.lister.List(sel)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(namespaces))
+	for _, namespace := range namespaces {
+		names = append(names, namespace.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// isNamespaceSelector reports whether a label value is a namespace selector,
+// optionally prefixed with "!" for an exclusion.
+func isNamespaceSelector(value string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(value, "!"), namespaceSelectorPrefix)
+}
+
+// validateLabel checks whether a label value of a label store can be used
+// as grant. Namespace selectors need a running Namespace informer.
+func validateLabel(value string, namespaces *NamespaceInformer) error {
+	if !isNamespaceSelector(value) {
+		return (&TenantLabels{}).Add(value)
+	}
+	if namespaces == nil {
+		return fmt.Errorf("namespace selector %s requires kubernetes namespace_selectors to be enabled", value)
+	}
+	selector := strings.TrimPrefix(strings.TrimPrefix(value, "!"), namespaceSelectorPrefix)
+	_, err := k8slabels.Parse(selector)
+	if err != nil {
+		return fmt.Errorf("invalid namespace selector %s: %w", value, err)
+	}
+	return nil
+}
+
+// resolveLabel returns the label values a label store value grants. Namespace
+// selectors are resolved to the names of the currently matching namespaces,
+// exclusions to excluded names. Other values are returned as they are.
+func resolveLabel(value string, namespaces *NamespaceInformer) ([]string, error) {
+	if !isNamespaceSelector(value) {
+		return []string{value}, nil
+	}
+	if namespaces == nil {
+		return nil, fmt.Errorf("namespace selector %s requires kubernetes namespace_selectors to be enabled", value)
+	}
+	prefix := ""
+	if strings.HasPrefix(value, "!") {
+		prefix = "!"
+	}
+	names, err := namespaces.Select(strings.TrimPrefix(value, prefix+namespaceSelectorPrefix))
+	if err != nil {
+		return nil, err
+	}
+	for i, name := range names {
+		names[i] = prefix + name
+	}
+	return names, nil
+}
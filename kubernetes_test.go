@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestNamespaceInformer(t *testing.T, namespaces map[string]map[string]string) (*NamespaceInformer, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	for name, labels := range namespaces {
+		_, err := client.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	informer, err := NewNamespaceInformer(ctx, client, 0)
+	assert.NoError(t, err)
+	return informer, client
+}
+
+func TestNamespaceInformer(t *testing.T) {
+	informer, client := newTestNamespaceInformer(t, map[string]map[string]string{
+		"payments":     {"team": "payments", "cost-center": "42"},
+		"payments-dev": {"team": "payments"},
+		"shop":         {"team": "shop", "cost-center": "42"},
+	})
+
+	names, err := informer.Select("team=payments")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments", "payments-dev"}, names)
+
+	names, err = informer.Select("cost-center=42,team!=shop")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments"}, names)
+
+	_, err = informer.Select("team in (payments")
+	assert.Error(t, err)
+
+	_, err = client.CoreV1().Namespaces().Create(context.Background(), &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments-prod", Labels: map[string]string{"team": "payments"}},
+	}, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		names, _ := informer.Select("team=payments")
+		return len(names) == 3
+	}, 5*time.Second, 10*time.Millisecond, "new namespaces are covered")
+
+	resolved, err := resolveLabel("!#namespaces team=shop", informer)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"!shop"}, resolved)
+	resolved, err = resolveLabel("payments", nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments"}, resolved)
+	_, err = resolveLabel("#namespaces team=shop", nil)
+	assert.Error(t, err)
+
+	assert.NoError(t, validateLabel("#namespaces team in (payments, shop)", informer))
+	assert.Error(t, validateLabel("#namespaces team in (payments", informer))
+	assert.Error(t, validateLabel("#namespaces team=payments", nil))
+}
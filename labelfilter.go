@@ -0,0 +1,306 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// defaultLabelWindow is the time range verified if a label request has no
+	// start and end.
+	defaultLabelWindow = time.Hour
+	// maxLabelWindow is the longest time range verified, longer ranges of
+	// label requests are cut to their end.
+	maxLabelWindow = 24 * time.Hour
+	// maxLabelVerificationQueries is the maximum number of verification
+	// queries sent to the upstreams for a label response, elements of a
+	// response that would need more are dropped.
+	maxLabelVerificationQueries = 10
+)
+
+// labelVerifier filters the responses of the label name and label value APIs
+// of a datasource. Values of the tenant label are checked against the tenant
+// labels, label names and values of other labels are verified with instant
+// queries for series of the allowed tenants, which are routed like queries.
+type labelVerifier struct {
+	upstreams   *upstreamRouter
+	datasource  Datasource
+	queryPath   string
+	enforcer    EnforceQL
+	tenantLabel string
+	// aggregation and rangeFunction build the verification queries, e.g.
+	// group(last_over_time({...}[1h])).
+	aggregation   string
+	rangeFunction string
+	a             *App
+}
+
+// newThanosLabelVerifier returns the labelVerifier of the Thanos label APIs.
+func newThanosLabelVerifier(a *App) *labelVerifier {
+	return &labelVerifier{
+		upstreams:     a.thanosUpstreams(),
+		datasource:    DatasourceMetrics,
+		queryPath:     "/api/v1/query",
+		enforcer:      PromQLEnforcer(struct{}{}),
+		tenantLabel:   a.Cfg.Thanos.TenantLabel,
+		aggregation:   "group",
+		rangeFunction: "last_over_time",
+		a:             a,
+	}
+}
+
+// newLokiLabelVerifier returns the labelVerifier of the Loki label APIs.
+func newLokiLabelVerifier(a *App) *labelVerifier {
+	return &labelVerifier{
+		upstreams:     a.lokiUpstreams(),
+		datasource:    DatasourceLogs,
+		queryPath:     "/loki/api/v1/query",
+		enforcer:      LogQLEnforcer(struct{}{}),
+		tenantLabel:   a.Cfg.Loki.TenantLabel,
+		aggregation:   "sum",
+		rangeFunction: "count_over_time",
+		a:             a,
+	}
+}
+
+// filters returns the filter of the "data" array of a label names or label
+// values response for the request. It has to be called before the request is
+// enforced, as it reads the time range of the request.
+func (v *labelVerifier) filters(r *http.Request, tenantLabels TenantLabels, groups []string) map[string]arrayFilter {
+	window, at := labelWindow(r)
+	verify := v.verification(tenantLabels, groups, at)
+	label, isValues := mux.Vars(r)["label"]
+	switch {
+	case !isValues:
+		return map[string]arrayFilter{"data": v.names(verify, window)}
+	case label == v.tenantLabel:
+		return map[string]arrayFilter{"data": eachElement(func(element json.RawMessage) (json.RawMessage, error) {
+			var value string
+			if err := json.Unmarshal(element, &value); err != nil {
+				return nil, fmt.Errorf("invalid label value: %w", err)
+			}
+			if !tenantValueAllowed(tenantLabels, v.tenantLabel, value) {
+				return nil, nil
+			}
+			return element, nil
+		})}
+	default:
+		return map[string]arrayFilter{"data": v.values(label, verify, window)}
+	}
+}
+
+// names keeps the label names of series of the allowed tenants. A batch of
+// names is verified with a single query, e.g.
+// label_replace(group(last_over_time({job=~".+"}[1h])), "label", "job", "", "") or ...
+func (v *labelVerifier) names(verify verification, window time.Duration) arrayFilter {
+	return func(elements []json.RawMessage) ([]json.RawMessage, error) {
+		names := make([]string, len(elements))
+		var queries []string
+		for i, element := range elements {
+			var name string
+			if err := json.Unmarshal(element, &name); err != nil {
+				return nil, fmt.Errorf("invalid label name: %w", err)
+			}
+			if !model.LabelName(name).IsValid() {
+				continue
+			}
+			names[i] = name
+			if name == v.tenantLabel {
+				continue
+			}
+			queries = append(queries, fmt.Sprintf(`label_replace(%s(%s({%s=~".+"}[%s])), "label", %q, "", "")`,
+				v.aggregation, v.rangeFunction, name, model.Duration(window), name))
+		}
+
+		found := map[string]bool{v.tenantLabel: true}
+		if len(queries) > 0 {
+			result, err := verify(strings.Join(queries, " or "))
+			if err != nil {
+				return nil, err
+			}
+			for _, metric := range result {
+				found[metric["label"]] = true
+			}
+		}
+		return keepFound(elements, names, found), nil
+	}
+}
+
+// values keeps the values of the label that series of the allowed tenants
+// have. A batch of values is verified with a single query, e.g.
+// group by (job) (last_over_time({job=~"api|web"}[1h])).
+func (v *labelVerifier) values(label string, verify verification, window time.Duration) arrayFilter {
+	return func(elements []json.RawMessage) ([]json.RawMessage, error) {
+		if !model.LabelName(label).IsValid() {
+			return nil, fmt.Errorf("invalid label name %s", label)
+		}
+		values := make([]string, len(elements))
+		alternatives := make([]string, 0, len(elements))
+		for i, element := range elements {
+			var value string
+			if err := json.Unmarshal(element, &value); err != nil {
+				return nil, fmt.Errorf("invalid label value: %w", err)
+			}
+			values[i] = value
+			alternatives = append(alternatives, regexp.QuoteMeta(value))
+		}
+
+		query := fmt.Sprintf("%s by (%s) (%s({%s=~%s}[%s]))", v.aggregation, label, v.rangeFunction,
+			label, strconv.Quote(strings.Join(alternatives, "|")), model.Duration(window))
+		result, err := verify(query)
+		if err != nil {
+			return nil, err
+		}
+		found := make(map[string]bool, len(result))
+		for _, metric := range result {
+			found[metric[label]] = true
+		}
+		return keepFound(elements, values, found), nil
+	}
+}
+
+// keepFound returns the elements whose key was found. Elements with an
+// empty key are dropped.
+func keepFound(elements []json.RawMessage, keys []string, found map[string]bool) []json.RawMessage {
+	kept := elements[:0]
+	for i, element := range elements {
+		if keys[i] != "" && found[keys[i]] {
+			kept = append(kept, element)
+		}
+	}
+	return kept
+}
+
+// verification runs a verification query and returns the label sets of the
+// resulting series.
+type verification func(query string) ([]map[string]string, error)
+
+// verification returns the verification of the label response of a request.
+// It enforces the verification queries to the tenant labels, runs them as
+// instant queries on the upstreams they are routed to and stops querying
+// after maxLabelVerificationQueries, returning no series. If the tenancy mode
+// of the datasource uses org IDs, the queries are sent with the org ID of the
+// tenant labels.
+func (v *labelVerifier) verification(tenantLabels TenantLabels, groups []string, at string) verification {
+	remaining := maxLabelVerificationQueries
+	return func(query string) ([]map[string]string, error) {
+		query, err := v.enforcer.Enforce(query, tenantLabels, v.tenantLabel)
+		if err != nil {
+			return nil, err
+		}
+		var orgID string
+		if v.a.tenancyMode(v.datasource).usesOrgID() {
+			if orgID, err = tenantLabels.OrgID(); err != nil {
+				return nil, err
+			}
+		}
+		targets := v.upstreams.routeQueries([]string{query}, v.enforcer, v.tenantLabel, groups)
+		if remaining < len(targets) {
+			log.Debug().Str("query", query).Msg("Label verification query limit reached, dropping label response elements")
+			return nil, nil
+		}
+		remaining -= len(targets)
+
+		form := url.Values{"query": {query}}
+		if at != "" {
+			form.Set("time", at)
+		}
+		var result []map[string]string
+		for _, target := range targets {
+			metrics, err := v.queryUpstream(target, form, orgID)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, metrics...)
+		}
+		return result, nil
+	}
+}
+
+// queryUpstream runs a verification query on an upstream, with the org ID
+// if it is set.
+func (v *labelVerifier) queryUpstream(target upstream, form url.Values, orgID string) ([]map[string]string, error) {
+	req, err := http.NewRequest(http.MethodPost, target.url.JoinPath(v.queryPath).String(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setHeaders(req, target.tls, target.headers, v.a.ServiceAccountToken)
+	if orgID != "" {
+		req.Header.Set(orgIDHeader, orgID)
+	}
+	resp, err := target.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("verification query failed with status %d", resp.StatusCode)
+	}
+	var response struct {
+		Data struct {
+			Result []struct {
+				Metric map[string]string `json:"metric"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("invalid verification query response: %w", err)
+	}
+	result := make([]map[string]string, 0, len(response.Data.Result))
+	for _, series := range response.Data.Result {
+		result = append(result, series.Metric)
+	}
+	return result, nil
+}
+
+// labelWindow returns the time range of a label request, at most
+// maxLabelWindow, as range of the verification queries, and its end as their
+// evaluation time. Prometheus
+// style timestamps in seconds and Loki style timestamps in nanoseconds are
+// supported as well as RFC 3339.
+func labelWindow(r *http.Request) (time.Duration, string) {
+	start, startOK := parseLabelTime(r.FormValue("start"))
+	end, endOK := parseLabelTime(r.FormValue("end"))
+	if !startOK || !endOK || !end.After(start) {
+		return defaultLabelWindow, r.FormValue("end")
+	}
+	return min(end.Sub(start).Round(time.Second)+time.Second, maxLabelWindow), r.FormValue("end")
+}
+
+func parseLabelTime(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil {
+		// Loki timestamps are in nanoseconds, Prometheus timestamps in seconds
+		if f > 1e15 {
+			return time.Unix(0, int64(f)), true
+		}
+		seconds, fraction := math.Modf(f)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), true
+	}
+	t, err := time.Parse(time.RFC3339Nano, value)
+	return t, err == nil
+}
+
+// tenantValueAllowed reports whether the tenant labels grant the value of
+// the tenant label, either directly or by one of their tuples.
+func tenantValueAllowed(tenantLabels TenantLabels, tenantLabel, value string) bool {
+	if tenantLabels.Excluded != nil && tenantLabels.Excluded.Allowed(value) {
+		return false
+	}
+	return tenantLabels.ClusterWide || anySelectorAllows(tenantLabels.Selectors(tenantLabel), tenantLabel, value)
+}
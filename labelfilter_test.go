@@ -0,0 +1,163 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelWindow(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantWindow time.Duration
+		wantAt     string
+	}{
+		{name: "Prometheus timestamps", query: "start=1700000000&end=1700003600.5", wantWindow: time.Hour + 2*time.Second, wantAt: "1700003600.5"},
+		{name: "Loki timestamps", query: "start=1700000000000000000&end=1700000600000000000", wantWindow: 10*time.Minute + time.Second, wantAt: "1700000600000000000"},
+		{name: "RFC 3339", query: "start=2024-01-01T00:00:00Z&end=2024-01-01T12:00:00Z", wantWindow: 12*time.Hour + time.Second, wantAt: "2024-01-01T12:00:00Z"},
+		{name: "Range longer than the maximum", query: "start=1600000000&end=1700000000", wantWindow: maxLabelWindow, wantAt: "1700000000"},
+		{name: "No range", query: "", wantWindow: defaultLabelWindow},
+		{name: "Invalid range", query: "start=2&end=1", wantWindow: defaultLabelWindow, wantAt: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			window, at := labelWindow(httptest.NewRequest(http.MethodGet, "/api/v1/labels?"+tt.query, nil))
+			assert.Equal(t, tt.wantWindow, window)
+			assert.Equal(t, tt.wantAt, at)
+		})
+	}
+}
+
+func TestLabelResponseFiltering(t *testing.T) {
+	app, tokens := setupTestMain()
+	var queries []string
+	thanos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/labels":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["__name__","job","secret","tenant_id"]}`)
+		case "/api/v1/label/tenant_id/values":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["allowed_user","other","also_allowed_user"]}`)
+		case "/api/v1/label/job/values":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["api","web","db"]}`)
+		case "/api/v1/query":
+			query := r.FormValue("query")
+			queries = append(queries, query+" @ "+r.FormValue("time"))
+			if strings.Contains(query, "label_replace") {
+				_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"label":"__name__"}},{"metric":{"label":"job"}}]}}`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"api"}},{"metric":{"job":"db"}}]}}`)
+		}
+	}))
+	defer thanos.Close()
+	app.Cfg.Thanos.URL = thanos.URL
+	app.Cfg.Thanos.TenantLabel = "tenant_id"
+	app.Cfg.Thanos.FilterLabelResponses = true
+	app.WithRoutes()
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("/api/v1/label/tenant_id/values")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":["allowed_user","also_allowed_user"]}`, rr.Body.String())
+	assert.Empty(t, queries)
+
+	rr = serve("/api/v1/label/job/values?start=1700000000&end=1700003600")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":["api","db"]}`, rr.Body.String())
+	assert.Equal(t, []string{`group by (job) (last_over_time({job=~"api|web|db",tenant_id=~"allowed_user|also_allowed_user"}[1h1s])) @ 1700003600`}, queries)
+
+	queries = nil
+	rr = serve("/api/v1/labels")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":["__name__","job","tenant_id"]}`, rr.Body.String())
+	assert.Len(t, queries, 1)
+	assert.Contains(t, queries[0], `label_replace(group(last_over_time({secret=~".+",tenant_id=~"allowed_user|also_allowed_user"}[1h])), "label", "secret", "", "")`)
+
+	t.Run("Verification query limit", func(t *testing.T) {
+		values := make([]string, 0, (maxLabelVerificationQueries+1)*jsonFilterBatchSize)
+		for i := 0; i < cap(values); i++ {
+			values = append(values, fmt.Sprintf("%q", fmt.Sprint("v", i)))
+		}
+		many := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/query" {
+				queries = append(queries, r.FormValue("query"))
+				_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"v0"}},{"metric":{"job":"v1050"}}]}}`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"status":"success","data":[`+strings.Join(values, ",")+`]}`)
+		}))
+		defer many.Close()
+		app.Cfg.Thanos.URL = many.URL
+		app.WithRoutes()
+		defer func() {
+			app.Cfg.Thanos.URL = thanos.URL
+			app.WithRoutes()
+		}()
+
+		queries = nil
+		rr := serve("/api/v1/label/job/values")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"status":"success","data":["v0"]}`, rr.Body.String())
+		assert.Len(t, queries, maxLabelVerificationQueries)
+	})
+
+	t.Run("Routed verification", func(t *testing.T) {
+		var dedicatedQueries []string
+		dedicated := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/query" {
+				dedicatedQueries = append(dedicatedQueries, r.FormValue("query"))
+				_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"job":"web"}}]}}`)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["api","web","db"]}`)
+		}))
+		defer dedicated.Close()
+		app.Cfg.Thanos.Upstreams = []UpstreamConfig{{URL: dedicated.URL, Tenants: []string{"allowed_user", "also_allowed_user"}}}
+		app.WithRoutes()
+		defer func() {
+			app.Cfg.Thanos.Upstreams = nil
+			app.WithRoutes()
+		}()
+
+		queries = nil
+		rr := serve("/api/v1/label/job/values")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.JSONEq(t, `{"status":"success","data":["web"]}`, rr.Body.String())
+		assert.Empty(t, queries)
+		assert.Len(t, dedicatedQueries, 1)
+	})
+
+	t.Run("Failing verification", func(t *testing.T) {
+		failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/v1/query" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = fmt.Fprint(w, `{"status":"success","data":["__name__","job"]}`)
+		}))
+		defer failing.Close()
+		app.Cfg.Thanos.URL = failing.URL
+		app.WithRoutes()
+		defer func() {
+			app.Cfg.Thanos.URL = thanos.URL
+			app.WithRoutes()
+		}()
+
+		rr := serve("/api/v1/labels")
+		assert.Equal(t, http.StatusBadGateway, rr.Code)
+		assert.Contains(t, rr.Body.String(), "verification query failed with status 401")
+	})
+}
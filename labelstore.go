@@ -1,15 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
 	"os"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/go-sql-driver/mysql"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/spf13/viper"
 )
 
@@ -18,12 +28,27 @@ import (
 type Labelstore interface {
 	// Connect establishes a connection with the label store using App configuration.
 	Connect(App) error
-	// GetLabels retrieves labels associated with the provided OAuth token.
-	// Returns a map containing the labels and a boolean indicating whether
+	// GetLabels retrieves labels associated with the provided OAuth token
+	// for the queried datasource.
+	// Returns the tenant labels and a boolean indicating whether
 	// the label is cluster-wide or not.
-	GetLabels(token OAuthToken) (map[string]bool, bool)
+	GetLabels(token OAuthToken, datasource Datasource) (TenantLabels, bool)
 }
 
+// Datasource identifies the kind of data a request queries. Grants in the
+// label store can be scoped to a datasource.
+type Datasource string
+
+const (
+	DatasourceMetrics  Datasource = "metrics"
+	DatasourceLogs     Datasource = "logs"
+	DatasourceTraces   Datasource = "traces"
+	DatasourceProfiles Datasource = "profiles"
+)
+
+// datasources lists all known datasources, used to validate scoped grants.
+var datasources = []Datasource{DatasourceMetrics, DatasourceLogs, DatasourceTraces, DatasourceProfiles}
+
 // WithLabelStore initializes and connects to a LabelStore specified in the
 // application configuration. It assigns the connected LabelStore to the App
 // instance and returns it. If the LabelStore type is unknown or an error
@@ -34,6 +59,10 @@ func (a *App) WithLabelStore() *App {
 		a.LabelStore = &ConfigMapHandler{}
 	case "mysql":
 		a.LabelStore = &MySQLHandler{}
+	case "sqlite":
+		a.LabelStore = &SQLiteHandler{}
+	case "claims":
+		a.LabelStore = &ClaimsHandler{}
 	default:
 		log.Fatal().Str("type", a.Cfg.Web.LabelStoreKind).Msg("Unknown label store type")
 	}
@@ -44,60 +73,502 @@ func (a *App) WithLabelStore() *App {
 	return a
 }
 
+// ConfigMapHandler reads the labels.yaml file. Username and group keys as
+// well as label values may be patterns, see isPattern.
+// Values nested under a datasource key like '#metrics' are only granted for
+// that datasource and kept in scoped, all other values apply to every datasource.
+// Time-bounded grants have their validity period kept in periods, the tenant
+// hierarchy of the '#tenants' key in tenants. Reloads replace all of them at
+// once while holding mu.
 type ConfigMapHandler struct {
-	labels map[string]map[string]bool
+	labels     map[string]map[string]bool
+	scoped     map[Datasource]map[string]map[string]bool
+	periods    map[grantKey]grantPeriod
+	patterns   []subjectPattern
+	tenants    TenantHierarchy
+	version    LabelsVersion
+	namespaces *NamespaceInformer
+	expired    sync.Map
+	mu         sync.RWMutex
+	reloadMu   sync.Mutex
+	v          *viper.Viper
+}
+
+// LabelsVersion identifies the loaded grants of a label store by the hash of
+// their content and the time they were loaded.
+type LabelsVersion struct {
+	Hash     string    `json:"hash"`
+	LoadedAt time.Time `json:"loaded_at"`
+}
+
+// Reloader is implemented by label stores that can reload their grants.
+type Reloader interface {
+	// Reload reloads the grants, keeping the previous ones on error.
+	Reload() (LabelsVersion, error)
+	// Version returns the version of the loaded grants.
+	Version() LabelsVersion
+}
+
+// EffectiveGrant is a label value granted to a token with its provenance:
+// the username, group or pattern key granting it, the datasource it is
+// scoped to and the tenant reference or namespace selector it was resolved
+// from.
+type EffectiveGrant struct {
+	Label      string     `json:"label"`
+	Subject    string     `json:"subject"`
+	Datasource Datasource `json:"datasource,omitempty"`
+	Source     string     `json:"source,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+// GrantExplainer is implemented by label stores that can explain the grants
+// of a token.
+type GrantExplainer interface {
+	EffectiveGrants(token OAuthToken, datasource Datasource) []EffectiveGrant
+}
+
+// grantKey identifies a label value granted to a subject of labels.yaml.
+// Datasource is empty for grants applying to every datasource.
+type grantKey struct {
+	Datasource Datasource
+	Subject    string
+	Label      string
+}
+
+// grantPeriod is the validity period of a time-bounded grant, zero times are
+// unbounded.
+type grantPeriod struct {
+	NotBefore time.Time
+	Expires   time.Time
 }
 
-func (c *ConfigMapHandler) Connect(_ App) error {
-	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
-	v.SetConfigName("labels")
-	v.SetConfigType("yaml")
-	v.AddConfigPath("/etc/config/labels/")
-	v.AddConfigPath("./configs")
-	err := v.MergeInConfig()
+// active reports whether the grant is valid at the given time.
+func (p grantPeriod) active(now time.Time) bool {
+	return (p.NotBefore.IsZero() || !now.Before(p.NotBefore)) && (p.Expires.IsZero() || now.Before(p.Expires))
+}
+
+// ExpiringGrant is a time-bounded grant listed by the admin API.
+type ExpiringGrant struct {
+	Subject    string     `json:"subject"`
+	Label      string     `json:"label"`
+	Datasource Datasource `json:"datasource,omitempty"`
+	NotBefore  *time.Time `json:"not_before,omitempty"`
+	Expires    time.Time  `json:"expires"`
+}
+
+// GrantExpirer is implemented by label stores supporting time-bounded grants.
+type GrantExpirer interface {
+	// ExpiringGrants returns the grants expiring within the given duration,
+	// sorted by expiry.
+	ExpiringGrants(within time.Duration) []ExpiringGrant
+}
+
+var (
+	grantsExpired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_labelstore_grants_expired_total",
+		Help: "Number of time-bounded grants of the label store that expired.",
+	}, []string{"datasource"})
+	labelStoreReloads = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_labelstore_reloads_total",
+		Help: "Number of label store reloads by result.",
+	}, []string{"result"})
+	labelStoreLoadTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "multena_labelstore_last_load_timestamp_seconds",
+		Help: "Time the grants of the label store were last loaded.",
+	})
+	labelStoreInfo = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "multena_labelstore_info",
+		Help: "Content hash of the loaded grants of the label store.",
+	}, []string{"hash"})
+)
+
+// subjectPattern is a username or group key of labels.yaml that is matched
+// against the username and groups of a token instead of being looked up.
+type subjectPattern struct {
+	key   string
+	regex *regexp.Regexp
+}
+
+func (c *ConfigMapHandler) Connect(a App) error {
+	c.namespaces = a.Namespaces
+	c.v = viper.NewWithOptions(viper.KeyDelimiter("::"))
+	c.v.SetConfigName("labels")
+	c.v.SetConfigType("yaml")
+	c.v.AddConfigPath("/etc/config/labels/")
+	c.v.AddConfigPath("./configs")
+	_, err := c.Reload()
 	if err != nil {
 		return err
 	}
-	err = v.Unmarshal(&c.labels)
+	go c.watchExpiry(time.Minute)
+	c.v.OnConfigChange(func(e fsnotify.Event) {
+		log.Info().Str("file", e.Name).Msg("Config file changed")
+		if _, err := c.Reload(); err != nil {
+			log.Error().Err(err).Msg("Error while reloading labels, keeping the previous labels")
+		}
+	})
+	c.v.WatchConfig()
+	return nil
+}
+
+// Reload reads the labels.yaml again and replaces all grants at once. On
+// error the previous grants are kept.
+func (c *ConfigMapHandler) Reload() (LabelsVersion, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+	err := c.reload()
+	if err != nil {
+		labelStoreReloads.WithLabelValues("error").Inc()
+		return LabelsVersion{}, err
+	}
+	labelStoreReloads.WithLabelValues("success").Inc()
+	return c.Version(), nil
+}
+
+// reload reads the content of the labels.yaml once, so that the hash
+// matches the loaded grants.
+func (c *ConfigMapHandler) reload() error {
+	if c.v.ConfigFileUsed() == "" {
+		if err := c.v.ReadInConfig(); err != nil {
+			return err
+		}
+	}
+	content, err := os.ReadFile(c.v.ConfigFileUsed())
 	if err != nil {
-		log.Fatal().Err(err).Msg("Error while unmarshalling config file")
 		return err
 	}
-	v.OnConfigChange(func(e fsnotify.Event) {
-		log.Info().Str("file", e.Name).Msg("Config file changed")
-		err = v.MergeInConfig()
-		if err != nil {
-			log.Fatal().Err(err).Msg("Error while unmarshalling config file")
+	if err := c.v.ReadConfig(bytes.NewReader(content)); err != nil {
+		return err
+	}
+	var raw map[string]map[string]any
+	if err := c.v.Unmarshal(&raw); err != nil {
+		return err
+	}
+	return c.load(raw, content)
+}
+
+// load parses and validates the raw labels.yaml content before replacing
+// all grants at once and updating the version metrics.
+func (c *ConfigMapHandler) load(raw map[string]map[string]any, content []byte) error {
+	tenants, err := parseTenants(raw, c.namespaces)
+	if err != nil {
+		return err
+	}
+	labels, scoped, periods, err := parseLabels(raw)
+	if err != nil {
+		return err
+	}
+	err = tenants.validateGrants(labels, scoped)
+	if err != nil {
+		return err
+	}
+	patterns, err := c.compileLabels(labels, scoped)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(content)
+	version := LabelsVersion{Hash: hex.EncodeToString(sum[:]), LoadedAt: time.Now()}
+
+	c.mu.Lock()
+	c.labels = labels
+	c.scoped = scoped
+	c.periods = periods
+	c.patterns = patterns
+	c.tenants = tenants
+	c.version = version
+	c.mu.Unlock()
+
+	labelStoreInfo.Reset()
+	labelStoreInfo.WithLabelValues(version.Hash).Set(1)
+	labelStoreLoadTimestamp.Set(float64(version.LoadedAt.Unix()))
+	log.Info().Str("hash", version.Hash).Int("subjects", len(labels)).Msg("Labels loaded")
+	c.reportExpired(version.LoadedAt)
+	return nil
+}
+
+// Version returns the hash and load time of the current grants.
+func (c *ConfigMapHandler) Version() LabelsVersion {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.version
+}
+
+// parseLabels splits the raw labels.yaml content into the unscoped labels and
+// the labels scoped to a datasource. A value of a username or group key is
+// either a label with a boolean, a label with a validity period or a
+// datasource key like '#logs' holding labels. The tenant hierarchy is skipped,
+// see parseTenants.
+func parseLabels(raw map[string]map[string]any) (map[string]map[string]bool, map[Datasource]map[string]map[string]bool, map[grantKey]grantPeriod, error) {
+	labels := make(map[string]map[string]bool, len(raw))
+	scoped := make(map[Datasource]map[string]map[string]bool)
+	periods := make(map[grantKey]grantPeriod)
+	for subject, entries := range raw {
+		if subject == tenantsKey {
+			continue
+		}
+		labels[subject] = make(map[string]bool, len(entries))
+		for key, value := range entries {
+			if v, ok := value.(map[string]any); ok && strings.HasPrefix(key, "#") && key != "#cluster-wide" {
+				datasource := Datasource(strings.TrimPrefix(key, "#"))
+				if !slices.Contains(datasources, datasource) {
+					return nil, nil, nil, fmt.Errorf("unknown datasource %s for %s", key, subject)
+				}
+				if scoped[datasource] == nil {
+					scoped[datasource] = make(map[string]map[string]bool)
+				}
+				scoped[datasource][subject] = make(map[string]bool, len(v))
+				for label, granted := range v {
+					err := parseGrant(scoped[datasource][subject], periods, grantKey{Datasource: datasource, Subject: subject, Label: label}, granted)
+					if err != nil {
+						return nil, nil, nil, err
+					}
+				}
+				continue
+			}
+			err := parseGrant(labels[subject], periods, grantKey{Subject: subject, Label: key}, value)
+			if err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	return labels, scoped, periods, nil
+}
+
+// parseGrant adds a label of labels.yaml to labels. The value is either a
+// boolean or a map with the optional keys not_before and expires, which is
+// recorded in periods.
+func parseGrant(labels map[string]bool, periods map[grantKey]grantPeriod, key grantKey, value any) error {
+	switch v := value.(type) {
+	case bool:
+		labels[key.Label] = v
+		return nil
+	case map[string]any:
+		var period grantPeriod
+		for name, timestamp := range v {
+			t, err := parseTimestamp(timestamp)
+			if err != nil {
+				return fmt.Errorf("invalid %s for label %s of %s: %w", name, key.Label, key.Subject, err)
+			}
+			switch name {
+			case "not_before":
+				period.NotBefore = t
+			case "expires":
+				period.Expires = t
+			default:
+				return fmt.Errorf("unknown key %s for label %s of %s", name, key.Label, key.Subject)
+			}
+		}
+		if !period.NotBefore.IsZero() && !period.Expires.IsZero() && !period.Expires.After(period.NotBefore) {
+			return fmt.Errorf("label %s of %s expires before it becomes valid", key.Label, key.Subject)
+		}
+		labels[key.Label] = true
+		periods[key] = period
+		return nil
+	default:
+		return fmt.Errorf("invalid value for label %s of %s", key.Label, key.Subject)
+	}
+}
+
+// parseTimestamp accepts YAML timestamps and RFC 3339 strings.
+func parseTimestamp(value any) (time.Time, error) {
+	switch v := value.(type) {
+	case time.Time:
+		return v, nil
+	case string:
+		return time.Parse(time.RFC3339, v)
+	default:
+		return time.Time{}, fmt.Errorf("unsupported timestamp %v", value)
+	}
+}
+
+// setLabels validates the given labels and replaces the current labels.
+func (c *ConfigMapHandler) setLabels(labels map[string]map[string]bool, scoped map[Datasource]map[string]map[string]bool) error {
+	patterns, err := c.compileLabels(labels, scoped)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.labels = labels
+	c.scoped = scoped
+	c.patterns = patterns
+	return nil
+}
+
+// compileLabels validates all label values of the given labels and compiles
+// the username and group patterns.
+func (c *ConfigMapHandler) compileLabels(labels map[string]map[string]bool, scoped map[Datasource]map[string]map[string]bool) ([]subjectPattern, error) {
+	var patterns []subjectPattern
+	seen := make(map[string]bool)
+	all := []map[string]map[string]bool{labels}
+	for _, datasourceLabels := range scoped {
+		all = append(all, datasourceLabels)
+	}
+	for _, subjects := range all {
+		for key, values := range subjects {
+			if isPattern(key) && !seen[key] {
+				_, re, err := compilePattern(key)
+				if err != nil {
+					return nil, err
+				}
+				seen[key] = true
+				patterns = append(patterns, subjectPattern{key: key, regex: re})
+			}
+			for value := range values {
+				if err := validateLabel(value, c.namespaces); err != nil {
+					return nil, err
+				}
+			}
 		}
-		err = v.Unmarshal(&c.labels)
+	}
+	return patterns, nil
+}
+
+func (c *ConfigMapHandler) GetLabels(token OAuthToken, datasource Datasource) (TenantLabels, bool) {
+	tenantLabels := NewTenantLabels()
+	for _, grant := range c.EffectiveGrants(token, datasource) {
+		if err := tenantLabels.Add(grant.Label); err != nil {
+			log.Error().Err(err).Str("subject", grant.Subject).Msg("Skipping invalid label pattern")
+		}
+	}
+	if tenantLabels.Skip() {
+		return TenantLabels{}, true
+	}
+	return tenantLabels, false
+}
+
+// EffectiveGrants returns the active grants of the token for the datasource
+// sorted by subject, scope and label. Tenant references and namespace
+// selectors are resolved, Source holds the original value.
+func (c *ConfigMapHandler) EffectiveGrants(token OAuthToken, datasource Datasource) []EffectiveGrant {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now()
+	var grants []EffectiveGrant
+	for _, subject := range matchSubjects(token, c.patterns) {
+		for i, values := range []map[string]bool{c.labels[subject], c.scoped[datasource][subject]} {
+			key := grantKey{Subject: subject}
+			if i == 1 {
+				key.Datasource = datasource
+			}
+			for k := range values {
+				key.Label = k
+				period, bounded := c.periods[key]
+				if bounded && !period.active(now) {
+					continue
+				}
+				for _, value := range c.resolve(k, subject) {
+					grant := EffectiveGrant{Label: value, Subject: subject, Datasource: key.Datasource}
+					if value != k {
+						grant.Source = k
+					}
+					if bounded {
+						grant.Expires = timePtr(period.Expires)
+					}
+					grants = append(grants, grant)
+				}
+			}
+		}
+	}
+	slices.SortFunc(grants, func(a, b EffectiveGrant) int {
+		return cmp.Or(
+			strings.Compare(a.Subject, b.Subject),
+			strings.Compare(string(a.Datasource), string(b.Datasource)),
+			strings.Compare(a.Label, b.Label),
+			strings.Compare(a.Source, b.Source),
+		)
+	})
+	return grants
+}
+
+// resolve expands tenant references and resolves namespace selectors of a
+// label value, errors are logged and skip the value.
+func (c *ConfigMapHandler) resolve(label, subject string) []string {
+	expanded, err := c.tenants.Expand(label)
+	if err != nil {
+		log.Error().Err(err).Str("subject", subject).Msg("Skipping unknown tenant")
+		return nil
+	}
+	var values []string
+	for _, label := range expanded {
+		resolved, err := resolveLabel(label, c.namespaces)
 		if err != nil {
-			log.Fatal().Err(err).Msg("Error while unmarshalling config file")
+			log.Error().Err(err).Str("subject", subject).Msg("Skipping unresolvable namespace selector")
+			continue
+		}
+		values = append(values, resolved...)
+	}
+	return values
+}
+
+// ExpiringGrants returns the time-bounded grants that are not expired yet
+// and expire within the given duration.
+func (c *ConfigMapHandler) ExpiringGrants(within time.Duration) []ExpiringGrant {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	now := time.Now()
+	var grants []ExpiringGrant
+	for key, period := range c.periods {
+		if period.Expires.IsZero() || !period.Expires.After(now) || period.Expires.After(now.Add(within)) {
+			continue
+		}
+		grant := ExpiringGrant{Subject: key.Subject, Label: key.Label, Datasource: key.Datasource, Expires: period.Expires}
+		if !period.NotBefore.IsZero() {
+			grant.NotBefore = &period.NotBefore
 		}
+		grants = append(grants, grant)
+	}
+	slices.SortFunc(grants, func(a, b ExpiringGrant) int {
+		return a.Expires.Compare(b.Expires)
 	})
-	v.WatchConfig()
-	log.Debug().Any("labels", c.labels).Msg("")
-	return nil
+	return grants
 }
 
-func (c *ConfigMapHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
-	username := token.PreferredUsername
-	groups := token.Groups
-	mergedNamespaces := make(map[string]bool, len(c.labels[username])*2)
-	for k := range c.labels[username] {
-		mergedNamespaces[k] = true
-		if k == "#cluster-wide" {
-			return nil, true
+// watchExpiry periodically reports grants that expired since the last check.
+func (c *ConfigMapHandler) watchExpiry(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		c.reportExpired(now)
+	}
+}
+
+// reportExpired logs every grant that expired and counts it in the
+// grantsExpired metric, each grant is reported once.
+func (c *ConfigMapHandler) reportExpired(now time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for key, period := range c.periods {
+		if period.Expires.IsZero() || now.Before(period.Expires) {
+			continue
+		}
+		if reported, ok := c.expired.Load(key); ok && reported.(time.Time).Equal(period.Expires) {
+			continue
 		}
+		c.expired.Store(key, period.Expires)
+		log.Info().Str("subject", key.Subject).Str("label", key.Label).Str("datasource", string(key.Datasource)).
+			Time("expires", period.Expires).Msg("Grant expired")
+		grantsExpired.WithLabelValues(string(key.Datasource)).Inc()
 	}
-	for _, group := range groups {
-		for k := range c.labels[group] {
-			mergedNamespaces[k] = true
-			if k == "#cluster-wide" {
-				return nil, true
+}
+
+// matchSubjects returns the subjects that apply to the token: its username,
+// its groups and every pattern key matching the username or one of the groups.
+func matchSubjects(token OAuthToken, patterns []subjectPattern) []string {
+	subjects := append([]string{token.PreferredUsername}, token.Groups...)
+	for _, pattern := range patterns {
+		if pattern.regex.MatchString(token.PreferredUsername) {
+			subjects = append(subjects, pattern.key)
+			continue
+		}
+		for _, group := range token.Groups {
+			if pattern.regex.MatchString(group) {
+				subjects = append(subjects, pattern.key)
+				break
 			}
 		}
 	}
-	return mergedNamespaces, false
+	return subjects
 }
 
 type MySQLHandler struct {
@@ -136,7 +607,10 @@ func (m *MySQLHandler) Close() {
 	}
 }
 
-func (m *MySQLHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
+// GetLabels runs the configured query, its labels apply to every datasource.
+// The rows are literal label values, values like "!x", "team-*" or tuples
+// are not parsed as exclusions, patterns or tuples.
+func (m *MySQLHandler) GetLabels(token OAuthToken, _ Datasource) (TenantLabels, bool) {
 	tokenMap := map[string]string{
 		"email":    token.Email,
 		"username": token.PreferredUsername,
@@ -146,7 +620,7 @@ func (m *MySQLHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
 	value, ok := tokenMap[m.TokenKey]
 	if !ok {
 		log.Fatal().Str("property", m.TokenKey).Msg("Unsupported token property")
-		return nil, false
+		return TenantLabels{}, false
 	}
 	n := strings.Count(m.Query, "?")
 
@@ -165,14 +639,14 @@ func (m *MySQLHandler) GetLabels(token OAuthToken) (map[string]bool, bool) {
 	if err != nil {
 		log.Fatal().Err(err).Str("query", m.Query).Msg("Error while querying database")
 	}
-	labels := make(map[string]bool)
+	labels := NewTenantLabels()
 	for res.Next() {
 		var label string
 		err = res.Scan(&label)
-		labels[label] = true
 		if err != nil {
 			log.Fatal().Err(err).Msg("Error scanning DB result")
 		}
+		labels.Values[label] = true
 	}
 	return labels, false
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// ClaimsHandler reads the tenant labels straight from a claim of the token.
+// The claim is addressed by a dot separated path into nested claims, e.g.
+// "resource_access.grafana.namespaces", and holds a string or a list of
+// strings. Values are optionally filtered and extracted with a regex and
+// rewritten with a prefix mapping. Its labels apply to every datasource.
+type ClaimsHandler struct {
+	Path          []string
+	ValueRegex    *regexp.Regexp
+	PrefixMapping map[string]string
+	prefixes      []string
+}
+
+func (c *ClaimsHandler) Connect(a App) error {
+	if a.Cfg.Claims.Path == "" {
+		return fmt.Errorf("claims path is required")
+	}
+	c.Path = strings.Split(a.Cfg.Claims.Path, ".")
+	if a.Cfg.Claims.ValueRegex != "" {
+		re, err := regexp.Compile(a.Cfg.Claims.ValueRegex)
+		if err != nil {
+			return fmt.Errorf("invalid claims value regex: %w", err)
+		}
+		if re.NumSubexp() > 1 {
+			return fmt.Errorf("claims value regex must have at most one capture group")
+		}
+		c.ValueRegex = re
+	}
+	c.PrefixMapping = a.Cfg.Claims.PrefixMapping
+	c.prefixes = MapKeysToArray(c.PrefixMapping)
+	// the longest prefix wins
+	sort.Slice(c.prefixes, func(i, j int) bool { return len(c.prefixes[i]) > len(c.prefixes[j]) })
+	log.Debug().Strs("path", c.Path).Str("regex", a.Cfg.Claims.ValueRegex).Any("prefix_mapping", c.PrefixMapping).Msg("")
+	return nil
+}
+
+// GetLabels maps the values of the configured claim to tenant labels.
+func (c *ClaimsHandler) GetLabels(token OAuthToken, _ Datasource) (TenantLabels, bool) {
+	labels := NewTenantLabels()
+	for _, value := range claimValues(token.Claims, c.Path) {
+		value, ok := c.mapValue(value)
+		if !ok {
+			continue
+		}
+		if err := labels.Add(value); err != nil {
+			log.Error().Err(err).Str("value", value).Msg("Skipping invalid label pattern")
+		}
+	}
+	if labels.Skip() {
+		return TenantLabels{}, true
+	}
+	return labels, false
+}
+
+// mapValue applies the value regex and the prefix mapping to a claim value.
+// A value not matching the regex is dropped, if the regex has a capture group
+// the captured text is the value. With a prefix mapping, only values with one
+// of the prefixes are kept and the prefix is replaced.
+func (c *ClaimsHandler) mapValue(value string) (string, bool) {
+	if c.ValueRegex != nil {
+		match := c.ValueRegex.FindStringSubmatch(value)
+		if match == nil {
+			return "", false
+		}
+		if len(match) > 1 {
+			value = match[1]
+		}
+	}
+	if len(c.prefixes) == 0 {
+		return value, value != ""
+	}
+	for _, prefix := range c.prefixes {
+		if strings.HasPrefix(value, prefix) {
+			value = c.PrefixMapping[prefix] + strings.TrimPrefix(value, prefix)
+			return value, value != ""
+		}
+	}
+	return "", false
+}
+
+// claimValues returns the string values of the claim at the path.
+func claimValues(claims map[string]any, path []string) []string {
+	var claim any = claims
+	for _, key := range path {
+		m, ok := claim.(map[string]any)
+		if !ok {
+			return nil
+		}
+		claim = m[key]
+	}
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []any:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
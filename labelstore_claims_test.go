@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetLabelsClaims(t *testing.T) {
+	claims := map[string]any{
+		"namespaces": []any{"payments", "billing", 42},
+		"groups":     []any{"ns-payments-viewer", "ns-shop-viewer", "admins", "team-a-devs"},
+		"resource_access": map[string]any{
+			"grafana": map[string]any{"namespace": "shop"},
+		},
+	}
+
+	cases := []struct {
+		name     string
+		config   ClaimsConfig
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "List claim",
+			config:   ClaimsConfig{Path: "namespaces"},
+			expected: []string{"billing", "payments"},
+		},
+		{
+			name:     "Nested string claim",
+			config:   ClaimsConfig{Path: "resource_access.grafana.namespace"},
+			expected: []string{"shop"},
+		},
+		{
+			name:     "Missing claim",
+			config:   ClaimsConfig{Path: "resource_access.other.namespace"},
+			expected: []string{},
+		},
+		{
+			name:     "Value regex with capture group",
+			config:   ClaimsConfig{Path: "groups", ValueRegex: "^ns-(.+)-viewer$"},
+			expected: []string{"payments", "shop"},
+		},
+		{
+			name:     "Prefix mapping",
+			config:   ClaimsConfig{Path: "groups", PrefixMapping: map[string]string{"ns-": "", "team-": "tenant-"}},
+			expected: []string{"payments-viewer", "shop-viewer", "tenant-a-devs"},
+		},
+		{
+			name:     "Value regex and prefix mapping",
+			config:   ClaimsConfig{Path: "groups", ValueRegex: "-(?:viewer|devs)$", PrefixMapping: map[string]string{"ns-": "", "ns-shop": "webshop"}},
+			expected: []string{"payments-viewer", "webshop-viewer"},
+		},
+		{
+			name:    "Invalid regex",
+			config:  ClaimsConfig{Path: "groups", ValueRegex: "^ns-("},
+			wantErr: true,
+		},
+		{
+			name:    "Missing path",
+			config:  ClaimsConfig{},
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := &ClaimsHandler{}
+			err := c.Connect(App{Cfg: &Config{Claims: tc.config}})
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			labels, skip := c.GetLabels(OAuthToken{Claims: claims}, DatasourceMetrics)
+			assert.False(t, skip)
+			assert.Equal(t, tc.expected, labels.Strings())
+		})
+	}
+}
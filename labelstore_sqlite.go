@@ -0,0 +1,419 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	_ "modernc.org/sqlite"
+)
+
+// Grant is a label value granted to a user or group, optionally scoped to a
+// datasource and bounded in time. Like the keys of labels.yaml, the subject
+// is matched against the username and the groups of a token and may be a
+// pattern.
+type Grant struct {
+	ID         int64      `json:"id"`
+	Subject    string     `json:"subject"`
+	Label      string     `json:"label"`
+	Datasource Datasource `json:"datasource,omitempty"`
+	NotBefore  *time.Time `json:"not_before,omitempty"`
+	Expires    *time.Time `json:"expires,omitempty"`
+}
+
+// GrantStore is implemented by writable label stores, it backs the admin API.
+type GrantStore interface {
+	// ListGrants returns the grants of the subject, or every grant if the
+	// subject is empty.
+	ListGrants(subject string) ([]Grant, error)
+	// CreateGrant stores a new grant and returns it with its ID.
+	CreateGrant(grant Grant) (Grant, error)
+	// UpdateGrant replaces the grant with the ID of the given grant.
+	UpdateGrant(grant Grant) error
+	// DeleteGrant deletes the grant with the given ID.
+	DeleteGrant(id int64) error
+	// ImportLabels replaces every grant with the grants of the labels.yaml content.
+	ImportLabels(raw map[string]map[string]any) error
+	// ExportLabels returns every grant in the labels.yaml format.
+	ExportLabels() (map[string]map[string]any, error)
+}
+
+// errGrantNotFound is returned when updating or deleting a grant that does not exist.
+var errGrantNotFound = errors.New("grant not found")
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS grants (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	subject TEXT NOT NULL,
+	label TEXT NOT NULL,
+	datasource TEXT NOT NULL DEFAULT '',
+	not_before INTEGER,
+	expires INTEGER,
+	UNIQUE (subject, label, datasource)
+);
+CREATE INDEX IF NOT EXISTS grants_subject ON grants (subject);
+`
+
+// SQLiteHandler is an embedded, writable label store keeping its grants in
+// a SQLite database. Subject patterns are cached and refreshed on every write.
+type SQLiteHandler struct {
+	DB         *sql.DB
+	mu         sync.RWMutex
+	patterns   []subjectPattern
+	namespaces *NamespaceInformer
+}
+
+func (s *SQLiteHandler) Connect(a App) error {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)", a.Cfg.SQLite.Path))
+	if err != nil {
+		return err
+	}
+	// SQLite allows a single writer, serializing the connections avoids busy errors
+	db.SetMaxOpenConns(1)
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		return err
+	}
+	s.DB = db
+	s.namespaces = a.Namespaces
+	return s.refreshPatterns()
+}
+
+func (s *SQLiteHandler) Close() {
+	err := s.DB.Close()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error closing DB connection")
+	}
+}
+
+// GetLabels returns the active grants of every subject applying to the token.
+// Errors are logged and result in no labels, which denies the request.
+func (s *SQLiteHandler) GetLabels(token OAuthToken, datasource Datasource) (TenantLabels, bool) {
+	s.mu.RLock()
+	subjects := matchSubjects(token, s.patterns)
+	s.mu.RUnlock()
+
+	now := time.Now().Unix()
+	query := fmt.Sprintf(`SELECT label FROM grants
+		WHERE subject IN (?%s) AND datasource IN ('', ?)
+		AND (not_before IS NULL OR not_before <= ?) AND (expires IS NULL OR expires > ?)`,
+		strings.Repeat(", ?", len(subjects)-1))
+	args := make([]any, 0, len(subjects)+3)
+	for _, subject := range subjects {
+		args = append(args, subject)
+	}
+	args = append(args, string(datasource), now, now)
+
+	rows, err := s.DB.Query(query, args...)
+	if err != nil {
+		log.Error().Err(err).Msg("Error while querying database")
+		return TenantLabels{}, false
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	labels := NewTenantLabels()
+	for rows.Next() {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			log.Error().Err(err).Msg("Error scanning DB result")
+			return TenantLabels{}, false
+		}
+		resolved, err := resolveLabel(label, s.namespaces)
+		if err != nil {
+			log.Error().Err(err).Msg("Skipping unresolvable namespace selector")
+			continue
+		}
+		for _, value := range resolved {
+			if err := labels.Add(value); err != nil {
+				log.Error().Err(err).Msg("Skipping invalid label pattern")
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		log.Error().Err(err).Msg("Error scanning DB result")
+		return TenantLabels{}, false
+	}
+	if labels.Skip() {
+		return TenantLabels{}, true
+	}
+	return labels, false
+}
+
+func (s *SQLiteHandler) ListGrants(subject string) ([]Grant, error) {
+	query := "SELECT id, subject, label, datasource, not_before, expires FROM grants"
+	var args []any
+	if subject != "" {
+		query += " WHERE subject = ?"
+		args = append(args, subject)
+	}
+	rows, err := s.DB.Query(query+" ORDER BY subject, datasource, label", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	grants := []Grant{}
+	for rows.Next() {
+		var grant Grant
+		var notBefore, expires sql.NullInt64
+		if err := rows.Scan(&grant.ID, &grant.Subject, &grant.Label, &grant.Datasource, &notBefore, &expires); err != nil {
+			return nil, err
+		}
+		grant.NotBefore = fromUnix(notBefore)
+		grant.Expires = fromUnix(expires)
+		grants = append(grants, grant)
+	}
+	return grants, rows.Err()
+}
+
+func (s *SQLiteHandler) CreateGrant(grant Grant) (Grant, error) {
+	if err := validateGrant(grant, s.namespaces); err != nil {
+		return Grant{}, err
+	}
+	res, err := s.DB.Exec("INSERT INTO grants (subject, label, datasource, not_before, expires) VALUES (?, ?, ?, ?, ?)",
+		grant.Subject, grant.Label, string(grant.Datasource), toUnix(grant.NotBefore), toUnix(grant.Expires))
+	if err != nil {
+		return Grant{}, err
+	}
+	grant.ID, err = res.LastInsertId()
+	if err != nil {
+		return Grant{}, err
+	}
+	return grant, s.refreshPatterns()
+}
+
+func (s *SQLiteHandler) UpdateGrant(grant Grant) error {
+	if err := validateGrant(grant, s.namespaces); err != nil {
+		return err
+	}
+	res, err := s.DB.Exec("UPDATE grants SET subject = ?, label = ?, datasource = ?, not_before = ?, expires = ? WHERE id = ?",
+		grant.Subject, grant.Label, string(grant.Datasource), toUnix(grant.NotBefore), toUnix(grant.Expires), grant.ID)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errors.Join(errGrantNotFound, err)
+	}
+	return s.refreshPatterns()
+}
+
+func (s *SQLiteHandler) DeleteGrant(id int64) error {
+	res, err := s.DB.Exec("DELETE FROM grants WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n == 0 {
+		return errors.Join(errGrantNotFound, err)
+	}
+	return s.refreshPatterns()
+}
+
+// ImportLabels replaces every grant in a single transaction. Labels set to
+// false are not imported.
+func (s *SQLiteHandler) ImportLabels(raw map[string]map[string]any) error {
+	if _, ok := raw[tenantsKey]; ok {
+		return fmt.Errorf("tenant hierarchies are not supported by the sqlite label store")
+	}
+	labels, scoped, periods, err := parseLabels(raw)
+	if err != nil {
+		return err
+	}
+	var grants []Grant
+	add := func(datasource Datasource, subjects map[string]map[string]bool) {
+		for subject, values := range subjects {
+			for label, granted := range values {
+				if !granted {
+					continue
+				}
+				grant := Grant{Subject: subject, Label: label, Datasource: datasource}
+				if period, ok := periods[grantKey{Datasource: datasource, Subject: subject, Label: label}]; ok {
+					grant.NotBefore = timePtr(period.NotBefore)
+					grant.Expires = timePtr(period.Expires)
+				}
+				grants = append(grants, grant)
+			}
+		}
+	}
+	add("", labels)
+	for datasource, subjects := range scoped {
+		add(datasource, subjects)
+	}
+	for _, grant := range grants {
+		if err := validateGrant(grant, s.namespaces); err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+	if _, err := tx.Exec("DELETE FROM grants"); err != nil {
+		return err
+	}
+	for _, grant := range grants {
+		_, err := tx.Exec("INSERT INTO grants (subject, label, datasource, not_before, expires) VALUES (?, ?, ?, ?, ?)",
+			grant.Subject, grant.Label, string(grant.Datasource), toUnix(grant.NotBefore), toUnix(grant.Expires))
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.refreshPatterns()
+}
+
+// ExportLabels returns every grant in the labels.yaml format, time-bounded
+// grants are exported with their not_before and expires timestamps.
+func (s *SQLiteHandler) ExportLabels() (map[string]map[string]any, error) {
+	grants, err := s.ListGrants("")
+	if err != nil {
+		return nil, err
+	}
+	raw := make(map[string]map[string]any)
+	for _, grant := range grants {
+		if raw[grant.Subject] == nil {
+			raw[grant.Subject] = make(map[string]any)
+		}
+		entries := raw[grant.Subject]
+		if grant.Datasource != "" {
+			key := "#" + string(grant.Datasource)
+			if entries[key] == nil {
+				entries[key] = make(map[string]any)
+			}
+			entries = entries[key].(map[string]any)
+		}
+		var value any = true
+		if grant.NotBefore != nil || grant.Expires != nil {
+			period := make(map[string]any)
+			if grant.NotBefore != nil {
+				period["not_before"] = grant.NotBefore.UTC()
+			}
+			if grant.Expires != nil {
+				period["expires"] = grant.Expires.UTC()
+			}
+			value = period
+		}
+		entries[grant.Label] = value
+	}
+	return raw, nil
+}
+
+// ExpiringGrants returns the grants that are not expired yet and expire
+// within the given duration.
+func (s *SQLiteHandler) ExpiringGrants(within time.Duration) []ExpiringGrant {
+	now := time.Now()
+	grants, err := s.ListGrants("")
+	if err != nil {
+		log.Error().Err(err).Msg("Error while querying database")
+		return nil
+	}
+	var expiring []ExpiringGrant
+	for _, grant := range grants {
+		if grant.Expires == nil || !grant.Expires.After(now) || grant.Expires.After(now.Add(within)) {
+			continue
+		}
+		expiring = append(expiring, ExpiringGrant{
+			Subject:    grant.Subject,
+			Label:      grant.Label,
+			Datasource: grant.Datasource,
+			NotBefore:  grant.NotBefore,
+			Expires:    *grant.Expires,
+		})
+	}
+	slices.SortFunc(expiring, func(a, b ExpiringGrant) int {
+		return a.Expires.Compare(b.Expires)
+	})
+	return expiring
+}
+
+// refreshPatterns compiles the subjects of all grants that are patterns.
+func (s *SQLiteHandler) refreshPatterns() error {
+	rows, err := s.DB.Query("SELECT DISTINCT subject FROM grants")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	var patterns []subjectPattern
+	for rows.Next() {
+		var subject string
+		if err := rows.Scan(&subject); err != nil {
+			return err
+		}
+		if !isPattern(subject) {
+			continue
+		}
+		_, re, err := compilePattern(subject)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, subjectPattern{key: subject, regex: re})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(patterns, func(i, j int) bool { return patterns[i].key < patterns[j].key })
+	s.mu.Lock()
+	s.patterns = patterns
+	s.mu.Unlock()
+	return nil
+}
+
+// validateGrant checks the subject pattern, the label, the datasource and the
+// validity period of a grant.
+func validateGrant(grant Grant, namespaces *NamespaceInformer) error {
+	if grant.Subject == "" || grant.Label == "" {
+		return fmt.Errorf("subject and label are required")
+	}
+	if isPattern(grant.Subject) {
+		if _, _, err := compilePattern(grant.Subject); err != nil {
+			return err
+		}
+	}
+	if err := validateLabel(grant.Label, namespaces); err != nil {
+		return err
+	}
+	if grant.Datasource != "" && !slices.Contains(datasources, grant.Datasource) {
+		return fmt.Errorf("unknown datasource %s", grant.Datasource)
+	}
+	if grant.NotBefore != nil && grant.Expires != nil && !grant.Expires.After(*grant.NotBefore) {
+		return fmt.Errorf("label %s of %s expires before it becomes valid", grant.Label, grant.Subject)
+	}
+	return nil
+}
+
+func toUnix(t *time.Time) sql.NullInt64 {
+	if t == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.Unix(), Valid: true}
+}
+
+func fromUnix(n sql.NullInt64) *time.Time {
+	if !n.Valid {
+		return nil
+	}
+	t := time.Unix(n.Int64, 0).UTC()
+	return &t
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
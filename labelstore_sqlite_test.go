@@ -0,0 +1,109 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestSQLiteHandler(t *testing.T) *SQLiteHandler {
+	s := &SQLiteHandler{}
+	err := s.Connect(App{Cfg: &Config{SQLite: SQLiteConfig{Path: filepath.Join(t.TempDir(), "labels.db")}}})
+	assert.NoError(t, err)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestGetLabelsSQLite(t *testing.T) {
+	s := newTestSQLiteHandler(t)
+	past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+	for _, grant := range []Grant{
+		{Subject: "user1", Label: "u1"},
+		{Subject: "group1", Label: "g1"},
+		{Subject: "group1", Label: "g1-logs", Datasource: DatasourceLogs},
+		{Subject: "^sre-.*", Label: "team-a-*"},
+		{Subject: "group1", Label: "expired", Expires: &past},
+		{Subject: "group1", Label: "upcoming", NotBefore: &future},
+		{Subject: "admins", Label: "#cluster-wide"},
+	} {
+		_, err := s.CreateGrant(grant)
+		assert.NoError(t, err)
+	}
+
+	labels, skip := s.GetLabels(OAuthToken{PreferredUsername: "user1", Groups: []string{"group1", "sre-oncall"}}, DatasourceMetrics)
+	assert.False(t, skip)
+	assert.Equal(t, []string{"g1", "u1", "team-a-.*"}, labels.Strings())
+
+	labels, _ = s.GetLabels(OAuthToken{PreferredUsername: "user2", Groups: []string{"group1"}}, DatasourceLogs)
+	assert.Equal(t, []string{"g1", "g1-logs"}, labels.Strings())
+
+	_, skip = s.GetLabels(OAuthToken{PreferredUsername: "user2", Groups: []string{"admins"}}, DatasourceLogs)
+	assert.True(t, skip)
+
+	expiring := s.ExpiringGrants(24 * time.Hour)
+	assert.Empty(t, expiring)
+}
+
+func TestGrantsSQLite(t *testing.T) {
+	s := newTestSQLiteHandler(t)
+
+	grant, err := s.CreateGrant(Grant{Subject: "group1", Label: "payments"})
+	assert.NoError(t, err)
+	assert.NotZero(t, grant.ID)
+
+	_, err = s.CreateGrant(Grant{Subject: "group1", Label: "payments"})
+	assert.Error(t, err, "duplicate grant")
+	_, err = s.CreateGrant(Grant{Subject: "group1", Label: "^a-("})
+	assert.Error(t, err)
+	_, err = s.CreateGrant(Grant{Subject: "group1", Label: "a", Datasource: "events"})
+	assert.Error(t, err)
+
+	expires := time.Now().Add(time.Hour).Truncate(time.Second).UTC()
+	grant.Expires = &expires
+	grant.Label = "billing"
+	assert.NoError(t, s.UpdateGrant(grant))
+	assert.ErrorIs(t, s.UpdateGrant(Grant{ID: 42, Subject: "a", Label: "b"}), errGrantNotFound)
+
+	grants, err := s.ListGrants("group1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Grant{grant}, grants)
+	assert.Len(t, s.ExpiringGrants(2*time.Hour), 1)
+
+	assert.NoError(t, s.DeleteGrant(grant.ID))
+	assert.ErrorIs(t, s.DeleteGrant(grant.ID), errGrantNotFound)
+	grants, err = s.ListGrants("")
+	assert.NoError(t, err)
+	assert.Empty(t, grants)
+}
+
+func TestImportExportSQLite(t *testing.T) {
+	s := newTestSQLiteHandler(t)
+	_, err := s.CreateGrant(Grant{Subject: "replaced", Label: "old"})
+	assert.NoError(t, err)
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	raw := map[string]map[string]any{
+		"group1": {
+			"shared": true,
+			"#logs": map[string]any{
+				"payments": map[string]any{"expires": expires},
+			},
+		},
+		"^sre-.*": {"team-a-*": true},
+	}
+	assert.NoError(t, s.ImportLabels(raw))
+
+	exported, err := s.ExportLabels()
+	assert.NoError(t, err)
+	assert.Equal(t, raw, exported)
+
+	labels, _ := s.GetLabels(OAuthToken{PreferredUsername: "user", Groups: []string{"sre-oncall"}}, DatasourceMetrics)
+	assert.Equal(t, []string{"team-a-.*"}, labels.Strings())
+
+	assert.Error(t, s.ImportLabels(map[string]map[string]any{"group1": {"#unknown": map[string]any{"a": true}}}))
+	exported, err = s.ExportLabels()
+	assert.NoError(t, err)
+	assert.Equal(t, raw, exported, "failed import keeps the grants")
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -75,9 +79,326 @@ func TestGetLabelsCM(t *testing.T) {
 
 	for _, tc := range cases {
 		t.Run(tc.name, func(t *testing.T) {
-			labels, skip := cmh.GetLabels(OAuthToken{PreferredUsername: tc.username, Groups: tc.groups})
-			assert.Equal(t, tc.expected, labels)
+			labels, skip := cmh.GetLabels(OAuthToken{PreferredUsername: tc.username, Groups: tc.groups}, DatasourceMetrics)
+			assert.Equal(t, tc.expected, labels.Values)
 			assert.Equal(t, tc.skip, skip)
 		})
 	}
 }
+
+func TestGetLabelsCMPatterns(t *testing.T) {
+	cmh := ConfigMapHandler{}
+	err := cmh.setLabels(map[string]map[string]bool{
+		"user1":      {"u1": true},
+		"^sre-.*":    {"team-a-*": true},
+		"ops-*":      {"#cluster-wide": true},
+		"group1":     {"^(dev|prod)-shop$": true},
+		"^admins?$":  {"admin": true},
+		"unrelated*": {"unrelated": true},
+	}, nil)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		name     string
+		username string
+		groups   []string
+		allowed  []string
+		denied   []string
+		skip     bool
+	}{
+		{
+			name:     "Group pattern",
+			username: "user1",
+			groups:   []string{"sre-oncall"},
+			allowed:  []string{"u1", "team-a-frontend"},
+			denied:   []string{"team-b-frontend"},
+		},
+		{
+			name:     "Value regex",
+			username: "user2",
+			groups:   []string{"group1"},
+			allowed:  []string{"dev-shop", "prod-shop"},
+			denied:   []string{"test-shop"},
+		},
+		{
+			name:     "Username pattern",
+			username: "admin",
+			allowed:  []string{"admin"},
+			denied:   []string{"u1"},
+		},
+		{
+			name:     "Cluster-wide glob",
+			username: "user2",
+			groups:   []string{"ops-team"},
+			skip:     true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels, skip := cmh.GetLabels(OAuthToken{PreferredUsername: tc.username, Groups: tc.groups}, DatasourceMetrics)
+			assert.Equal(t, tc.skip, skip)
+			for _, value := range tc.allowed {
+				assert.True(t, labels.Allowed(value), value)
+			}
+			for _, value := range tc.denied {
+				assert.False(t, labels.Allowed(value), value)
+			}
+		})
+	}
+
+	assert.Error(t, cmh.setLabels(map[string]map[string]bool{"^sre-(": {"a": true}}, nil))
+	assert.Error(t, cmh.setLabels(map[string]map[string]bool{"group": {"^a-(": true}}, nil))
+}
+
+func TestGetLabelsCMDatasources(t *testing.T) {
+	labels, scoped, _, err := parseLabels(map[string]map[string]any{
+		"group1": {
+			"shared": true,
+			"#metrics": map[string]any{
+				"payments": true,
+			},
+			"#logs": map[string]any{
+				"payments-logs": true,
+			},
+		},
+		"group2": {
+			"#traces": map[string]any{
+				"#cluster-wide": true,
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	cmh := ConfigMapHandler{}
+	assert.NoError(t, cmh.setLabels(labels, scoped))
+
+	cases := []struct {
+		name       string
+		groups     []string
+		datasource Datasource
+		expected   map[string]bool
+		skip       bool
+	}{
+		{
+			name:       "Metrics",
+			groups:     []string{"group1"},
+			datasource: DatasourceMetrics,
+			expected:   map[string]bool{"shared": true, "payments": true},
+		},
+		{
+			name:       "Logs",
+			groups:     []string{"group1"},
+			datasource: DatasourceLogs,
+			expected:   map[string]bool{"shared": true, "payments-logs": true},
+		},
+		{
+			name:       "Unscoped only",
+			groups:     []string{"group1"},
+			datasource: DatasourceTraces,
+			expected:   map[string]bool{"shared": true},
+		},
+		{
+			name:       "Cluster-wide for one datasource",
+			groups:     []string{"group2"},
+			datasource: DatasourceTraces,
+			skip:       true,
+		},
+		{
+			name:       "Cluster-wide not granted for other datasource",
+			groups:     []string{"group2"},
+			datasource: DatasourceMetrics,
+			expected:   map[string]bool{},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			labels, skip := cmh.GetLabels(OAuthToken{PreferredUsername: "user", Groups: tc.groups}, tc.datasource)
+			assert.Equal(t, tc.skip, skip)
+			assert.Equal(t, tc.expected, labels.Values)
+		})
+	}
+
+	_, _, _, err = parseLabels(map[string]map[string]any{"group": {"#unknown": map[string]any{"a": true}}})
+	assert.Error(t, err)
+	_, _, _, err = parseLabels(map[string]map[string]any{"group": {"a": "yes"}})
+	assert.Error(t, err)
+}
+
+func TestGetLabelsCMExclusions(t *testing.T) {
+	cmh := ConfigMapHandler{}
+	assert.NoError(t, cmh.setLabels(map[string]map[string]bool{
+		"operators": {"#cluster-wide": true, "!vault": true, "!kube-*": true},
+		"devs":      {"payments": true, "vault": true},
+		"auditors":  {"!vault": true},
+	}, nil))
+
+	labels, skip := cmh.GetLabels(OAuthToken{PreferredUsername: "user", Groups: []string{"operators"}}, DatasourceMetrics)
+	assert.False(t, skip)
+	assert.True(t, labels.ClusterWide)
+	assert.Equal(t, []string{"#cluster-wide", "!vault", "!kube-.*"}, labels.Strings())
+
+	labels, skip = cmh.GetLabels(OAuthToken{PreferredUsername: "user", Groups: []string{"devs", "auditors"}}, DatasourceMetrics)
+	assert.False(t, skip)
+	assert.True(t, labels.Allowed("payments"))
+	assert.False(t, labels.Allowed("vault"))
+
+	assert.Error(t, cmh.setLabels(map[string]map[string]bool{"group": {"!!vault": true}}, nil))
+}
+
+func TestGetLabelsCMTimeBounded(t *testing.T) {
+	now := time.Now()
+	labels, scoped, periods, err := parseLabels(map[string]map[string]any{
+		"contractor": {
+			"payments": map[string]any{"expires": now.Add(time.Hour)},
+			"billing":  map[string]any{"expires": now.Add(-time.Hour).Format(time.RFC3339)},
+			"shop":     map[string]any{"not_before": now.Add(time.Hour)},
+			"#logs": map[string]any{
+				"payments-audit": map[string]any{"not_before": now.Add(-time.Hour), "expires": now.Add(time.Hour)},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, periods, 4)
+
+	cmh := ConfigMapHandler{}
+	assert.NoError(t, cmh.setLabels(labels, scoped))
+	cmh.periods = periods
+
+	token := OAuthToken{PreferredUsername: "contractor"}
+	tenantLabels, _ := cmh.GetLabels(token, DatasourceMetrics)
+	assert.Equal(t, map[string]bool{"payments": true}, tenantLabels.Values)
+	tenantLabels, _ = cmh.GetLabels(token, DatasourceLogs)
+	assert.Equal(t, map[string]bool{"payments": true, "payments-audit": true}, tenantLabels.Values)
+
+	cmh.reportExpired(now)
+	_, reported := cmh.expired.Load(grantKey{Subject: "contractor", Label: "billing"})
+	assert.True(t, reported)
+	_, reported = cmh.expired.Load(grantKey{Subject: "contractor", Label: "payments"})
+	assert.False(t, reported)
+
+	for _, invalid := range []map[string]any{
+		{"expires": "tomorrow"},
+		{"until": now},
+		{"not_before": now, "expires": now.Add(-time.Hour)},
+	} {
+		_, _, _, err = parseLabels(map[string]map[string]any{"contractor": {"payments": invalid}})
+		assert.Error(t, err)
+	}
+}
+
+func TestGetLabelsCMNamespaceSelectors(t *testing.T) {
+	informer, _ := newTestNamespaceInformer(t, map[string]map[string]string{
+		"payments":     {"team": "payments"},
+		"payments-dev": {"team": "payments"},
+		"vault":        {"team": "payments", "sensitive": "true"},
+	})
+	cmh := ConfigMapHandler{namespaces: informer}
+	assert.NoError(t, cmh.setLabels(map[string]map[string]bool{
+		"payments-devs": {"#namespaces team=payments": true, "!#namespaces sensitive=true": true},
+	}, nil))
+
+	labels, skip := cmh.GetLabels(OAuthToken{PreferredUsername: "user", Groups: []string{"payments-devs"}}, DatasourceMetrics)
+	assert.False(t, skip)
+	assert.True(t, labels.Allowed("payments"))
+	assert.True(t, labels.Allowed("payments-dev"))
+	assert.False(t, labels.Allowed("vault"))
+
+	assert.Error(t, (&ConfigMapHandler{}).setLabels(map[string]map[string]bool{"group": {"#namespaces team=payments": true}}, nil))
+}
+
+func TestGetLabelsCMTenants(t *testing.T) {
+	raw := map[string]map[string]any{
+		tenantsKey: {
+			"acme":          map[string]any{"children": []any{"team-payments", "team-shop"}},
+			"team-payments": map[string]any{"labels": []any{"payments", "payments-dev"}},
+			"team-shop":     map[string]any{"labels": []any{"shop"}},
+		},
+		"acme-admins":    {"#tenant acme": true, "!#tenant team-shop": true},
+		"payments-devs":  {"#metrics": map[string]any{"#tenant team-payments": true}},
+		"shop-and-other": {"#tenant team-shop": true, "other": true},
+	}
+	tenants, err := parseTenants(raw, nil)
+	assert.NoError(t, err)
+	labels, scoped, _, err := parseLabels(raw)
+	assert.NoError(t, err)
+	assert.NotContains(t, labels, tenantsKey)
+	assert.NoError(t, tenants.validateGrants(labels, scoped))
+
+	cmh := ConfigMapHandler{tenants: tenants}
+	assert.NoError(t, cmh.setLabels(labels, scoped))
+
+	cases := []struct {
+		group      string
+		datasource Datasource
+		expected   []string
+	}{
+		{group: "acme-admins", datasource: DatasourceLogs, expected: []string{"payments", "payments-dev", "shop", "!shop"}},
+		{group: "payments-devs", datasource: DatasourceMetrics, expected: []string{"payments", "payments-dev"}},
+		{group: "payments-devs", datasource: DatasourceLogs, expected: []string{}},
+		{group: "shop-and-other", datasource: DatasourceLogs, expected: []string{"other", "shop"}},
+	}
+	for _, tc := range cases {
+		labels, _ := cmh.GetLabels(OAuthToken{PreferredUsername: "user", Groups: []string{tc.group}}, tc.datasource)
+		assert.Equal(t, tc.expected, labels.Strings(), tc.group)
+	}
+}
+
+func newTestConfigMapHandler(t *testing.T, content string) (*ConfigMapHandler, string) {
+	path := filepath.Join(t.TempDir(), "labels.yaml")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	v := viper.NewWithOptions(viper.KeyDelimiter("::"))
+	v.SetConfigFile(path)
+	return &ConfigMapHandler{v: v}, path
+}
+
+func TestReloadCM(t *testing.T) {
+	cmh, path := newTestConfigMapHandler(t, "group1:\n  payments: true\n")
+	version, err := cmh.Reload()
+	assert.NoError(t, err)
+	assert.Len(t, version.Hash, 64)
+	assert.Equal(t, version, cmh.Version())
+
+	token := OAuthToken{PreferredUsername: "user", Groups: []string{"group1"}}
+	labels, _ := cmh.GetLabels(token, DatasourceMetrics)
+	assert.Equal(t, []string{"payments"}, labels.Strings())
+
+	for _, invalid := range []string{
+		"group1:\n  payments: [",
+		"group1:\n  '^a-(': true\n",
+		"group1:\n  '#tenant unknown': true\n",
+	} {
+		assert.NoError(t, os.WriteFile(path, []byte(invalid), 0o600))
+		_, err = cmh.Reload()
+		assert.Error(t, err, invalid)
+		labels, _ = cmh.GetLabels(token, DatasourceMetrics)
+		assert.Equal(t, []string{"payments"}, labels.Strings(), "previous labels are kept")
+		assert.Equal(t, version, cmh.Version())
+	}
+
+	assert.NoError(t, os.WriteFile(path, []byte("group1:\n  billing: true\n"), 0o600))
+	reloaded, err := cmh.Reload()
+	assert.NoError(t, err)
+	assert.NotEqual(t, version.Hash, reloaded.Hash)
+	labels, _ = cmh.GetLabels(token, DatasourceMetrics)
+	assert.Equal(t, []string{"billing"}, labels.Strings(), "removed labels are not merged")
+}
+
+func TestEffectiveGrantsCM(t *testing.T) {
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	cmh := &ConfigMapHandler{}
+	assert.NoError(t, cmh.load(map[string]map[string]any{
+		tenantsKey: {"team": map[string]any{"labels": []any{"payments", "billing"}}},
+		"group1":   {"#tenant team": true, "#logs": map[string]any{"audit": map[string]any{"expires": expires}}},
+		"^sre-.*":  {"shared": true},
+	}, []byte("content")))
+
+	grants := cmh.EffectiveGrants(OAuthToken{PreferredUsername: "sre-bob", Groups: []string{"group1"}}, DatasourceLogs)
+	assert.Equal(t, []EffectiveGrant{
+		{Label: "shared", Subject: "^sre-.*"},
+		{Label: "billing", Subject: "group1", Source: "#tenant team"},
+		{Label: "payments", Subject: "group1", Source: "#tenant team"},
+		{Label: "audit", Subject: "group1", Datasource: DatasourceLogs, Expires: &expires},
+	}, grants)
+}
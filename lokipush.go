@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushBodyLimit is the maximum size of a push request body, compressed and
+// decompressed.
+const pushBodyLimit = 64 << 20
+
+// pushStreamError is the error of a rejected stream of a push request.
+type pushStreamError struct {
+	stream int
+	labels string
+	err    error
+}
+
+func (e pushStreamError) Error() string {
+	return fmt.Sprintf("stream %d %s: %v", e.stream, e.labels, e.err)
+}
+
+// pushHandler returns the handler of the Loki push endpoint. The tenant label
+// of every stream has to be allowed for the user, streams without tenant
+// label get it injected if the Loki config enables it and the user has a
+// single tenant. Rejected streams are removed from the request, the other
+// streams are pushed to the upstream serving their tenants. If streams were
+// rejected, the per-stream errors are returned with status 400 once the
+// others have been pushed, or with status 403 if no stream remains.
+func pushHandler(a *App) func(http.ResponseWriter, *http.Request) {
+	upstreams := a.lokiUpstreams()
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthToken, tenantLabels, skip, ok := authorizeRequest(w, r, DatasourceLogs, a)
+		if !ok {
+			return
+		}
+		r, enforce, ok := applyTenancy(w, r, DatasourceLogs, tenantLabels, skip, a)
+		if !ok {
+			return
+		}
+		if !enforce {
+			target, err := upstreams.single(upstreams.routeUser(tenantLabels, skip, a.Cfg.Loki.TenantLabel, oauthToken.Groups), a.Cfg.Loki.TenantLabel)
+			if err != nil {
+				logAndWriteError(w, http.StatusBadRequest, err, "")
+				return
+			}
+			target.streamUp(w, r, a)
+			return
+		}
+
+		body, err := readPushBody(w, r)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		enforcer := pushEnforcer{
+			tenantLabels: tenantLabels,
+			tenantLabel:  a.Cfg.Loki.TenantLabel,
+			inject:       a.Cfg.Loki.PushInjectTenantLabel,
+		}
+		var rejected []pushStreamError
+		var tenants []string
+		if mediaType(r.Header.Get("Content-Type")) == "application/json" {
+			body, tenants, rejected, err = enforcer.enforceJSON(body)
+		} else {
+			body, tenants, rejected, err = enforcer.enforceProtobuf(body)
+		}
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		target, err := upstreams.single(upstreams.targets(tenants, oauthToken.Groups), a.Cfg.Loki.TenantLabel)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		errs := make([]error, 0, len(rejected))
+		for _, e := range rejected {
+			errs = append(errs, e)
+		}
+		r.Header.Del("Content-Encoding")
+		pushUp(w, r, target, a, body, len(tenants), errs)
+	}
+}
+
+// pushUp forwards a write request with the enforced body to the upstream.
+// Kept is the number of remaining streams or series and errs are the errors
+// of the rejected ones. If nothing remains, the errors are returned with
+// status 403 and nothing is forwarded. Otherwise, the errors are returned
+// with status 400 once the upstream accepted the remaining ones, so clients
+// do not retry the request.
+func pushUp(w http.ResponseWriter, r *http.Request, up upstream, a *App, body []byte, kept int, errs []error) {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	if kept == 0 && len(errs) > 0 {
+		logAndWriteError(w, http.StatusForbidden, fmt.Errorf("%s", strings.Join(messages, "\n")), "")
+		return
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	setHeaders(r, up.tls, up.headers, a.ServiceAccountToken)
+	proxy := up.reverseProxy()
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if len(errs) == 0 || resp.StatusCode/100 != 2 {
+			return nil
+		}
+		// the remaining streams or series were written, report the rejected ones
+		_ = resp.Body.Close()
+		message := strings.Join(messages, "\n") + "\n"
+		resp.StatusCode = http.StatusBadRequest
+		resp.Status = http.StatusText(http.StatusBadRequest)
+		resp.Body = io.NopCloser(strings.NewReader(message))
+		resp.ContentLength = int64(len(message))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(message)))
+		resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+		return nil
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// readPushBody reads the body of a push request. Gzip compressed JSON is
+// decompressed, snappy compressed protobuf is decompressed by the enforcer.
+func readPushBody(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, pushBodyLimit)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		reader = io.LimitReader(gz, pushBodyLimit+1)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > pushBodyLimit {
+		return nil, fmt.Errorf("push request exceeds %d bytes", pushBodyLimit)
+	}
+	return body, nil
+}
+
+// mediaType returns the media type of a Content-Type header without its
+// parameters.
+func mediaType(contentType string) string {
+	mt, _, _ := strings.Cut(contentType, ";")
+	return strings.TrimSpace(strings.ToLower(mt))
+}
+
+// pushEnforcer enforces the tenant label of the streams and series of push
+// and remote write requests.
+type pushEnforcer struct {
+	tenantLabels TenantLabels
+	tenantLabel  string
+	inject       bool
+}
+
+// enforceLabelSet checks the labels of a stream or series and injects the tenant label if
+// it is missing and injection is enabled.
+func (p pushEnforcer) enforceLabelSet(set map[string]string) error {
+	if _, ok := set[p.tenantLabel]; !ok {
+		value, ok := p.injectedValue()
+		if !ok {
+			return fmt.Errorf("missing %s label", p.tenantLabel)
+		}
+		set[p.tenantLabel] = value
+	}
+	if !p.tenantLabels.AllowsLabelSet(set, p.tenantLabel) {
+		return unauthorizedLabelError(set[p.tenantLabel])
+	}
+	return nil
+}
+
+// injectedValue returns the tenant label value to inject into streams
+// without tenant label. Only users with a single literal tenant label value
+// get it injected.
+func (p pushEnforcer) injectedValue() (string, bool) {
+	t := p.tenantLabels
+	if !p.inject || t.ClusterWide || len(t.Values) != 1 || len(t.Patterns) > 0 || len(t.Tuples) > 0 {
+		return "", false
+	}
+	for value := range t.Values {
+		return value, true
+	}
+	return "", false
+}
+
+// enforceJSON enforces a push request in JSON format. It returns the request
+// with the allowed streams, their tenant label values and the errors of the
+// rejected ones.
+func (p pushEnforcer) enforceJSON(body []byte) ([]byte, []string, []pushStreamError, error) {
+	var request struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values json.RawMessage   `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid push request: %w", err)
+	}
+	var rejected []pushStreamError
+	var tenants []string
+	streams := request.Streams[:0]
+	for i, stream := range request.Streams {
+		if stream.Stream == nil {
+			stream.Stream = make(map[string]string)
+		}
+		if err := p.enforceLabelSet(stream.Stream); err != nil {
+			rejected = append(rejected, pushStreamError{stream: i, labels: labels.FromMap(stream.Stream).String(), err: err})
+			continue
+		}
+		streams = append(streams, stream)
+		tenants = append(tenants, stream.Stream[p.tenantLabel])
+	}
+	request.Streams = streams
+	body, err := json.Marshal(request)
+	return body, tenants, rejected, err
+}
+
+// enforceProtobuf enforces a snappy compressed push request in protobuf
+// format. Only the labels of the streams are decoded, the entries are kept
+// as they are. It returns the request with the allowed streams, their tenant
+// label values and the errors of the rejected ones.
+func (p pushEnforcer) enforceProtobuf(body []byte) ([]byte, []string, []pushStreamError, error) {
+	if n, err := snappy.DecodedLen(body); err != nil || n > pushBodyLimit {
+		return nil, nil, nil, fmt.Errorf("invalid push request: snappy block of %d bytes: %v", n, err)
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid push request: %w", err)
+	}
+
+	var out []byte
+	var rejected []pushStreamError
+	var tenants []string
+	for i := 0; len(decoded) > 0; {
+		num, typ, n := protowire.ConsumeTag(decoded)
+		if n < 0 {
+			return nil, nil, nil, fmt.Errorf("invalid push request: %w", protowire.ParseError(n))
+		}
+		value, m := consumeFieldValue(num, typ, decoded[n:])
+		if m < 0 {
+			return nil, nil, nil, fmt.Errorf("invalid push request: %w", protowire.ParseError(m))
+		}
+		field := decoded[:n+m]
+		decoded = decoded[n+m:]
+
+		// PushRequest.streams = 1
+		if num != 1 || typ != protowire.BytesType {
+			out = append(out, field...)
+			continue
+		}
+		stream, set, err := p.enforceProtobufStream(value)
+		if err != nil {
+			selector := "{}"
+			if set != nil {
+				selector = labels.FromMap(set).String()
+			}
+			rejected = append(rejected, pushStreamError{stream: i, labels: selector, err: err})
+			i++
+			continue
+		}
+		out = protowire.AppendTag(out, 1, protowire.BytesType)
+		out = protowire.AppendBytes(out, stream)
+		tenants = append(tenants, set[p.tenantLabel])
+		i++
+	}
+	return snappy.Encode(nil, out), tenants, rejected, nil
+}
+
+// enforceProtobufStream enforces a stream of a push request in protobuf
+// format and returns it with the enforced labels and its label set.
+func (p pushEnforcer) enforceProtobufStream(stream []byte) ([]byte, map[string]string, error) {
+	var out []byte
+	set := make(map[string]string)
+	seen := false
+	for len(stream) > 0 {
+		num, typ, n := protowire.ConsumeTag(stream)
+		if n < 0 {
+			return nil, nil, protowire.ParseError(n)
+		}
+		value, m := consumeFieldValue(num, typ, stream[n:])
+		if m < 0 {
+			return nil, nil, protowire.ParseError(m)
+		}
+		field := stream[:n+m]
+		stream = stream[n+m:]
+
+		// StreamAdapter.labels = 1, the hash = 3 is recalculated by Loki
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			matchers, err := parser.ParseMetricSelector(string(value))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid labels %s: %w", value, err)
+			}
+			for _, matcher := range matchers {
+				set[matcher.Name] = matcher.Value
+			}
+			seen = true
+		case num == 3:
+		default:
+			out = append(out, field...)
+		}
+	}
+	if !seen {
+		return nil, nil, fmt.Errorf("stream has no labels")
+	}
+	if err := p.enforceLabelSet(set); err != nil {
+		return nil, set, err
+	}
+	out = protowire.AppendTag(out, 1, protowire.BytesType)
+	out = protowire.AppendString(out, labels.FromMap(set).String())
+	return out, set, nil
+}
+
+// consumeFieldValue consumes the value of a protobuf field and returns the
+// content of length-delimited values and the length of the value.
+func consumeFieldValue(num protowire.Number, typ protowire.Type, b []byte) ([]byte, int) {
+	if typ == protowire.BytesType {
+		value, n := protowire.ConsumeBytes(b)
+		return value, n
+	}
+	return nil, protowire.ConsumeFieldValue(num, typ, b)
+}
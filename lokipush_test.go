@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufPushRequest encodes a snappy compressed push request with a stream
+// with a single entry for every label selector.
+func protobufPushRequest(selectors ...string) []byte {
+	var request []byte
+	for _, selector := range selectors {
+		var entry []byte
+		entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+		entry = protowire.AppendString(entry, "line")
+		var stream []byte
+		stream = protowire.AppendTag(stream, 1, protowire.BytesType)
+		stream = protowire.AppendString(stream, selector)
+		stream = protowire.AppendTag(stream, 2, protowire.BytesType)
+		stream = protowire.AppendBytes(stream, entry)
+		stream = protowire.AppendTag(stream, 3, protowire.VarintType)
+		stream = protowire.AppendVarint(stream, 42)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, stream)
+	}
+	return snappy.Encode(nil, request)
+}
+
+// protobufPushSelectors decodes the label selectors of the streams of a
+// snappy compressed push request.
+func protobufPushSelectors(t *testing.T, body []byte) []string {
+	decoded, err := snappy.Decode(nil, body)
+	assert.NoError(t, err)
+	var selectors []string
+	for len(decoded) > 0 {
+		_, _, n := protowire.ConsumeTag(decoded)
+		stream, m := protowire.ConsumeBytes(decoded[n:])
+		decoded = decoded[n+m:]
+		for len(stream) > 0 {
+			num, typ, n := protowire.ConsumeTag(stream)
+			m := protowire.ConsumeFieldValue(num, typ, stream[n:])
+			if num == 1 {
+				value, _ := protowire.ConsumeString(stream[n:])
+				selectors = append(selectors, value)
+			}
+			assert.NotEqual(t, protowire.Number(3), num, "stream hash is removed")
+			stream = stream[n+m:]
+		}
+	}
+	return selectors
+}
+
+func TestPushEnforcerJSON(t *testing.T) {
+	body := `{"streams":[
+		{"stream":{"namespace":"payments","app":"api"},"values":[["1700000000000000000","line"]]},
+		{"stream":{"namespace":"billing"},"values":[["1700000000000000000","line"]]},
+		{"stream":{"app":"web"},"values":[["1700000000000000000","line",{"trace_id":"abc"}]]}
+	]}`
+
+	t.Run("Reject", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace"}
+		enforced, tenants, rejected, err := p.enforceJSON([]byte(body))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments"}, tenants)
+		assert.JSONEq(t, `{"streams":[{"stream":{"namespace":"payments","app":"api"},"values":[["1700000000000000000","line"]]}]}`, string(enforced))
+		assert.Len(t, rejected, 2)
+		assert.Equal(t, `stream 1 {namespace="billing"}: user not allowed with tenant label billing`, rejected[0].Error())
+		assert.Equal(t, `stream 2 {app="web"}: missing namespace label`, rejected[1].Error())
+	})
+
+	t.Run("Inject", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace", inject: true}
+		enforced, tenants, rejected, err := p.enforceJSON([]byte(body))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments", "payments"}, tenants)
+		assert.Len(t, rejected, 1)
+		var request struct {
+			Streams []struct {
+				Stream map[string]string `json:"stream"`
+				Values json.RawMessage   `json:"values"`
+			} `json:"streams"`
+		}
+		assert.NoError(t, json.Unmarshal(enforced, &request))
+		assert.Equal(t, map[string]string{"app": "web", "namespace": "payments"}, request.Streams[1].Stream)
+		assert.JSONEq(t, `[["1700000000000000000","line",{"trace_id":"abc"}]]`, string(request.Streams[1].Values))
+	})
+
+	t.Run("No injection for multiple tenants", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments", "billing"), tenantLabel: "namespace", inject: true}
+		_, tenants, rejected, err := p.enforceJSON([]byte(body))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments", "billing"}, tenants)
+		assert.Len(t, rejected, 1)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace"}
+		_, _, _, err := p.enforceJSON([]byte(`{"streams":{}}`))
+		assert.Error(t, err)
+	})
+}
+
+func TestPushEnforcerProtobuf(t *testing.T) {
+	p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace", inject: true}
+	body := protobufPushRequest(`{app="api", namespace="payments"}`, `{namespace="billing"}`, `{app="web"}`)
+	enforced, tenants, rejected, err := p.enforceProtobuf(body)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments", "payments"}, tenants)
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, 1, rejected[0].stream)
+	assert.Equal(t, []string{`{app="api", namespace="payments"}`, `{app="web", namespace="payments"}`}, protobufPushSelectors(t, enforced))
+
+	_, _, _, err = p.enforceProtobuf([]byte("not snappy"))
+	assert.Error(t, err)
+}
+
+func TestPushHandler(t *testing.T) {
+	app, tokens := setupTestMain()
+	var pushed string
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		pushed = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer loki.Close()
+	app.Cfg.Loki.URL = loki.URL
+	app.Cfg.Loki.TenantLabel = "tenant_id"
+	app.WithRoutes()
+
+	serve := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/loki/api/v1/push", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set("Content-Type", "application/json")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(`{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[["1","line"]]}]}`)
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.JSONEq(t, `{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[["1","line"]]}]}`, pushed)
+
+	pushed = ""
+	rr = serve(`{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[["1","line"]]},{"stream":{"tenant_id":"other"},"values":[["1","line"]]}]}`)
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `stream 1 {tenant_id="other"}`)
+	assert.JSONEq(t, `{"streams":[{"stream":{"tenant_id":"allowed_user"},"values":[["1","line"]]}]}`, pushed)
+
+	pushed = ""
+	rr = serve(`{"streams":[{"stream":{"tenant_id":"other"},"values":[["1","line"]]}]}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Empty(t, pushed)
+}
@@ -23,6 +23,7 @@ type App struct {
 	TlS                 *tls.Config
 	ServiceAccountToken string
 	LabelStore          Labelstore
+	Namespaces          *NamespaceInformer
 	i                   *mux.Router
 	e                   *mux.Router
 	healthy             bool
@@ -44,8 +45,10 @@ func main() {
 		WithSAT().
 		WithTLSConfig().
 		WithJWKS().
+		WithNamespaceInformer().
 		WithLabelStore().
 		WithHealthz().
+		WithAdmin().
 		WithRoutes().
 		StartServer()
 
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// otlpResourceError is the error of a rejected resource of an OTLP request.
+type otlpResourceError struct {
+	resource  int
+	attribute string
+	value     string
+	err       error
+}
+
+func (e otlpResourceError) Error() string {
+	return fmt.Sprintf("resource %d %s=%q: %v", e.resource, e.attribute, e.value, e.err)
+}
+
+// otlpSignal describes the layout of the export requests of a signal: the
+// JSON field of the resources and the paths from a resource to the attributes
+// nested in it, as JSON fields and as protobuf field numbers.
+type otlpSignal struct {
+	field         string
+	jsonPaths     [][]string
+	protobufPaths [][]protowire.Number
+}
+
+var (
+	// otlpLogs is the layout of logs export requests, the scope and log
+	// record attributes are nested in the resources.
+	otlpLogs = otlpSignal{
+		field: "resourceLogs",
+		jsonPaths: [][]string{
+			{"scopeLogs", "scope", "attributes"},
+			{"scopeLogs", "logRecords", "attributes"},
+		},
+		// ResourceLogs.scope_logs = 2, ScopeLogs.scope = 1, InstrumentationScope.attributes = 3,
+		// ScopeLogs.log_records = 2, LogRecord.attributes = 6
+		protobufPaths: [][]protowire.Number{{2, 1, 3}, {2, 2, 6}},
+	}
+	// otlpMetrics is the layout of metrics export requests, the scope and
+	// data point attributes are nested in the resources.
+	otlpMetrics = otlpSignal{
+		field: "resourceMetrics",
+		jsonPaths: [][]string{
+			{"scopeMetrics", "scope", "attributes"},
+			{"scopeMetrics", "metrics", "gauge", "dataPoints", "attributes"},
+			{"scopeMetrics", "metrics", "sum", "dataPoints", "attributes"},
+			{"scopeMetrics", "metrics", "histogram", "dataPoints", "attributes"},
+			{"scopeMetrics", "metrics", "exponentialHistogram", "dataPoints", "attributes"},
+			{"scopeMetrics", "metrics", "summary", "dataPoints", "attributes"},
+		},
+		// ResourceMetrics.scope_metrics = 2, ScopeMetrics.scope = 1, InstrumentationScope.attributes = 3,
+		// ScopeMetrics.metrics = 2, Metric.gauge = 5, sum = 7, histogram = 9, exponential_histogram = 10
+		// and summary = 11, their data_points = 1 and the attributes of their data points = 7, 7, 9, 1 and 7
+		protobufPaths: [][]protowire.Number{
+			{2, 1, 3},
+			{2, 2, 5, 1, 7},
+			{2, 2, 7, 1, 7},
+			{2, 2, 9, 1, 9},
+			{2, 2, 10, 1, 1},
+			{2, 2, 11, 1, 7},
+		},
+	}
+)
+
+// WithOTLP configures and adds the OTLP/HTTP ingestion routes for logs (/otlp/v1/logs,
+// forwarded to Loki) and metrics (/otlp/v1/metrics, forwarded to the Thanos URL, e.g.
+// Mimir) to the App's router if the tenant attribute of the OTLP config and the
+// respective datasource are configured, and returns the updated App.
+func (a *App) WithOTLP() *App {
+	if a.Cfg.OTLP.TenantAttribute == "" {
+		log.Debug().Msg("OTLP tenant attribute not set, skipping OTLP routes")
+		return a
+	}
+	if a.Cfg.Loki.URL != "" {
+		a.e.HandleFunc("/otlp/v1/logs", otlpHandler(otlpLogs, DatasourceLogs, a.Cfg.Loki.TenantLabel,
+			a.lokiUpstreams(), a)).Methods(http.MethodPost).Name("/otlp/v1/logs")
+	}
+	if a.Cfg.Thanos.URL != "" {
+		a.e.HandleFunc("/otlp/v1/metrics", otlpHandler(otlpMetrics, DatasourceMetrics, a.Cfg.Thanos.TenantLabel,
+			a.thanosUpstreams(), a)).Methods(http.MethodPost).Name("/otlp/v1/metrics")
+	}
+	return a
+}
+
+// otlpHandler returns the handler of an OTLP/HTTP ingestion route accepting
+// protobuf and JSON encoded export requests. The tenant attribute of every
+// resource, and of the scopes, log records and data points nested in it, is
+// checked against the grants of the user as value of the tenant label.
+// Requests with unauthorized resources are rejected with one error per
+// resource, or, if the OTLP config strips them, forwarded without them.
+// Requests without any authorized resource are always rejected. Requests are
+// forwarded to the upstream serving the tenants of their resources.
+func otlpHandler(signal otlpSignal, datasource Datasource, tl string, upstreams *upstreamRouter, a *App) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthToken, tenantLabels, skip, ok := authorizeRequest(w, r, datasource, a)
+		if !ok {
+			return
+		}
+		r, enforce, ok := applyTenancy(w, r, datasource, tenantLabels, skip, a)
+		if !ok {
+			return
+		}
+		if !enforce {
+			target, err := upstreams.single(upstreams.routeUser(tenantLabels, skip, tl, oauthToken.Groups), tl)
+			if err != nil {
+				logAndWriteError(w, http.StatusBadRequest, err, "")
+				return
+			}
+			target.streamUp(w, r, a)
+			return
+		}
+
+		body, err := readPushBody(w, r)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		allowed := func(value string) error {
+			if !tenantLabels.AllowsLabelSet(map[string]string{tl: value}, tl) {
+				return unauthorizedLabelError(value)
+			}
+			return nil
+		}
+		var tenants []string
+		var rejected []otlpResourceError
+		if mediaType(r.Header.Get("Content-Type")) == "application/json" {
+			body, tenants, rejected, err = enforceOTLPJSON(body, signal, a.Cfg.OTLP.TenantAttribute, allowed)
+		} else {
+			body, tenants, rejected, err = enforceOTLPProtobuf(body, signal, a.Cfg.OTLP.TenantAttribute, allowed)
+		}
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+
+		errs := make([]error, 0, len(rejected))
+		for _, e := range rejected {
+			errs = append(errs, e)
+		}
+		if len(errs) > 0 && (!a.Cfg.OTLP.StripUnauthorized || len(tenants) == 0) {
+			// nothing is forwarded without kept resources
+			pushUp(w, r, upstreams.fallback, a, body, 0, errs)
+			return
+		}
+		target, err := upstreams.single(upstreams.targets(tenants, oauthToken.Groups), tl)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		if len(errs) > 0 {
+			log.Warn().Int("stripped", len(errs)).Errs("errors", errs).Msg("Stripped unauthorized OTLP resources")
+		}
+		r.Header.Del("Content-Encoding")
+		pushUp(w, r, target, a, body, len(tenants), nil)
+	}
+}
+
+// enforceOTLPJSON enforces a JSON encoded OTLP export request of a signal.
+// Fields may be given in lowerCamelCase or, like protobuf fields, in
+// snake_case, they are converted to lowerCamelCase first so none escapes the
+// enforcement. It returns the request with the authorized resources, the
+// tenant attribute values of their resources and the errors of the others.
+func enforceOTLPJSON(body []byte, signal otlpSignal, attribute string, allowed func(string) error) ([]byte, []string, []otlpResourceError, error) {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var decoded any
+	if err := decoder.Decode(&decoded); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid OTLP request: %w", err)
+	}
+	decoded, err := camelCaseFields(decoded)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid OTLP request: %w", err)
+	}
+	request, ok := decoded.(map[string]any)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("invalid OTLP request: no object")
+	}
+	resources, ok := request[signal.field].([]any)
+	if !ok && request[signal.field] != nil {
+		return nil, nil, nil, fmt.Errorf("invalid OTLP request: %s is no list", signal.field)
+	}
+
+	var rejected []otlpResourceError
+	var tenants []string
+	kept := make([]any, 0, len(resources))
+	for i, resource := range resources {
+		var nested []string
+		for _, path := range signal.jsonPaths {
+			nested = append(nested, jsonAttributes(resource, path, attribute)...)
+		}
+		values := resourceValues(jsonAttributes(resource, []string{"resource", "attributes"}, attribute), nested)
+		if value, err := allowedValues(values, allowed); err != nil {
+			rejected = append(rejected, otlpResourceError{resource: i, attribute: attribute, value: value, err: err})
+			continue
+		}
+		kept = append(kept, resource)
+		tenants = append(tenants, values...)
+	}
+	request[signal.field] = kept
+	body, err = json.Marshal(request)
+	return body, tenants, rejected, err
+}
+
+// camelCaseFields converts the snake_case fields of the objects of a decoded
+// JSON value to lowerCamelCase, e.g. resource_logs to resourceLogs. OTLP JSON
+// has no maps, every object field is a protobuf field. A field given in both
+// cases is an error.
+func camelCaseFields(value any) (any, error) {
+	switch v := value.(type) {
+	case map[string]any:
+		fields := make(map[string]any, len(v))
+		for key, field := range v {
+			field, err := camelCaseFields(field)
+			if err != nil {
+				return nil, err
+			}
+			name := lowerCamelCase(key)
+			if _, ok := fields[name]; ok {
+				return nil, fmt.Errorf("duplicate field %s", name)
+			}
+			fields[name] = field
+		}
+		return fields, nil
+	case []any:
+		for i, item := range v {
+			item, err := camelCaseFields(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+	}
+	return value, nil
+}
+
+// lowerCamelCase converts a snake_case name to lowerCamelCase like the JSON
+// names of protobuf fields.
+func lowerCamelCase(name string) string {
+	if !strings.Contains(name, "_") {
+		return name
+	}
+	var b strings.Builder
+	upper := false
+	for _, c := range name {
+		switch {
+		case c == '_':
+			upper = true
+		case upper:
+			b.WriteRune(unicode.ToUpper(c))
+			upper = false
+		default:
+			b.WriteRune(c)
+		}
+	}
+	return b.String()
+}
+
+// enforceOTLPProtobuf enforces a protobuf encoded OTLP export request of a
+// signal. The resources are in field 1 of the request and the resource is in
+// field 1 of each of them. Only the attributes are decoded, everything else
+// is kept as it is. It returns the request with the authorized resources,
+// the tenant attribute values of their resources and the errors of the
+// others.
+func enforceOTLPProtobuf(body []byte, signal otlpSignal, attribute string, allowed func(string) error) ([]byte, []string, []otlpResourceError, error) {
+	var out []byte
+	var rejected []otlpResourceError
+	var tenants []string
+	for i := 0; len(body) > 0; {
+		num, typ, n := protowire.ConsumeTag(body)
+		if n < 0 {
+			return nil, nil, nil, fmt.Errorf("invalid OTLP request: %w", protowire.ParseError(n))
+		}
+		value, m := consumeFieldValue(num, typ, body[n:])
+		if m < 0 {
+			return nil, nil, nil, fmt.Errorf("invalid OTLP request: %w", protowire.ParseError(m))
+		}
+		field := body[:n+m]
+		body = body[n+m:]
+		if num != 1 || typ != protowire.BytesType {
+			out = append(out, field...)
+			continue
+		}
+
+		// ResourceLogs.resource = 1, ResourceMetrics.resource = 1, Resource.attributes = 1
+		values, err := protobufAttributes(value, []protowire.Number{1, 1}, attribute)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid OTLP request: %w", err)
+		}
+		var nested []string
+		for _, path := range signal.protobufPaths {
+			pathValues, err := protobufAttributes(value, path, attribute)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid OTLP request: %w", err)
+			}
+			nested = append(nested, pathValues...)
+		}
+		values = resourceValues(values, nested)
+		if tenant, err := allowedValues(values, allowed); err != nil {
+			rejected = append(rejected, otlpResourceError{resource: i, attribute: attribute, value: tenant, err: err})
+		} else {
+			out = append(out, field...)
+			tenants = append(tenants, values...)
+		}
+		i++
+	}
+	return out, tenants, rejected, nil
+}
+
+// resourceValues returns the values of the tenant attribute of a resource
+// and of the scopes, log records and data points nested in it. A resource
+// without the attribute has an empty value.
+func resourceValues(values, nested []string) []string {
+	if len(values) == 0 {
+		values = []string{""}
+	}
+	return append(values, nested...)
+}
+
+// allowedValues checks the values of the tenant attribute of a resource and
+// returns the first value that is not allowed with its error. An attribute
+// given more than once has to be allowed for every value.
+func allowedValues(values []string, allowed func(string) error) (string, error) {
+	for _, value := range values {
+		if err := allowed(value); err != nil {
+			return value, err
+		}
+	}
+	return "", nil
+}
+
+// jsonAttributes returns the values of an attribute of the attribute lists
+// at the end of a path of fields of a decoded JSON value. Lists on the path
+// are descended into item by item. Values that are no strings are returned
+// as empty strings.
+func jsonAttributes(item any, path []string, attribute string) []string {
+	if items, ok := item.([]any); ok && len(path) > 0 {
+		var values []string
+		for _, item := range items {
+			values = append(values, jsonAttributes(item, path, attribute)...)
+		}
+		return values
+	}
+	if len(path) > 0 {
+		fields, _ := item.(map[string]any)
+		return jsonAttributes(fields[path[0]], path[1:], attribute)
+	}
+	attributes, _ := item.([]any)
+	var values []string
+	for _, kv := range attributes {
+		kv, _ := kv.(map[string]any)
+		if kv["key"] != attribute {
+			continue
+		}
+		value, _ := kv["value"].(map[string]any)
+		s, _ := value["stringValue"].(string)
+		values = append(values, s)
+	}
+	return values
+}
+
+// protobufAttributes returns the values of an attribute of the attribute
+// lists at the end of a path of field numbers of a protobuf message. Values
+// that are no strings are returned as empty strings.
+func protobufAttributes(message []byte, path []protowire.Number, attribute string) ([]string, error) {
+	fields, err := protobufFields(message, path[0])
+	if err != nil {
+		return nil, err
+	}
+	var values []string
+	if len(path) > 1 {
+		for _, field := range fields {
+			fieldValues, err := protobufAttributes(field, path[1:], attribute)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, fieldValues...)
+		}
+		return values, nil
+	}
+	for _, kv := range fields {
+		// KeyValue.key = 1, KeyValue.value = 2
+		keys, err := protobufFields(kv, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) == 0 || string(keys[len(keys)-1]) != attribute {
+			continue
+		}
+		anyValues, err := protobufFields(kv, 2)
+		if err != nil {
+			return nil, err
+		}
+		value := ""
+		for _, anyValue := range anyValues {
+			// AnyValue.string_value = 1
+			stringValues, err := protobufFields(anyValue, 1)
+			if err != nil {
+				return nil, err
+			}
+			if len(stringValues) > 0 {
+				value = string(stringValues[len(stringValues)-1])
+			}
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// protobufFields returns the values of the length-delimited fields with the
+// given number of a protobuf message.
+func protobufFields(message []byte, number protowire.Number) ([][]byte, error) {
+	var values [][]byte
+	for len(message) > 0 {
+		num, typ, n := protowire.ConsumeTag(message)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		value, m := consumeFieldValue(num, typ, message[n:])
+		if m < 0 {
+			return nil, protowire.ParseError(m)
+		}
+		message = message[n+m:]
+		if num == number && typ == protowire.BytesType {
+			values = append(values, value)
+		}
+	}
+	return values, nil
+}
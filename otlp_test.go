@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// protobufOTLPRequest encodes an OTLP export request with a resource for every
+// value of the k8s.namespace.name attribute, each with an empty scope.
+func protobufOTLPRequest(namespaces ...string) []byte {
+	var request []byte
+	for _, namespace := range namespaces {
+		var value []byte
+		value = protowire.AppendTag(value, 1, protowire.BytesType)
+		value = protowire.AppendString(value, namespace)
+		var kv []byte
+		kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+		kv = protowire.AppendString(kv, "k8s.namespace.name")
+		kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+		kv = protowire.AppendBytes(kv, value)
+		var resource []byte
+		resource = protowire.AppendTag(resource, 1, protowire.BytesType)
+		resource = protowire.AppendBytes(resource, kv)
+		var resourceLogs []byte
+		resourceLogs = protowire.AppendTag(resourceLogs, 1, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, resource)
+		resourceLogs = protowire.AppendTag(resourceLogs, 2, protowire.BytesType)
+		resourceLogs = protowire.AppendBytes(resourceLogs, nil)
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, resourceLogs)
+	}
+	return request
+}
+
+func otlpAllowed(values ...string) func(string) error {
+	return func(value string) error {
+		for _, v := range values {
+			if v == value {
+				return nil
+			}
+		}
+		return unauthorizedLabelError(value)
+	}
+}
+
+func TestEnforceOTLPJSON(t *testing.T) {
+	body := `{"resourceLogs":[
+		{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeLogs":[{"logRecords":[{"timeUnixNano":"1700000000000000000"}]}]},
+		{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"billing"}}]},"scopeLogs":[]},
+		{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"api"}}]},"scopeLogs":[]},
+		{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}},{"key":"k8s.namespace.name","value":{"stringValue":"billing"}}]}}
+	]}`
+
+	enforced, tenants, rejected, err := enforceOTLPJSON([]byte(body), otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments"}, tenants)
+	assert.JSONEq(t, `{"resourceLogs":[{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeLogs":[{"logRecords":[{"timeUnixNano":"1700000000000000000"}]}]}]}`, string(enforced))
+	assert.Len(t, rejected, 3)
+	assert.Equal(t, `resource 1 k8s.namespace.name="billing": user not allowed with tenant label billing`, rejected[0].Error())
+	assert.Equal(t, 2, rejected[1].resource)
+	assert.Equal(t, "", rejected[1].value)
+	assert.Equal(t, "billing", rejected[2].value)
+
+	_, _, _, err = enforceOTLPJSON([]byte(`{"resourceLogs":{}}`), otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+	assert.Error(t, err)
+
+	t.Run("SnakeCase", func(t *testing.T) {
+		body := `{"resource_logs":[
+			{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"string_value":"billing"}}]},"scope_logs":[]},
+			{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"string_value":"payments"}}]},"scope_logs":[]}
+		]}`
+		enforced, tenants, rejected, err := enforceOTLPJSON([]byte(body), otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments"}, tenants)
+		assert.JSONEq(t, `{"resourceLogs":[{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeLogs":[]}]}`, string(enforced))
+		assert.Len(t, rejected, 1)
+		assert.Equal(t, "billing", rejected[0].value)
+
+		_, _, _, err = enforceOTLPJSON([]byte(`{"resourceLogs":[],"resource_logs":[]}`), otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+		assert.Error(t, err)
+	})
+
+	t.Run("Nested", func(t *testing.T) {
+		body := `{"resourceMetrics":[
+			{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeMetrics":[{"metrics":[{"sum":{"dataPoints":[{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"billing"}}]}]}}]}]},
+			{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeMetrics":[{"scope":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]}}]}
+		]}`
+		_, tenants, rejected, err := enforceOTLPJSON([]byte(body), otlpMetrics, "k8s.namespace.name", otlpAllowed("payments"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments", "payments"}, tenants)
+		assert.Len(t, rejected, 1)
+		assert.Equal(t, 0, rejected[0].resource)
+		assert.Equal(t, "billing", rejected[0].value)
+
+		logs := `{"resourceLogs":[{"resource":{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"payments"}}]},"scopeLogs":[{"logRecords":[{"attributes":[{"key":"k8s.namespace.name","value":{"stringValue":"billing"}}]}]}]}]}`
+		_, tenants, _, err = enforceOTLPJSON([]byte(logs), otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+		assert.NoError(t, err)
+		assert.Empty(t, tenants)
+	})
+}
+
+func TestEnforceOTLPProtobuf(t *testing.T) {
+	enforced, tenants, rejected, err := enforceOTLPProtobuf(protobufOTLPRequest("payments", "billing", "payments"), otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments", "payments"}, tenants)
+	assert.Equal(t, protobufOTLPRequest("payments", "payments"), enforced)
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, 1, rejected[0].resource)
+	assert.Equal(t, "billing", rejected[0].value)
+
+	_, _, _, err = enforceOTLPProtobuf([]byte{0x0a, 0xff}, otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+	assert.Error(t, err)
+
+	t.Run("Nested", func(t *testing.T) {
+		// a log record of another tenant in the scope logs of the first resource
+		record := protobufKeyValue(6, "k8s.namespace.name", "billing")
+		var scopeLogs []byte
+		scopeLogs = protowire.AppendTag(scopeLogs, 2, protowire.BytesType)
+		scopeLogs = protowire.AppendBytes(scopeLogs, record)
+		request := protobufOTLPRequest("payments", "payments")
+		resourceLogs, n := protowire.ConsumeBytes(request[1:])
+		nested := protowire.AppendTag(append([]byte(nil), resourceLogs...), 2, protowire.BytesType)
+		nested = protowire.AppendBytes(nested, scopeLogs)
+		var body []byte
+		body = protowire.AppendTag(body, 1, protowire.BytesType)
+		body = protowire.AppendBytes(body, nested)
+		body = append(body, request[1+n:]...)
+
+		enforced, tenants, rejected, err := enforceOTLPProtobuf(body, otlpLogs, "k8s.namespace.name", otlpAllowed("payments"))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments"}, tenants)
+		assert.Equal(t, protobufOTLPRequest("payments"), enforced)
+		assert.Len(t, rejected, 1)
+		assert.Equal(t, 0, rejected[0].resource)
+		assert.Equal(t, "billing", rejected[0].value)
+	})
+}
+
+// protobufKeyValue encodes a message with a string attribute in the given
+// field.
+func protobufKeyValue(field protowire.Number, key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	kv = protowire.AppendTag(kv, 2, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, anyValue)
+	var message []byte
+	message = protowire.AppendTag(message, field, protowire.BytesType)
+	return protowire.AppendBytes(message, kv)
+}
+
+func TestOTLPHandler(t *testing.T) {
+	app, tokens := setupTestMain()
+	var pushed []byte
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/otlp/v1/logs", r.URL.Path)
+		pushed, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer loki.Close()
+	app.Cfg.Loki.URL = loki.URL
+	app.Cfg.Loki.TenantLabel = "tenant_id"
+	app.Cfg.OTLP.TenantAttribute = "k8s.namespace.name"
+	app.WithRoutes()
+
+	serve := func(body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/otlp/v1/logs", strings.NewReader(string(body)))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(protobufOTLPRequest("allowed_user"))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, protobufOTLPRequest("allowed_user"), pushed)
+
+	t.Run("Reject", func(t *testing.T) {
+		pushed = nil
+		rr := serve(protobufOTLPRequest("allowed_user", "other"))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Contains(t, rr.Body.String(), `resource 1 k8s.namespace.name="other"`)
+		assert.Nil(t, pushed)
+	})
+
+	t.Run("Strip", func(t *testing.T) {
+		app.Cfg.OTLP.StripUnauthorized = true
+		defer func() { app.Cfg.OTLP.StripUnauthorized = false }()
+
+		pushed = nil
+		rr := serve(protobufOTLPRequest("allowed_user", "other"))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, protobufOTLPRequest("allowed_user"), pushed)
+
+		pushed = nil
+		rr = serve(protobufOTLPRequest("other"))
+		assert.Equal(t, http.StatusForbidden, rr.Code)
+		assert.Nil(t, pushed)
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// remoteReadHandler returns the handler of the remote read route. The matchers
+// of every query of the snappy compressed ReadRequest are restricted to the
+// tenant labels like a PromQL selector before it is forwarded. The response,
+// either sampled or streamed in chunks, is streamed back as it is, as it only
+// contains series matching the enforced matchers. The request is sent to the
+// upstream serving the tenants its queries select, responses of several
+// upstreams cannot be merged, so requests selecting tenants of several
+// upstreams are rejected.
+func remoteReadHandler(upstreams *upstreamRouter, a *App) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthToken, tenantLabels, skip, ok := authorizeRequest(w, r, DatasourceMetrics, a)
+		if !ok {
+			return
+		}
+		r, enforce, ok := applyTenancy(w, r, DatasourceMetrics, tenantLabels, skip, a)
+		if !ok {
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, pushBodyLimit))
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		if enforce {
+			body, err = enforceReadRequest(body, tenantLabels, a.Cfg.Thanos.TenantLabel)
+			if err != nil {
+				logAndWriteError(w, http.StatusForbidden, err, "")
+				return
+			}
+		}
+		request, err := decodeReadRequest(body)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		selectors := make([][]*labels.Matcher, 0, len(request.Queries))
+		for _, query := range request.Queries {
+			matchers, err := fromLabelMatchers(query.Matchers)
+			if err != nil {
+				logAndWriteError(w, http.StatusBadRequest, err, "")
+				return
+			}
+			selectors = append(selectors, matchers)
+		}
+		targets := upstreams.routeSelectors(selectors, a.Cfg.Thanos.TenantLabel, oauthToken.Groups)
+		if len(targets) > 1 {
+			logAndWriteError(w, http.StatusBadRequest, fmt.Errorf("remote read request selects tenants of %d upstreams, select the tenants of a single upstream with a matcher on %s", len(targets), a.Cfg.Thanos.TenantLabel), "")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		targets[0].streamUp(w, r, a)
+	}
+}
+
+// decodeReadRequest decodes a snappy compressed remote read request.
+func decodeReadRequest(body []byte) (prompb.ReadRequest, error) {
+	var request prompb.ReadRequest
+	if n, err := snappy.DecodedLen(body); err != nil || n > pushBodyLimit {
+		return request, fmt.Errorf("invalid remote read request: snappy block of %d bytes: %v", n, err)
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return request, fmt.Errorf("invalid remote read request: %w", err)
+	}
+	if err := request.Unmarshal(decoded); err != nil {
+		return request, fmt.Errorf("invalid remote read request: %w", err)
+	}
+	return request, nil
+}
+
+// enforceReadRequest restricts the matchers of every query of a snappy
+// compressed remote read request to the tenant labels.
+func enforceReadRequest(body []byte, tenantLabels TenantLabels, tenantLabel string) ([]byte, error) {
+	request, err := decodeReadRequest(body)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range request.Queries {
+		matchers, err := fromLabelMatchers(query.Matchers)
+		if err != nil {
+			return nil, err
+		}
+		matchers, err = tenantLabels.RestrictSelector(matchers, tenantLabel)
+		if err != nil {
+			return nil, err
+		}
+		query.Matchers = toLabelMatchers(matchers)
+	}
+
+	encoded, err := request.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	return snappy.Encode(nil, encoded), nil
+}
+
+// fromLabelMatchers converts the matchers of a remote read query.
+func fromLabelMatchers(matchers []*prompb.LabelMatcher) ([]*labels.Matcher, error) {
+	result := make([]*labels.Matcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		var matchType labels.MatchType
+		switch matcher.Type {
+		case prompb.LabelMatcher_EQ:
+			matchType = labels.MatchEqual
+		case prompb.LabelMatcher_NEQ:
+			matchType = labels.MatchNotEqual
+		case prompb.LabelMatcher_RE:
+			matchType = labels.MatchRegexp
+		case prompb.LabelMatcher_NRE:
+			matchType = labels.MatchNotRegexp
+		default:
+			return nil, fmt.Errorf("invalid matcher type %s", matcher.Type)
+		}
+		m, err := labels.NewMatcher(matchType, matcher.Name, matcher.Value)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+	return result, nil
+}
+
+// toLabelMatchers converts matchers to the matchers of a remote read query.
+func toLabelMatchers(matchers []*labels.Matcher) []*prompb.LabelMatcher {
+	result := make([]*prompb.LabelMatcher, 0, len(matchers))
+	for _, matcher := range matchers {
+		var matchType prompb.LabelMatcher_Type
+		switch matcher.Type {
+		case labels.MatchEqual:
+			matchType = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			matchType = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			matchType = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			matchType = prompb.LabelMatcher_NRE
+		}
+		result = append(result, &prompb.LabelMatcher{Type: matchType, Name: matcher.Name, Value: matcher.Value})
+	}
+	return result
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+// readRequest encodes a snappy compressed remote read request with a query
+// for every list of matchers.
+func readRequest(t *testing.T, queries ...[]*prompb.LabelMatcher) []byte {
+	request := prompb.ReadRequest{AcceptedResponseTypes: []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS}}
+	for _, matchers := range queries {
+		request.Queries = append(request.Queries, &prompb.Query{StartTimestampMs: 1, EndTimestampMs: 2, Matchers: matchers})
+	}
+	encoded, err := request.Marshal()
+	assert.NoError(t, err)
+	return snappy.Encode(nil, encoded)
+}
+
+// readRequestMatchers decodes the matchers of the queries of a snappy
+// compressed remote read request.
+func readRequestMatchers(t *testing.T, body []byte) [][]string {
+	decoded, err := snappy.Decode(nil, body)
+	assert.NoError(t, err)
+	var request prompb.ReadRequest
+	assert.NoError(t, request.Unmarshal(decoded))
+	assert.Equal(t, []prompb.ReadRequest_ResponseType{prompb.ReadRequest_STREAMED_XOR_CHUNKS}, request.AcceptedResponseTypes)
+	var queries [][]string
+	for _, query := range request.Queries {
+		matchers, err := fromLabelMatchers(query.Matchers)
+		assert.NoError(t, err)
+		var rendered []string
+		for _, matcher := range matchers {
+			rendered = append(rendered, matcher.String())
+		}
+		queries = append(queries, rendered)
+	}
+	return queries
+}
+
+func TestEnforceReadRequest(t *testing.T) {
+	up := &prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}
+	tests := []struct {
+		name         string
+		queries      [][]*prompb.LabelMatcher
+		tenantLabels TenantLabels
+		want         [][]string
+		wantErr      bool
+	}{
+		{
+			name:         "Inject tenant matcher",
+			queries:      [][]*prompb.LabelMatcher{{up}, {up, {Type: prompb.LabelMatcher_RE, Name: "namespace", Value: "pay.*"}}},
+			tenantLabels: NewTenantLabels("payments", "billing"),
+			want: [][]string{
+				{`__name__="up"`, `namespace=~"billing|payments"`},
+				{`__name__="up"`, `namespace="payments"`},
+			},
+		},
+		{
+			name:         "Forbidden tenant",
+			queries:      [][]*prompb.LabelMatcher{{up}, {up, {Type: prompb.LabelMatcher_EQ, Name: "namespace", Value: "shop"}}},
+			tenantLabels: NewTenantLabels("payments"),
+			wantErr:      true,
+		},
+		{
+			name:         "Cluster-wide with exclusion",
+			queries:      [][]*prompb.LabelMatcher{{up}},
+			tenantLabels: NewTenantLabels("#cluster-wide", "!vault"),
+			want:         [][]string{{`__name__="up"`, `namespace!="vault"`}},
+		},
+		{
+			name:         "Multiple tuple grants",
+			queries:      [][]*prompb.LabelMatcher{{up}},
+			tenantLabels: NewTenantLabels(`{cluster="eu", namespace="payments"}`, `{cluster="us", namespace="payments"}`),
+			wantErr:      true,
+		},
+		{
+			name:         "Single tuple grant",
+			queries:      [][]*prompb.LabelMatcher{{up, {Type: prompb.LabelMatcher_EQ, Name: "cluster", Value: "eu"}}},
+			tenantLabels: NewTenantLabels(`{cluster="eu", namespace="payments"}`, `{cluster="us", namespace="payments"}`),
+			want:         [][]string{{`__name__="up"`, `cluster="eu"`, `namespace="payments"`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enforced, err := enforceReadRequest(readRequest(t, tt.queries...), tt.tenantLabels, "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, readRequestMatchers(t, enforced))
+		})
+	}
+}
+
+func TestRemoteReadHandler(t *testing.T) {
+	app, tokens := setupTestMain()
+	var read []byte
+	var orgID string
+	prometheus := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, _ = io.ReadAll(r.Body)
+		orgID = r.Header.Get(orgIDHeader)
+		w.Header().Set("Content-Type", "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse")
+		for _, chunk := range []string{"first", "second"} {
+			_, _ = w.Write([]byte(chunk))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer prometheus.Close()
+	app.Cfg.Thanos.URL = prometheus.URL
+	app.Cfg.Thanos.TenantLabel = "tenant_id"
+	app.WithRoutes()
+
+	serve := func(body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set(orgIDHeader, "other")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(readRequest(t, []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/x-streamed-protobuf; proto=prometheus.ChunkedReadResponse", rr.Header().Get("Content-Type"))
+	assert.Equal(t, "firstsecond", rr.Body.String())
+	assert.Equal(t, [][]string{{`__name__="up"`, `tenant_id=~"allowed_user|also_allowed_user"`}}, readRequestMatchers(t, read))
+
+	read = nil
+	rr = serve(readRequest(t, []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "tenant_id", Value: "other"}}))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Nil(t, read)
+
+	// the tenancy mode applies, the org ID of the client is not forwarded
+	app.Cfg.Thanos.TenancyMode = TenancyModeOrgID
+	app.WithRoutes()
+	rr = serve(readRequest(t, []*prompb.LabelMatcher{{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"}}))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "allowed_user|also_allowed_user", orgID)
+	assert.Equal(t, [][]string{{`__name__="up"`}}, readRequestMatchers(t, read))
+}
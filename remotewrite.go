@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+var (
+	remoteWriteSeries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_remote_write_series_total",
+		Help: "Number of series received by remote write per tenant and result.",
+	}, []string{"tenant", "result"})
+	remoteWriteSamples = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "multena_remote_write_samples_total",
+		Help: "Number of samples, histogram samples and exemplars received by remote write per tenant and result.",
+	}, []string{"tenant", "result"})
+)
+
+// remoteWriteSeriesError is the error of a rejected series of a remote write
+// request.
+type remoteWriteSeriesError struct {
+	series int
+	labels string
+	err    error
+}
+
+func (e remoteWriteSeriesError) Error() string {
+	return fmt.Sprintf("series %d %s: %v", e.series, e.labels, e.err)
+}
+
+// WithRemoteWrite configures and adds the remote write routes of Thanos Receive
+// (/api/v1/receive) and Mimir (/api/v1/push) to the App's router if the Thanos URL
+// is set, and returns the updated App. Requests are forwarded to the remote write
+// URL of the upstream serving their tenants, which defaults to its URL.
+func (a *App) WithRemoteWrite() *App {
+	if a.Cfg.Thanos.URL == "" {
+		return a
+	}
+	upstreams := a.thanosRemoteWriteUpstreams()
+	for _, path := range []string{"/api/v1/receive", "/api/v1/push"} {
+		a.e.HandleFunc(path, remoteWriteHandler(upstreams, a)).Methods(http.MethodPost).Name(path)
+	}
+	return a
+}
+
+// remoteWriteHandler returns the handler of the remote write routes. The
+// tenant label of every series has to be allowed for the user, series
+// without tenant label get it injected if the Thanos config enables it and
+// the user has a single tenant. Rejected series are removed from the request
+// and reported like rejected streams of Loki pushes, see pushUp. Remote write
+// 2.0 requests cannot be enforced and are rejected with status 415.
+func remoteWriteHandler(upstreams *upstreamRouter, a *App) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := checkRemoteWriteVersion(r); err != nil {
+			logAndWriteError(w, http.StatusUnsupportedMediaType, err, "")
+			return
+		}
+		oauthToken, tenantLabels, skip, ok := authorizeRequest(w, r, DatasourceMetrics, a)
+		if !ok {
+			return
+		}
+		r, enforce, ok := applyTenancy(w, r, DatasourceMetrics, tenantLabels, skip, a)
+		if !ok {
+			return
+		}
+		if !enforce {
+			target, err := upstreams.single(upstreams.routeUser(tenantLabels, skip, a.Cfg.Thanos.TenantLabel, oauthToken.Groups), a.Cfg.Thanos.TenantLabel)
+			if err != nil {
+				logAndWriteError(w, http.StatusBadRequest, err, "")
+				return
+			}
+			target.streamUp(w, r, a)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, pushBodyLimit))
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		enforcer := pushEnforcer{
+			tenantLabels: tenantLabels,
+			tenantLabel:  a.Cfg.Thanos.TenantLabel,
+			inject:       a.Cfg.Thanos.RemoteWriteInjectTenantLabel,
+		}
+		body, tenants, rejected, err := enforcer.enforceWriteRequest(body)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		target, err := upstreams.single(upstreams.targets(tenants, oauthToken.Groups), a.Cfg.Thanos.TenantLabel)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		errs := make([]error, 0, len(rejected))
+		for _, e := range rejected {
+			errs = append(errs, e)
+		}
+		pushUp(w, r, target, a, body, len(tenants), errs)
+	}
+}
+
+// checkRemoteWriteVersion returns an error if the Content-Type or version
+// header of a remote write request is not remote write 1.0.
+func checkRemoteWriteVersion(r *http.Request) error {
+	if version := r.Header.Get("X-Prometheus-Remote-Write-Version"); version != "" && !strings.HasPrefix(version, "0.1.") {
+		return fmt.Errorf("unsupported remote write version %s", version)
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return nil
+	}
+	mt, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %s: %w", contentType, err)
+	}
+	if mt != "application/x-protobuf" {
+		return fmt.Errorf("unsupported content type %s", contentType)
+	}
+	if proto, ok := params["proto"]; ok && proto != "prometheus.WriteRequest" {
+		return fmt.Errorf("unsupported remote write message %s", proto)
+	}
+	return nil
+}
+
+// enforceWriteRequest enforces a snappy compressed remote write request. It
+// returns the request with the allowed series, their tenant label values and
+// the errors of the rejected ones, and counts the series and samples per
+// result and, if accepted, per checked or injected tenant label value.
+// Requests with fields unknown to remote write 1.0, e.g. remote write 2.0
+// requests, and requests without series or metadata are rejected, as they
+// would be forwarded without enforcement.
+func (p pushEnforcer) enforceWriteRequest(body []byte) ([]byte, []string, []remoteWriteSeriesError, error) {
+	if n, err := snappy.DecodedLen(body); err != nil || n > pushBodyLimit {
+		return nil, nil, nil, fmt.Errorf("invalid remote write request: snappy block of %d bytes: %v", n, err)
+	}
+	decoded, err := snappy.Decode(nil, body)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid remote write request: %w", err)
+	}
+	var request prompb.WriteRequest
+	if err := request.Unmarshal(decoded); err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid remote write request: %w", err)
+	}
+	if len(request.XXX_unrecognized) > 0 {
+		return nil, nil, nil, fmt.Errorf("invalid remote write request: unknown fields, only remote write 1.0 is supported")
+	}
+	if len(decoded) > 0 && len(request.Timeseries) == 0 && len(request.Metadata) == 0 {
+		return nil, nil, nil, fmt.Errorf("invalid remote write request: no series")
+	}
+
+	var rejected []remoteWriteSeriesError
+	var tenants []string
+	series := request.Timeseries[:0]
+	for i, ts := range request.Timeseries {
+		set := make(map[string]string, len(ts.Labels)+1)
+		var err error
+		if len(ts.XXX_unrecognized) > 0 {
+			err = fmt.Errorf("unknown fields, only remote write 1.0 is supported")
+		}
+		for _, label := range ts.Labels {
+			if _, ok := set[label.Name]; ok && err == nil {
+				err = fmt.Errorf("duplicate label %s", label.Name)
+			}
+			set[label.Name] = label.Value
+		}
+		if err == nil {
+			err = p.enforceLabelSet(set)
+		}
+		samples := float64(len(ts.Samples) + len(ts.Histograms) + len(ts.Exemplars))
+		if err != nil {
+			// the tenant label of rejected series is not checked, they are not counted per tenant
+			remoteWriteSeries.WithLabelValues("", "rejected").Inc()
+			remoteWriteSamples.WithLabelValues("", "rejected").Add(samples)
+			rejected = append(rejected, remoteWriteSeriesError{series: i, labels: labels.FromMap(set).String(), err: err})
+			continue
+		}
+		tenant := set[p.tenantLabel]
+		remoteWriteSeries.WithLabelValues(tenant, "accepted").Inc()
+		remoteWriteSamples.WithLabelValues(tenant, "accepted").Add(samples)
+		// the series is written with the checked labels, sorted as the tenant label may have been injected
+		ts.Labels = prompb.FromLabels(labels.FromMap(set), ts.Labels[:0])
+		series = append(series, ts)
+		tenants = append(tenants, set[p.tenantLabel])
+	}
+	request.Timeseries = series
+
+	encoded, err := request.Marshal()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return snappy.Encode(nil, encoded), tenants, rejected, nil
+}
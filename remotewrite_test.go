@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// writeRequest encodes a snappy compressed remote write request with a
+// series with a single sample for every label set.
+func writeRequest(t *testing.T, sets ...labels.Labels) []byte {
+	var request prompb.WriteRequest
+	for _, set := range sets {
+		request.Timeseries = append(request.Timeseries, prompb.TimeSeries{
+			Labels:  prompb.FromLabels(set, nil),
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}},
+		})
+	}
+	encoded, err := request.Marshal()
+	assert.NoError(t, err)
+	return snappy.Encode(nil, encoded)
+}
+
+// writeRequestLabels decodes the label sets of a snappy compressed remote
+// write request.
+func writeRequestLabels(t *testing.T, body []byte) []string {
+	decoded, err := snappy.Decode(nil, body)
+	assert.NoError(t, err)
+	var request prompb.WriteRequest
+	assert.NoError(t, request.Unmarshal(decoded))
+	var sets []string
+	for _, ts := range request.Timeseries {
+		assert.Len(t, ts.Samples, 1)
+		var builder labels.ScratchBuilder
+		for _, label := range ts.Labels {
+			builder.Add(label.Name, label.Value)
+		}
+		sets = append(sets, builder.Labels().String())
+	}
+	return sets
+}
+
+func TestEnforceWriteRequest(t *testing.T) {
+	body := writeRequest(t,
+		labels.FromStrings("__name__", "up", "namespace", "payments"),
+		labels.FromStrings("__name__", "up", "namespace", "billing"),
+		labels.FromStrings("__name__", "up", "job", "api"),
+	)
+
+	t.Run("Reject", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace"}
+		before := testutil.ToFloat64(remoteWriteSamples.WithLabelValues("payments", "accepted"))
+		rejectedBefore := testutil.ToFloat64(remoteWriteSeries.WithLabelValues("", "rejected"))
+		enforced, tenants, rejected, err := p.enforceWriteRequest(body)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments"}, tenants)
+		assert.Equal(t, []string{`{__name__="up", namespace="payments"}`}, writeRequestLabels(t, enforced))
+		assert.Len(t, rejected, 2)
+		assert.Equal(t, `series 1 {__name__="up", namespace="billing"}: user not allowed with tenant label billing`, rejected[0].Error())
+		assert.Equal(t, `series 2 {__name__="up", job="api"}: missing namespace label`, rejected[1].Error())
+		assert.Equal(t, before+1, testutil.ToFloat64(remoteWriteSamples.WithLabelValues("payments", "accepted")))
+		assert.Equal(t, rejectedBefore+2, testutil.ToFloat64(remoteWriteSeries.WithLabelValues("", "rejected")))
+	})
+
+	t.Run("Inject", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace", inject: true}
+		before := testutil.ToFloat64(remoteWriteSeries.WithLabelValues("payments", "accepted"))
+		enforced, tenants, rejected, err := p.enforceWriteRequest(body)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"payments", "payments"}, tenants)
+		assert.Len(t, rejected, 1)
+		assert.Equal(t, []string{
+			`{__name__="up", namespace="payments"}`,
+			`{__name__="up", job="api", namespace="payments"}`,
+		}, writeRequestLabels(t, enforced))
+		// the series with the injected tenant label is counted for its tenant
+		assert.Equal(t, before+2, testutil.ToFloat64(remoteWriteSeries.WithLabelValues("payments", "accepted")))
+	})
+
+	t.Run("DuplicateLabel", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace"}
+		request := prompb.WriteRequest{Timeseries: []prompb.TimeSeries{{
+			Labels:  []prompb.Label{{Name: "namespace", Value: "billing"}, {Name: "namespace", Value: "payments"}},
+			Samples: []prompb.Sample{{Value: 1, Timestamp: 1700000000000}},
+		}}}
+		encoded, err := request.Marshal()
+		assert.NoError(t, err)
+		_, tenants, rejected, err := p.enforceWriteRequest(snappy.Encode(nil, encoded))
+		assert.NoError(t, err)
+		assert.Empty(t, tenants)
+		assert.Len(t, rejected, 1)
+		assert.ErrorContains(t, rejected[0], "duplicate label namespace")
+	})
+
+	t.Run("UnknownFields", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace"}
+		// remote write 2.0 symbols = 4
+		v2 := protowire.AppendTag(nil, 4, protowire.BytesType)
+		v2 = protowire.AppendString(v2, "namespace")
+		_, _, _, err := p.enforceWriteRequest(snappy.Encode(nil, v2))
+		assert.ErrorContains(t, err, "unknown fields")
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		p := pushEnforcer{tenantLabels: NewTenantLabels("payments"), tenantLabel: "namespace"}
+		_, _, _, err := p.enforceWriteRequest(snappy.Encode(nil, []byte("not a write request")))
+		assert.Error(t, err)
+	})
+}
+
+func TestWithRemoteWrite(t *testing.T) {
+	app, tokens := setupTestMain()
+	var path string
+	var written []byte
+	receive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		written, _ = io.ReadAll(r.Body)
+	}))
+	defer receive.Close()
+	app.Cfg.Thanos.URL = "http://querier.invalid"
+	app.Cfg.Thanos.RemoteWriteURL = receive.URL
+	app.Cfg.Thanos.TenantLabel = "tenant_id"
+	app.WithRoutes()
+
+	serve := func(body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/receive", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(writeRequest(t, labels.FromStrings("__name__", "up", "tenant_id", "allowed_user")))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/api/v1/receive", path)
+	assert.Equal(t, []string{`{__name__="up", tenant_id="allowed_user"}`}, writeRequestLabels(t, written))
+
+	rr = serve(writeRequest(t, labels.FromStrings("__name__", "up", "tenant_id", "allowed_user"), labels.FromStrings("__name__", "up", "tenant_id", "other")))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+	assert.Contains(t, rr.Body.String(), `series 1 {__name__="up", tenant_id="other"}`)
+
+	written = nil
+	rr = serve(writeRequest(t, labels.FromStrings("__name__", "up", "tenant_id", "other")))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Nil(t, written)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/receive", bytes.NewReader(writeRequest(t)))
+	req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+	req.Header.Set("Content-Type", "application/x-protobuf;proto=io.prometheus.write.v2.Request")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "2.0.0")
+	rr = httptest.NewRecorder()
+	app.e.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+	assert.Nil(t, written)
+}
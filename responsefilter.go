@@ -0,0 +1,296 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// jsonFilterBatchSize is the maximum number of array elements passed to an
+// arrayFilter at once.
+const jsonFilterBatchSize = 100
+
+// elementFilter rewrites an element of a JSON array, returning nil drops the
+// element.
+type elementFilter func(element json.RawMessage) (json.RawMessage, error)
+
+// arrayFilter rewrites a batch of elements of a JSON array and returns the
+// elements to keep.
+type arrayFilter func(elements []json.RawMessage) ([]json.RawMessage, error)
+
+// eachElement returns an arrayFilter passing every element through filter.
+func eachElement(filter elementFilter) arrayFilter {
+	return func(elements []json.RawMessage) ([]json.RawMessage, error) {
+		kept := elements[:0]
+		for _, element := range elements {
+			element, err := filter(element)
+			if err != nil {
+				return nil, err
+			}
+			if element != nil {
+				kept = append(kept, element)
+			}
+		}
+		return kept, nil
+	}
+}
+
+// filterJSONArrays copies the JSON document read from r to w and passes the
+// elements of the arrays at the given dot separated paths, e.g. "data.groups",
+// through their filter in batches of at most jsonFilterBatchSize elements.
+// Only one batch is held in memory at a time, so large responses can be
+// streamed.
+func filterJSONArrays(r io.Reader, w io.Writer, filters map[string]arrayFilter) error {
+	return copyJSONValue(json.NewDecoder(r), w, "", filters)
+}
+
+// copyJSONValue copies the next JSON value of the decoder to w, descending
+// into objects on the way to a filtered array.
+func copyJSONValue(decoder *json.Decoder, w io.Writer, path string, filters map[string]arrayFilter) error {
+	filter, filtered := filters[path]
+	if !filtered && !hasFilteredPath(path, filters) {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return err
+		}
+		_, err := w.Write(value)
+		return err
+	}
+
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	switch {
+	case filtered && token == json.Delim('['):
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+		first := true
+		batch := make([]json.RawMessage, 0, jsonFilterBatchSize)
+		for more := decoder.More(); more || len(batch) > 0; more = decoder.More() {
+			if more {
+				var element json.RawMessage
+				if err := decoder.Decode(&element); err != nil {
+					return err
+				}
+				batch = append(batch, element)
+				if len(batch) < jsonFilterBatchSize {
+					continue
+				}
+			}
+			kept, err := filter(batch)
+			if err != nil {
+				return err
+			}
+			for _, element := range kept {
+				if !first {
+					if _, err := io.WriteString(w, ","); err != nil {
+						return err
+					}
+				}
+				first = false
+				if _, err := w.Write(element); err != nil {
+					return err
+				}
+			}
+			batch = batch[:0]
+		}
+	case !filtered && token == json.Delim('{'):
+		if _, err := io.WriteString(w, "{"); err != nil {
+			return err
+		}
+		for first := true; decoder.More(); first = false {
+			token, err := decoder.Token()
+			if err != nil {
+				return err
+			}
+			key, _ := token.(string)
+			encoded, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if !first {
+				encoded = append([]byte(","), encoded...)
+			}
+			if _, err := w.Write(append(encoded, ':')); err != nil {
+				return err
+			}
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			if err := copyJSONValue(decoder, w, child, filters); err != nil {
+				return err
+			}
+		}
+	case token == nil:
+		_, err := io.WriteString(w, "null")
+		return err
+	default:
+		return fmt.Errorf("unexpected %v at %s", token, path)
+	}
+
+	// closing delimiter of the array or object
+	token, err = decoder.Token()
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, token.(json.Delim).String())
+	return err
+}
+
+// hasFilteredPath reports whether a filtered array is nested in the value at
+// the path.
+func hasFilteredPath(path string, filters map[string]arrayFilter) bool {
+	for filtered := range filters {
+		if path == "" || strings.HasPrefix(filtered, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+// alertFilter keeps the alerts of a Prometheus alerts or rules response
+// whose labels the tenant labels allow.
+func alertFilter(tenantLabels TenantLabels, tenantLabel string) arrayFilter {
+	return eachElement(alertAllowed(tenantLabels, tenantLabel))
+}
+
+// alertAllowed keeps an alert if the tenant labels allow its labels.
+func alertAllowed(tenantLabels TenantLabels, tenantLabel string) elementFilter {
+	return func(element json.RawMessage) (json.RawMessage, error) {
+		var alert struct {
+			Labels map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(element, &alert); err != nil {
+			return nil, fmt.Errorf("invalid alert: %w", err)
+		}
+		if !tenantLabels.AllowsLabelSet(alert.Labels, tenantLabel) {
+			return nil, nil
+		}
+		return element, nil
+	}
+}
+
+// targetFilter keeps the targets of a Prometheus targets response whose
+// discovered labels, overridden by the labels of active targets after
+// relabeling, the tenant labels allow.
+func targetFilter(tenantLabels TenantLabels, tenantLabel string) arrayFilter {
+	return eachElement(func(element json.RawMessage) (json.RawMessage, error) {
+		var target struct {
+			DiscoveredLabels map[string]string `json:"discoveredLabels"`
+			Labels           map[string]string `json:"labels"`
+		}
+		if err := json.Unmarshal(element, &target); err != nil {
+			return nil, fmt.Errorf("invalid target: %w", err)
+		}
+		set := make(map[string]string, len(target.DiscoveredLabels)+len(target.Labels))
+		for name, value := range target.DiscoveredLabels {
+			set[name] = value
+		}
+		for name, value := range target.Labels {
+			set[name] = value
+		}
+		if !tenantLabels.AllowsLabelSet(set, tenantLabel) {
+			return nil, nil
+		}
+		return element, nil
+	})
+}
+
+// ruleGroupFilter keeps the rules of a Prometheus rule group that belong to
+// the tenant and drops groups without any of them. A rule belongs to the
+// tenant if its labels carry an allowed tenant label, or, without a tenant
+// label, if every selector of its query is confined to the tenant labels.
+// The alerts of alerting rules are filtered like the alerts endpoint.
+func ruleGroupFilter(tenantLabels TenantLabels, tenantLabel string) arrayFilter {
+	alerts := alertAllowed(tenantLabels, tenantLabel)
+	return eachElement(func(element json.RawMessage) (json.RawMessage, error) {
+		var group map[string]json.RawMessage
+		if err := json.Unmarshal(element, &group); err != nil {
+			return nil, fmt.Errorf("invalid rule group: %w", err)
+		}
+		var rules []json.RawMessage
+		if err := json.Unmarshal(group["rules"], &rules); err != nil {
+			return nil, fmt.Errorf("invalid rules: %w", err)
+		}
+
+		kept := make([]json.RawMessage, 0, len(rules))
+		for _, rule := range rules {
+			var fields map[string]json.RawMessage
+			var summary struct {
+				Query  string            `json:"query"`
+				Labels map[string]string `json:"labels"`
+				Alerts []json.RawMessage `json:"alerts"`
+			}
+			if err := json.Unmarshal(rule, &fields); err != nil {
+				return nil, fmt.Errorf("invalid rule: %w", err)
+			}
+			if err := json.Unmarshal(rule, &summary); err != nil {
+				return nil, fmt.Errorf("invalid rule: %w", err)
+			}
+			if _, ok := summary.Labels[tenantLabel]; ok {
+				if !tenantLabels.AllowsLabelSet(summary.Labels, tenantLabel) {
+					continue
+				}
+			} else if !queryConfined(summary.Query, tenantLabels, tenantLabel) {
+				continue
+			}
+
+			if _, ok := fields["alerts"]; ok {
+				allowed := make([]json.RawMessage, 0, len(summary.Alerts))
+				for _, alert := range summary.Alerts {
+					alert, err := alerts(alert)
+					if err != nil {
+						return nil, err
+					}
+					if alert != nil {
+						allowed = append(allowed, alert)
+					}
+				}
+				encoded, err := json.Marshal(allowed)
+				if err != nil {
+					return nil, err
+				}
+				fields["alerts"] = encoded
+				if rule, err = json.Marshal(fields); err != nil {
+					return nil, err
+				}
+			}
+			kept = append(kept, rule)
+		}
+		if len(kept) == 0 {
+			return nil, nil
+		}
+
+		encoded, err := json.Marshal(kept)
+		if err != nil {
+			return nil, err
+		}
+		group["rules"] = encoded
+		return json.Marshal(group)
+	})
+}
+
+// queryConfined reports whether the PromQL query has selectors and every one
+// of them is confined to the tenant labels.
+func queryConfined(query string, tenantLabels TenantLabels, tenantLabel string) bool {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return false
+	}
+	selectors := 0
+	confined := true
+	parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			selectors++
+			confined = confined && tenantLabels.Confines(vs.LabelMatchers, tenantLabel) == nil
+		}
+		return nil
+	})
+	return selectors > 0 && confined
+}
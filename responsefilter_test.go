@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterJSONArrays(t *testing.T) {
+	tenantLabels := NewTenantLabels("payments", "billing")
+	tests := []struct {
+		name    string
+		body    string
+		filters map[string]arrayFilter
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "Alerts",
+			body:    `{"status":"success","data":{"alerts":[{"labels":{"namespace":"payments"}},{"labels":{"namespace":"shop"}},{"labels":{"namespace":"billing"}}]}}`,
+			filters: map[string]arrayFilter{"data.alerts": alertFilter(tenantLabels, "namespace")},
+			want:    `{"status":"success","data":{"alerts":[{"labels":{"namespace":"payments"}},{"labels":{"namespace":"billing"}}]}}`,
+		},
+		{
+			name: "Targets",
+			body: `{"status":"success","data":{"activeTargets":[{"discoveredLabels":{"namespace":"shop"},"labels":{"namespace":"payments"}},{"discoveredLabels":{"namespace":"payments"},"labels":{"namespace":"shop"}}],"droppedTargets":[{"discoveredLabels":{"namespace":"billing"}},{"discoveredLabels":{"job":"node"}}]}}`,
+			filters: map[string]arrayFilter{
+				"data.activeTargets":  targetFilter(tenantLabels, "namespace"),
+				"data.droppedTargets": targetFilter(tenantLabels, "namespace"),
+			},
+			want: `{"status":"success","data":{"activeTargets":[{"discoveredLabels":{"namespace":"shop"},"labels":{"namespace":"payments"}}],"droppedTargets":[{"discoveredLabels":{"namespace":"billing"}}]}}`,
+		},
+		{
+			name:    "Missing data",
+			body:    `{"status":"error","errorType":"bad_data","data":null}`,
+			filters: map[string]arrayFilter{"data.alerts": alertFilter(tenantLabels, "namespace")},
+			want:    `{"status":"error","errorType":"bad_data","data":null}`,
+		},
+		{
+			name:    "Unexpected value",
+			body:    `{"data":{"alerts":{}}}`,
+			filters: map[string]arrayFilter{"data.alerts": alertFilter(tenantLabels, "namespace")},
+			wantErr: true,
+		},
+		{
+			name:    "Truncated",
+			body:    `{"data":{"alerts":[{"labels":{"namespace":"payments"}}`,
+			filters: map[string]arrayFilter{"data.alerts": alertFilter(tenantLabels, "namespace")},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := filterJSONArrays(strings.NewReader(tt.body), &out, tt.filters)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.want, out.String())
+		})
+	}
+}
+
+func TestRuleGroupFilter(t *testing.T) {
+	body := `{"status":"success","data":{"groups":[
+		{"name":"payments","file":"payments.yaml","rules":[
+			{"type":"alerting","name":"PaymentsDown","query":"up{namespace=\"payments\"} == 0","labels":{},"alerts":[{"labels":{"namespace":"payments"}}]},
+			{"type":"recording","name":"payments:requests:rate5m","query":"rate(http_requests_total{namespace=~\"payments|billing\"}[5m])","labels":{}}
+		]},
+		{"name":"cluster","file":"cluster.yaml","rules":[
+			{"type":"alerting","name":"TargetDown","query":"up == 0","labels":{},"alerts":[{"labels":{"namespace":"payments"}},{"labels":{"namespace":"shop"}}]},
+			{"type":"alerting","name":"ShopDown","query":"up == 0","labels":{"namespace":"shop"},"alerts":[]},
+			{"type":"alerting","name":"BillingDown","query":"up == 0","labels":{"namespace":"billing"},"alerts":[{"labels":{"namespace":"billing"}},{"labels":{"namespace":"shop"}}]},
+			{"type":"recording","name":"mixed","query":"up{namespace=\"payments\"} + up{namespace=\"shop\"}","labels":{}}
+		]},
+		{"name":"shop","file":"shop.yaml","rules":[
+			{"type":"recording","name":"shop:up","query":"up{namespace=\"shop\"}","labels":{}}
+		]}
+	]}}`
+	want := `{"status":"success","data":{"groups":[
+		{"name":"payments","file":"payments.yaml","rules":[
+			{"type":"alerting","name":"PaymentsDown","query":"up{namespace=\"payments\"} == 0","labels":{},"alerts":[{"labels":{"namespace":"payments"}}]},
+			{"type":"recording","name":"payments:requests:rate5m","query":"rate(http_requests_total{namespace=~\"payments|billing\"}[5m])","labels":{}}
+		]},
+		{"name":"cluster","file":"cluster.yaml","rules":[
+			{"type":"alerting","name":"BillingDown","query":"up == 0","labels":{"namespace":"billing"},"alerts":[{"labels":{"namespace":"billing"}}]}
+		]}
+	]}}`
+
+	var out bytes.Buffer
+	filters := map[string]arrayFilter{"data.groups": ruleGroupFilter(NewTenantLabels("payments", "billing"), "namespace")}
+	assert.NoError(t, filterJSONArrays(strings.NewReader(body), &out, filters))
+	assert.JSONEq(t, want, out.String())
+}
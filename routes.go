@@ -1,17 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"net/http/httputil"
 	"net/http/pprof"
 	"net/url"
+	"strconv"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/gorilla/mux"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/protobuf/encoding/protowire"
 )
 
 type Route struct {
@@ -48,6 +54,12 @@ func (a *App) WithRoutes() *App {
 	a.e = e
 	a.WithLoki()
 	a.WithThanos()
+	a.WithTempo()
+	a.WithPyroscope()
+	a.WithAlertmanager()
+	a.WithRuler()
+	a.WithRemoteWrite()
+	a.WithOTLP()
 	return a
 }
 
@@ -58,11 +70,13 @@ func (a *App) WithLoki() *App {
 		log.Warn().Msg("Loki URL not set, skipping Loki routes")
 		return a
 	}
+	if err := a.Cfg.Loki.TenancyMode.validate(); err != nil {
+		log.Fatal().Err(err).Msg("Error in Loki config")
+	}
 	routes := []Route{
 		{Url: "/api/v1/query", MatchWord: "query"},
 		{Url: "/api/v1/query_range", MatchWord: "query"},
 		{Url: "/api/v1/series", MatchWord: "match[]"},
-		{Url: "/api/v1/tail", MatchWord: "query"},
 		{Url: "/api/v1/index/stats", MatchWord: "query"},
 		{Url: "/api/v1/format_query", MatchWord: "query"},
 		{Url: "/api/v1/labels", MatchWord: "query"},
@@ -70,17 +84,27 @@ func (a *App) WithLoki() *App {
 		{Url: "/api/v1/query_exemplars", MatchWord: "query"},
 		{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
 	}
+	var filters func(*http.Request, TenantLabels, []string) map[string]arrayFilter
+	if a.Cfg.Loki.FilterLabelResponses {
+		filters = newLokiLabelVerifier(a).filters
+	}
+	upstreams := a.lokiUpstreams()
 	lokiRouter := a.e.PathPrefix("/loki").Subrouter()
 	for _, route := range routes {
 		log.Trace().Any("route", route).Msg("Loki route")
-		lokiRouter.HandleFunc(route.Url, handler(route.MatchWord,
+		var routeFilters func(*http.Request, TenantLabels, []string) map[string]arrayFilter
+		if isLabelRoute(route.Url) {
+			routeFilters = filters
+		}
+		lokiRouter.HandleFunc(route.Url, filteringHandler(route.MatchWord,
 			LogQLEnforcer(struct{}{}),
+			DatasourceLogs,
 			a.Cfg.Loki.TenantLabel,
-			a.Cfg.Loki.URL,
-			a.Cfg.Loki.UseMutualTLS,
-			a.Cfg.Loki.Headers,
-			a)).Name(route.Url)
+			upstreams,
+			a, routeFilters)).Name(route.Url)
 	}
+	lokiRouter.HandleFunc("/api/v1/push", pushHandler(a)).Methods(http.MethodPost).Name("/api/v1/push")
+	lokiRouter.HandleFunc("/api/v1/tail", tailHandler(a)).Methods(http.MethodGet).Name("/api/v1/tail")
 	return a
 }
 
@@ -91,6 +115,9 @@ func (a *App) WithThanos() *App {
 		log.Warn().Msg("Thanos URL not set, skipping Thanos routes")
 		return a
 	}
+	if err := a.Cfg.Thanos.TenancyMode.validate(); err != nil {
+		log.Fatal().Err(err).Msg("Error in Thanos config")
+	}
 	routes := []Route{
 		{Url: "/api/v1/query", MatchWord: "query"},
 		{Url: "/api/v1/query_range", MatchWord: "query"},
@@ -104,28 +131,260 @@ func (a *App) WithThanos() *App {
 		{Url: "/api/v1/status/buildinfo", MatchWord: "query"},
 		{Url: "/api/v1/metadata", MatchWord: "query"},
 	}
+	var filters func(*http.Request, TenantLabels, []string) map[string]arrayFilter
+	if a.Cfg.Thanos.FilterLabelResponses {
+		filters = newThanosLabelVerifier(a).filters
+	}
+	upstreams := a.thanosUpstreams()
 	thanosRouter := a.e.PathPrefix("").Subrouter()
 	for _, route := range routes {
 		log.Trace().Any("route", route).Msg("Thanos route")
+		var routeFilters func(*http.Request, TenantLabels, []string) map[string]arrayFilter
+		if isLabelRoute(route.Url) {
+			routeFilters = filters
+		}
 		thanosRouter.HandleFunc(route.Url,
-			handler(route.MatchWord,
+			filteringHandler(route.MatchWord,
 				PromQLEnforcer(struct{}{}),
+				DatasourceMetrics,
 				a.Cfg.Thanos.TenantLabel,
-				a.Cfg.Thanos.URL,
-				a.Cfg.Thanos.UseMutualTLS,
-				a.Cfg.Thanos.Headers,
-				a)).Name(route.Url)
+				upstreams,
+				a, routeFilters)).Name(route.Url)
 
 	}
+
+	filteredRoutes := map[string]func(TenantLabels, string) map[string]arrayFilter{
+		"/api/v1/rules": func(labels TenantLabels, tl string) map[string]arrayFilter {
+			return map[string]arrayFilter{"data.groups": ruleGroupFilter(labels, tl)}
+		},
+		"/api/v1/alerts": func(labels TenantLabels, tl string) map[string]arrayFilter {
+			return map[string]arrayFilter{"data.alerts": alertFilter(labels, tl)}
+		},
+		"/api/v1/targets": func(labels TenantLabels, tl string) map[string]arrayFilter {
+			return map[string]arrayFilter{
+				"data.activeTargets":  targetFilter(labels, tl),
+				"data.droppedTargets": targetFilter(labels, tl),
+			}
+		},
+	}
+	for path, filters := range filteredRoutes {
+		log.Trace().Str("route", path).Msg("Thanos filtered route")
+		thanosRouter.HandleFunc(path, filteredThanosHandler(filters, upstreams, a)).Methods(http.MethodGet).Name(path)
+	}
+	thanosRouter.HandleFunc("/api/v1/read", remoteReadHandler(upstreams, a)).Methods(http.MethodPost).Name("/api/v1/read")
 	return a
 }
 
+// isLabelRoute reports whether the route is a label names or label values
+// route, whose responses can be filtered with a labelVerifier.
+func isLabelRoute(route string) bool {
+	return route == "/api/v1/labels" || route == "/api/v1/label/{label}/values"
+}
+
+// filteredThanosHandler returns a handler for the Thanos endpoints that take
+// no query to enforce, like rules, alerts and targets. Instead, the response
+// is streamed through the element filters returned by filters, so only the
+// rules, alerts and targets of the allowed tenants are returned. Requests are
+// sent to the upstream of the groups of the user or, as they select no
+// tenants, to every upstream and the responses are merged.
+func filteredThanosHandler(filters func(TenantLabels, string) map[string]arrayFilter, upstreams *upstreamRouter, a *App) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthToken, labels, skip, ok := authorizeRequest(w, r, DatasourceMetrics, a)
+		if !ok {
+			return
+		}
+		r, enforce, ok := applyTenancy(w, r, DatasourceMetrics, labels, skip, a)
+		if !ok {
+			return
+		}
+		var elementFilters map[string]arrayFilter
+		if enforce && !(labels.ClusterWide && labels.Excluded == nil) {
+			elementFilters = filters(labels, a.Cfg.Thanos.TenantLabel)
+		}
+		upstreams.serve(w, r, "", PromQLEnforcer(struct{}{}), a.Cfg.Thanos.TenantLabel, oauthToken.Groups, a, elementFilters, false)
+	}
+}
+
+// WithTempo configures and adds the Tempo search and trace routes to the App's router,
+// logging warnings if the Tempo URL is not set, and returns the updated App.
+// Search requests are enforced with the TraceQLEnforcer, traces fetched by ID are
+// filtered to the spans of the allowed tenants.
+func (a *App) WithTempo() *App {
+	if a.Cfg.Tempo.URL == "" {
+		log.Warn().Msg("Tempo URL not set, skipping Tempo routes")
+		return a
+	}
+	routes := []Route{
+		{Url: "/api/search", MatchWord: "q"},
+		{Url: "/api/search/tags", MatchWord: "q"},
+		{Url: "/api/v2/search/tags", MatchWord: "q"},
+		{Url: "/api/search/tag/{tag}/values", MatchWord: "q"},
+		{Url: "/api/v2/search/tag/{tag}/values", MatchWord: "q"},
+	}
+	tempoRouter := a.e.PathPrefix("").Subrouter()
+	for _, route := range routes {
+		log.Trace().Any("route", route).Msg("Tempo route")
+		search := handler(route.MatchWord,
+			TraceQLEnforcer(struct{}{}),
+			DatasourceTraces,
+			a.Cfg.Tempo.TenantLabel,
+			a.Cfg.Tempo.URL,
+			a.Cfg.Tempo.UseMutualTLS,
+			a.Cfg.Tempo.Headers,
+			a)
+		tempoRouter.HandleFunc(route.Url, func(w http.ResponseWriter, r *http.Request) {
+			// the tags parameter of the legacy search bypasses TraceQL
+			if r.URL.Query().Has("tags") {
+				logAndWriteError(w, http.StatusBadRequest, nil, "tags search is not supported, use a TraceQL query in q")
+				return
+			}
+			search(w, r)
+		}).Name(route.Url)
+	}
+	for _, path := range []string{"/api/traces/{traceID}", "/api/v2/traces/{traceID}"} {
+		tempoRouter.HandleFunc(path, traceHandler(a)).Name(path)
+	}
+	return a
+}
+
+// traceHandler returns the handler for traces fetched by ID. The trace is
+// requested in JSON format and the spans of tenants the user is not allowed
+// to see are removed. If no spans remain, the trace is reported as not found.
+func traceHandler(a *App) func(http.ResponseWriter, *http.Request) {
+	upstreamURL, err := url.Parse(a.Cfg.Tempo.URL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", a.Cfg.Tempo.URL).Msg("Error parsing URL")
+	}
+	attribute := strings.TrimPrefix(a.Cfg.Tempo.TenantLabel, "resource.")
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, labels, skip, ok := authorizeRequest(w, r, DatasourceTraces, a)
+		if !ok {
+			return
+		}
+		if skip {
+			streamUp(w, r, upstreamURL, a.Cfg.Tempo.UseMutualTLS, a.Cfg.Tempo.Headers, a)
+			return
+		}
+
+		r.Header.Set("Accept", "application/json")
+		streamUpAndFilter(w, r, upstreamURL, a.Cfg.Tempo.UseMutualTLS, a.Cfg.Tempo.Headers, a, func(body []byte) ([]byte, error) {
+			filtered, found, err := filterTrace(body, labels, attribute)
+			if err == nil && !found {
+				err = fmt.Errorf("trace %w", errNotFound)
+			}
+			return filtered, err
+		})
+	}
+}
+
+// WithPyroscope configures and adds the Pyroscope HTTP and Connect routes to the App's router,
+// logging warnings if the Pyroscope URL is not set, and returns the updated App.
+// Label selectors are enforced with the PyroscopeEnforcer.
+func (a *App) WithPyroscope() *App {
+	if a.Cfg.Pyroscope.URL == "" {
+		log.Warn().Msg("Pyroscope URL not set, skipping Pyroscope routes")
+		return a
+	}
+	routes := []Route{
+		{Url: "/pyroscope/render", MatchWord: "query"},
+		{Url: "/pyroscope/labels", MatchWord: "query"},
+		{Url: "/pyroscope/label-values", MatchWord: "query"},
+	}
+	pyroscopeRouter := a.e.PathPrefix("").Subrouter()
+	for _, route := range routes {
+		log.Trace().Any("route", route).Msg("Pyroscope route")
+		pyroscopeRouter.HandleFunc(route.Url, handler(route.MatchWord,
+			PyroscopeEnforcer(struct{}{}),
+			DatasourceProfiles,
+			a.Cfg.Pyroscope.TenantLabel,
+			a.Cfg.Pyroscope.URL,
+			a.Cfg.Pyroscope.UseMutualTLS,
+			a.Cfg.Pyroscope.Headers,
+			a)).Name(route.Url)
+	}
+
+	// fields holding label selectors of the Connect requests, the field
+	// numbers are the ones of the querier.v1 and types.v1 messages
+	selectField := connectField{name: "labelSelector", numbers: []protowire.Number{2}}
+	connectRoutes := map[string][]connectField{
+		"SelectMergeStacktraces": {selectField},
+		"SelectMergeProfile":     {selectField},
+		"SelectMergeSpanProfile": {selectField},
+		"SelectSeries":           {selectField},
+		"Diff": {
+			{name: "left.labelSelector", numbers: []protowire.Number{1, 2}},
+			{name: "right.labelSelector", numbers: []protowire.Number{2, 2}},
+		},
+		"LabelNames":   {{name: "matchers", numbers: []protowire.Number{1}, repeated: true}},
+		"LabelValues":  {{name: "matchers", numbers: []protowire.Number{2}, repeated: true}},
+		"Series":       {{name: "matchers", numbers: []protowire.Number{1}, repeated: true}},
+		"ProfileTypes": nil,
+	}
+	for method, fields := range connectRoutes {
+		path := "/querier.v1.QuerierService/" + method
+		log.Trace().Str("route", path).Int("fields", len(fields)).Msg("Pyroscope route")
+		pyroscopeRouter.HandleFunc(path, connectHandler(fields, a)).Methods(http.MethodPost).Name(path)
+	}
+	return a
+}
+
+// connectHandler returns the handler for a Pyroscope Connect endpoint. The
+// label selectors in the given fields of JSON and protobuf encoded requests
+// are enforced with the PyroscopeEnforcer, compressed requests and the gRPC
+// protocols are rejected.
+func connectHandler(fields []connectField, a *App) func(http.ResponseWriter, *http.Request) {
+	upstreamURL, err := url.Parse(a.Cfg.Pyroscope.URL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", a.Cfg.Pyroscope.URL).Msg("Error parsing URL")
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, labels, skip, ok := authorizeRequest(w, r, DatasourceProfiles, a)
+		if !ok {
+			return
+		}
+		if skip {
+			streamUp(w, r, upstreamURL, a.Cfg.Pyroscope.UseMutualTLS, a.Cfg.Pyroscope.Headers, a)
+			return
+		}
+
+		enforceConnect := enforceConnectRequest
+		switch contentType := r.Header.Get("Content-Type"); {
+		case strings.HasPrefix(contentType, "application/json"):
+		case strings.HasPrefix(contentType, "application/proto"):
+			enforceConnect = enforceConnectProtobuf
+		default:
+			logAndWriteError(w, http.StatusUnsupportedMediaType, nil, "only the JSON and protobuf encodings of Connect are supported")
+			return
+		}
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+			logAndWriteError(w, http.StatusUnsupportedMediaType, nil, "compressed Connect requests are not supported")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		_ = r.Body.Close()
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		body, err = enforceConnect(body, fields, PyroscopeEnforcer{}, labels, a.Cfg.Pyroscope.TenantLabel)
+		if err != nil {
+			logAndWriteError(w, http.StatusForbidden, err, "")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+		r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+
+		streamUp(w, r, upstreamURL, a.Cfg.Pyroscope.UseMutualTLS, a.Cfg.Pyroscope.Headers, a)
+	}
+}
+
 // handler function orchestrates the request flow through the proxy, comprising
 // authentication, conditional enforcement, and forwarding to the upstream server.
 //
 // Initially, it retrieves the OAuth token and validates it.
 //
-// Subsequently, it validates labels retrieved from the token and determines whether
+// Subsequently, it validates labels retrieved from the token for the datasource and determines whether
 // enforcement should be skipped based on them. If an error occurs during label
 // validation, it is logged and a forbidden status response is dispatched. If enforcement
 // is opted to be skipped, the request is streamed directly to the upstream server without
@@ -137,31 +396,47 @@ func (a *App) WithThanos() *App {
 //
 // Finally, if all checks and possible enforcement pass successfully, the request is
 // streamed to the upstream server.
-func handler(matchWord string, enforcer EnforceQL, tl string, dsURL string, tls bool, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
-	upstreamURL, err := url.Parse(dsURL)
-	if err != nil {
-		log.Fatal().Err(err).Str("url", dsURL).Msg("Error parsing URL")
-	}
+func handler(matchWord string, enforcer EnforceQL, datasource Datasource, tl string, dsURL string, tls bool, headers map[string]string, a *App) func(http.ResponseWriter, *http.Request) {
+	return filteringHandler(matchWord, enforcer, datasource, tl, newUpstreamRouter(upstream{url: parseUpstreamURL(dsURL), tls: tls, headers: headers}, nil, nil, false), a, nil)
+}
+
+// filteringHandler is a handler whose enforced requests are sent to the
+// upstreams the upstreamRouter routes them to and streamed through the array
+// filters returned by filters, if it is set. Users who can see every tenant
+// get unfiltered responses.
+func filteringHandler(matchWord string, enforcer EnforceQL, datasource Datasource, tl string, upstreams *upstreamRouter, a *App,
+	filters func(*http.Request, TenantLabels, []string) map[string]arrayFilter) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		oauthToken, err := getToken(r, a)
 		if err != nil {
 			logAndWriteError(w, http.StatusForbidden, err, "")
 		}
 
-		labels, skip, err := validateLabels(oauthToken, a)
+		labels, skip, err := validateLabels(oauthToken, datasource, a)
 		if err != nil {
 			logAndWriteError(w, http.StatusForbidden, err, "")
 			return
 		}
+		r, enforce, ok := applyTenancy(w, r, datasource, labels, skip, a)
+		if !ok {
+			return
+		}
 		if skip {
-			streamUp(w, r, upstreamURL, tls, headers, a)
+			upstreams.serve(w, r, matchWord, enforcer, tl, oauthToken.Groups, a, nil, false)
 			return
 		}
 
-		err = enforceRequest(r, enforcer, labels, tl, matchWord)
-		if err != nil {
-			logAndWriteError(w, http.StatusForbidden, err, "")
-			return
+		var arrays map[string]arrayFilter
+		if enforce {
+			// the filters read the request before it is enforced
+			if filters != nil && !(labels.ClusterWide && labels.Excluded == nil) {
+				arrays = filters(r, labels, oauthToken.Groups)
+			}
+
+			if err := enforceRequest(r, enforcer, labels, tl, matchWord); err != nil {
+				logAndWriteError(w, http.StatusForbidden, err, "")
+				return
+			}
 		}
 
 		if _, ok := enforcer.(LogQLEnforcer); ok {
@@ -179,8 +454,27 @@ func handler(matchWord string, enforcer EnforceQL, tl string, dsURL string, tls
 			}
 		}
 
-		streamUp(w, r, upstreamURL, tls, headers, a)
+		// the filters of label responses run verification queries, which can fail
+		upstreams.serve(w, r, matchWord, enforcer, tl, oauthToken.Groups, a, arrays, true)
+	}
+}
+
+// authorizeRequest authenticates the request and returns the token of the
+// user, their tenant labels for the datasource and whether enforcement can be
+// skipped. If the request is not authorized, the error response is written
+// and false is returned.
+func authorizeRequest(w http.ResponseWriter, r *http.Request, datasource Datasource, a *App) (OAuthToken, TenantLabels, bool, bool) {
+	oauthToken, err := getToken(r, a)
+	if err != nil {
+		logAndWriteError(w, http.StatusForbidden, err, "")
+		return OAuthToken{}, TenantLabels{}, false, false
+	}
+	labels, skip, err := validateLabels(oauthToken, datasource, a)
+	if err != nil {
+		logAndWriteError(w, http.StatusForbidden, err, "")
+		return OAuthToken{}, TenantLabels{}, false, false
 	}
+	return oauthToken, labels, skip, true
 }
 
 func setActorHeaderLogQL(r *http.Request, token OAuthToken, a *App) error {
@@ -204,13 +498,105 @@ func setActorHeaderPromQL(r *http.Request, token OAuthToken, a *App) error {
 // streamUp forwards the provided HTTP request to the specified upstream URL using
 // a reverse proxy.It serves the upstream content back to the original client.
 func streamUp(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App) {
-	setHeaders(r, tls, headers, a.ServiceAccountToken)
-	proxy := httputil.NewSingleHostReverseProxy(upstreamURL)
+	upstream{url: upstreamURL, tls: tls, headers: headers}.streamUp(w, r, a)
+}
+
+// streamUp forwards the request to the upstream like the streamUp function,
+// with the transport of the upstream.
+func (up upstream) streamUp(w http.ResponseWriter, r *http.Request, a *App) {
+	setHeaders(r, up.tls, up.headers, a.ServiceAccountToken)
+	up.reverseProxy().ServeHTTP(w, r)
+}
+
+// errNotFound is returned by response filters if nothing the user is allowed
+// to see remains, it is reported to the client as not found.
+var errNotFound = errors.New("not found")
+
+// streamUpAndFilter forwards the provided HTTP request like streamUp, but
+// passes the body of successful responses through filter before serving it
+// back to the client. Compressed responses are avoided so the body can be
+// filtered.
+func streamUpAndFilter(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App, filter func([]byte) ([]byte, error)) {
+	upstream{url: upstreamURL, tls: tls, headers: headers}.streamUpAndFilter(w, r, a, filter)
+}
+
+// streamUpAndFilter forwards the request to the upstream like the
+// streamUpAndFilter function, with the transport of the upstream.
+func (up upstream) streamUpAndFilter(w http.ResponseWriter, r *http.Request, a *App, filter func([]byte) ([]byte, error)) {
+	setHeaders(r, up.tls, up.headers, a.ServiceAccountToken)
+	r.Header.Del("Accept-Encoding")
+	proxy := up.reverseProxy()
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		body, err = filter(body)
+		if err != nil {
+			return err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		resp.ContentLength = int64(len(body))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		if errors.Is(err, errNotFound) {
+			logAndWriteError(w, http.StatusNotFound, err, "")
+			return
+		}
+		logAndWriteError(w, http.StatusBadGateway, err, "")
+	}
+	proxy.ServeHTTP(w, r)
+}
+
+// streamUpAndRewrite forwards the provided HTTP request like streamUp, but
+// streams the body of successful responses through rewrite while it is served
+// back to the client, so large responses are never held in memory. If rewrite
+// fails, the response is cut off and the error is logged.
+func streamUpAndRewrite(w http.ResponseWriter, r *http.Request, upstreamURL *url.URL, tls bool, headers map[string]string, a *App, rewrite func(io.Reader, io.Writer) error) {
+	upstream{url: upstreamURL, tls: tls, headers: headers}.streamUpAndRewrite(w, r, a, rewrite)
+}
+
+// streamUpAndRewrite forwards the request to the upstream like the
+// streamUpAndRewrite function, with the transport of the upstream.
+func (up upstream) streamUpAndRewrite(w http.ResponseWriter, r *http.Request, a *App, rewrite func(io.Reader, io.Writer) error) {
+	setHeaders(r, up.tls, up.headers, a.ServiceAccountToken)
+	r.Header.Del("Accept-Encoding")
+	proxy := up.reverseProxy()
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return nil
+		}
+		body := resp.Body
+		reader, writer := io.Pipe()
+		go func() {
+			buffered := bufio.NewWriter(writer)
+			err := rewrite(body, buffered)
+			if err == nil {
+				err = buffered.Flush()
+			}
+			if err != nil && !errors.Is(err, io.ErrClosedPipe) {
+				log.Error().Err(err).Str("path", resp.Request.URL.Path).Msg("Error rewriting response")
+			}
+			_ = body.Close()
+			_ = writer.CloseWithError(err)
+		}()
+		resp.Body = reader
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		return nil
+	}
 	proxy.ServeHTTP(w, r)
 }
 
 // setHeaders modifies the HTTP request headers to set the Authorization and
-// other headers based on the provided arguments.
+// other headers based on the provided arguments. The org ID resolved by
+// applyTenancy takes precedence over the provided headers.
 func setHeaders(r *http.Request, tls bool, header map[string]string, sat string) {
 	if !tls {
 		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", sat))
@@ -218,4 +604,5 @@ func setHeaders(r *http.Request, tls bool, header map[string]string, sat string)
 	for k, v := range header {
 		r.Header.Set(k, v)
 	}
+	setOrgIDHeader(r)
 }
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -116,3 +117,134 @@ func TestWithHealthz(t *testing.T) {
 		}
 	})
 }
+
+func TestWithTempo(t *testing.T) {
+	app, tokens := setupTestMain()
+	var query string
+	tempo := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("q")
+		if r.URL.Path == "/api/traces/4bf92f3577b34da6" {
+			assert.Equal(t, "application/json", r.Header.Get("Accept"))
+			_, _ = fmt.Fprint(w, `{"batches":[`+
+				`{"resource":{"attributes":[{"key":"tenant_id","value":{"stringValue":"allowed_group1"}}]},"scopeSpans":[]},`+
+				`{"resource":{"attributes":[{"key":"tenant_id","value":{"stringValue":"other"}}]},"scopeSpans":[]}]}`)
+			return
+		}
+		_, _ = fmt.Fprint(w, `{"traces":[]}`)
+	}))
+	defer tempo.Close()
+	app.Cfg.Tempo.URL = tempo.URL
+	app.Cfg.Tempo.TenantLabel = "resource.tenant_id"
+	app.WithRoutes()
+
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[token])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("/api/search?q=%7B%20name%20%3D%20%22GET%22%20%7D&limit=20", "groupTenant")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{ (name = "GET") && resource.tenant_id =~ "^(?:allowed_group1|also_allowed_group1)$" }`, query)
+
+	rr = serve("/api/v2/search/tag/resource.service.name/values", "groupTenant")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `{ resource.tenant_id =~ "^(?:allowed_group1|also_allowed_group1)$" }`, query)
+
+	rr = serve("/api/search?q=%7B%20resource.tenant_id%20%3D%20%22other%22%20%7D", "groupTenant")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve("/api/search?tags=service.name%3Dapi", "groupTenant")
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	rr = serve("/api/traces/4bf92f3577b34da6", "groupTenant")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Contains(t, rr.Body.String(), "allowed_group1")
+	assert.NotContains(t, rr.Body.String(), "other")
+
+	rr = serve("/api/traces/4bf92f3577b34da6", "userTenant")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestWithPyroscope(t *testing.T) {
+	app, tokens := setupTestMain()
+	var query, body string
+	pyroscope := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query().Get("query")
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		_, _ = fmt.Fprint(w, "{}")
+	}))
+	defer pyroscope.Close()
+	app.Cfg.Pyroscope.URL = pyroscope.URL
+	app.Cfg.Pyroscope.TenantLabel = "namespace"
+	app.WithRoutes()
+
+	serve := func(method, path, contentType, requestBody string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(requestBody))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		req.Header.Set("Content-Type", contentType)
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve(http.MethodGet, "/pyroscope/render?query=process_cpu:cpu:nanoseconds:cpu:nanoseconds%7Bservice_name%3D%22api%22%7D&from=now-1h", "", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `process_cpu:cpu:nanoseconds:cpu:nanoseconds{service_name="api", namespace=~"allowed_user|also_allowed_user"}`, query)
+
+	rr = serve(http.MethodPost, "/querier.v1.QuerierService/LabelValues", "application/json", `{"name":"service_name"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"name":"service_name","matchers":["{namespace=~\"allowed_user|also_allowed_user\"}"]}`, body)
+
+	rr = serve(http.MethodPost, "/querier.v1.QuerierService/SelectSeries", "application/json", `{"profileTypeID":"x","labelSelector":"{namespace=\"other\"}"}`)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(http.MethodPost, "/querier.v1.QuerierService/SelectSeries", "application/proto", string(protoString(protoString(nil, 1, "x"), 2, `{service_name="api"}`)))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, string(protoString(protoString(nil, 1, "x"), 2, `{service_name="api", namespace=~"allowed_user|also_allowed_user"}`)), body)
+
+	rr = serve(http.MethodPost, "/querier.v1.QuerierService/LabelNames", "application/proto", string(protoString(nil, 1, `{namespace="other"}`)))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(http.MethodPost, "/querier.v1.QuerierService/SelectSeries", "application/grpc", "")
+	assert.Equal(t, http.StatusUnsupportedMediaType, rr.Code)
+}
+
+func TestWithThanosFilteredRoutes(t *testing.T) {
+	app, tokens := setupTestMain()
+	thanos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/alerts":
+			_, _ = fmt.Fprint(w, `{"status":"success","data":{"alerts":[{"labels":{"tenant_id":"allowed_user"}},{"labels":{"tenant_id":"other"}}]}}`)
+		case "/api/v1/targets":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = fmt.Fprint(w, `{"status":"error"}`)
+		}
+	}))
+	defer thanos.Close()
+	app.Cfg.Thanos.URL = thanos.URL
+	app.Cfg.Thanos.TenantLabel = "tenant_id"
+	app.WithRoutes()
+
+	serve := func(path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("/api/v1/alerts", tokens["userTenant"])
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.JSONEq(t, `{"status":"success","data":{"alerts":[{"labels":{"tenant_id":"allowed_user"}}]}}`, rr.Body.String())
+
+	rr = serve("/api/v1/targets", tokens["userTenant"])
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.JSONEq(t, `{"status":"error"}`, rr.Body.String())
+
+	rr = serve("/api/v1/alerts", tokens["noTenant"])
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"gopkg.in/yaml.v3"
+)
+
+// WithRuler configures and adds the ruler API routes of Loki (/loki/api/v1/rules) and
+// Mimir (/prometheus/config/v1/rules) to the App's router if the Loki URL or the ruler URL
+// of the Thanos config is set, and returns the updated App. The Thanos URL serves the
+// Prometheus query API only, so the Mimir ruler API has its own URL, TLS and headers.
+//
+// Rule namespaces are mapped to tenant label values, so users can only list, read, write
+// and delete the rule groups of the namespaces they are allowed to query. The expressions
+// of written rule groups are enforced to the tenant of their namespace.
+func (a *App) WithRuler() *App {
+	if a.Cfg.Loki.URL != "" {
+		rp := newRulerProxy(LogQLEnforcer(struct{}{}), DatasourceLogs, a.Cfg.Loki.TenantLabel, a.lokiUpstreams(), a)
+		rp.routes(a.e.PathPrefix("/loki/api/v1/rules").Subrouter(), "/loki/api/v1/rules")
+	}
+	if a.Cfg.Thanos.RulerURL != "" {
+		rp := newRulerProxy(PromQLEnforcer(struct{}{}), DatasourceMetrics, a.Cfg.Thanos.TenantLabel, a.thanosRulerUpstreams(), a)
+		rp.routes(a.e.PathPrefix("/prometheus/config/v1/rules").Subrouter(), "/prometheus/config/v1/rules")
+	}
+	return a
+}
+
+type rulerProxy struct {
+	upstreams   *upstreamRouter
+	enforcer    EnforceQL
+	datasource  Datasource
+	tenantLabel string
+	a           *App
+}
+
+func newRulerProxy(enforcer EnforceQL, datasource Datasource, tl string, upstreams *upstreamRouter, a *App) *rulerProxy {
+	return &rulerProxy{upstreams: upstreams, enforcer: enforcer, datasource: datasource, tenantLabel: tl, a: a}
+}
+
+func (rp *rulerProxy) routes(router *mux.Router, prefix string) {
+	router.HandleFunc("", rp.list).Methods(http.MethodGet).Name(prefix)
+	router.HandleFunc("/{namespace}", rp.list).Methods(http.MethodGet).Name(prefix + "/{namespace}")
+	router.HandleFunc("/{namespace}", rp.write).Methods(http.MethodPost).Name(prefix + "/{namespace}")
+	router.HandleFunc("/{namespace}", rp.forward).Methods(http.MethodDelete).Name(prefix + "/{namespace}")
+	router.HandleFunc("/{namespace}/{groupName}", rp.forward).Methods(http.MethodGet, http.MethodDelete).Name(prefix + "/{namespace}/{groupName}")
+}
+
+// authorize authorizes the request and, if the route has a namespace, checks
+// that the user is allowed to query its tenant, directly or by one of their
+// tuples like the label API. It returns the request with the tenancy mode
+// applied, the tenant labels of the user, the upstream serving the tenant of
+// the namespace, or all tenants of the user if the route has none, and
+// whether enforcement can be skipped. If the request is not authorized or
+// needs several upstreams, the error response is written and false is
+// returned.
+func (rp *rulerProxy) authorize(w http.ResponseWriter, r *http.Request) (*http.Request, TenantLabels, upstream, bool, bool) {
+	oauthToken, tenantLabels, skip, ok := authorizeRequest(w, r, rp.datasource, rp.a)
+	if !ok {
+		return r, tenantLabels, upstream{}, skip, ok
+	}
+	r, enforce, ok := applyTenancy(w, r, rp.datasource, tenantLabels, skip, rp.a)
+	if !ok {
+		return r, tenantLabels, upstream{}, skip, ok
+	}
+	namespace, hasNamespace := mux.Vars(r)["namespace"]
+	if enforce && hasNamespace && !tenantValueAllowed(tenantLabels, rp.tenantLabel, namespace) {
+		logAndWriteError(w, http.StatusForbidden, fmt.Errorf("user not allowed to manage rule namespace %s", namespace), "")
+		return r, tenantLabels, upstream{}, false, false
+	}
+	targets := rp.upstreams.routeUser(tenantLabels, skip, rp.tenantLabel, oauthToken.Groups)
+	if hasNamespace {
+		targets = rp.upstreams.targets([]string{namespace}, oauthToken.Groups)
+	}
+	target, err := rp.upstreams.single(targets, rp.tenantLabel)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "")
+		return r, tenantLabels, upstream{}, false, false
+	}
+	return r, tenantLabels, target, !enforce, true
+}
+
+// list lists the rule groups of the namespaces the user is allowed to query.
+func (rp *rulerProxy) list(w http.ResponseWriter, r *http.Request) {
+	r, tenantLabels, target, skip, ok := rp.authorize(w, r)
+	if !ok {
+		return
+	}
+	if skip {
+		target.streamUp(w, r, rp.a)
+		return
+	}
+	target.streamUpAndFilter(w, r, rp.a, func(body []byte) ([]byte, error) {
+		return filterRuleNamespaces(body, tenantLabels, rp.tenantLabel)
+	})
+}
+
+// forward forwards requests reading or deleting rule groups of a namespace
+// the user is allowed to query.
+func (rp *rulerProxy) forward(w http.ResponseWriter, r *http.Request) {
+	r, _, target, _, ok := rp.authorize(w, r)
+	if !ok {
+		return
+	}
+	target.streamUp(w, r, rp.a)
+}
+
+// write enforces the expressions of the rule group in the body to the tenant
+// of the namespace before the rule group is written.
+func (rp *rulerProxy) write(w http.ResponseWriter, r *http.Request) {
+	r, tenantLabels, target, skip, ok := rp.authorize(w, r)
+	if !ok {
+		return
+	}
+	if skip {
+		target.streamUp(w, r, rp.a)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	_ = r.Body.Close()
+	if err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "")
+		return
+	}
+	scope := tenantLabels
+	if !tenantLabels.ClusterWide {
+		scope, err = ruleScope(tenantLabels, rp.tenantLabel, mux.Vars(r)["namespace"])
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+	}
+	body, err = enforceRuleGroup(body, rp.enforcer, scope, rp.tenantLabel)
+	if err != nil {
+		logAndWriteError(w, http.StatusForbidden, err, "")
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	target.streamUp(w, r, rp.a)
+}
+
+// ruleScope returns the tenant labels the rules of a namespace are enforced
+// to. The namespace is taken as literal value of the tenant label, never as
+// pattern, tuple or exclusion. If the user is granted the namespace by tuples
+// only, e.g. {cluster="prod-eu", namespace="payments"}, the rules are
+// enforced to these tuples with the namespace as tenant label value, so they
+// cannot query the namespace in other clusters.
+func ruleScope(tenantLabels TenantLabels, tenantLabel, namespace string) (TenantLabels, error) {
+	if !model.LabelValue(namespace).IsValid() {
+		return TenantLabels{}, fmt.Errorf("invalid rule namespace %q", namespace)
+	}
+	scope := TenantLabels{Values: make(map[string]bool)}
+	if tenantLabels.Allowed(namespace) {
+		scope.Values[namespace] = true
+		return scope, nil
+	}
+	scope.Tuples = make(map[string][]*labels.Matcher)
+	for _, tuple := range tenantLabels.Tuples {
+		if !anySelectorAllows([][]*labels.Matcher{tuple}, tenantLabel, namespace) {
+			continue
+		}
+		matchers := []*labels.Matcher{labels.MustNewMatcher(labels.MatchEqual, tenantLabel, namespace)}
+		for _, matcher := range tuple {
+			if matcher.Name != tenantLabel {
+				matchers = append(matchers, matcher)
+			}
+		}
+		sort.Slice(matchers, func(i, j int) bool { return matchers[i].Name < matchers[j].Name })
+		scope.Tuples[matchersString(matchers)] = matchers
+	}
+	return scope, nil
+}
+
+// filterRuleNamespaces removes the namespaces the tenant labels do not allow
+// from a ruler response in YAML format, mapping namespaces to rule groups.
+func filterRuleNamespaces(body []byte, tenantLabels TenantLabels, tenantLabel string) ([]byte, error) {
+	var namespaces yaml.Node
+	if err := yaml.Unmarshal(body, &namespaces); err != nil {
+		return nil, fmt.Errorf("invalid rule namespaces: %w", err)
+	}
+	if len(namespaces.Content) == 0 {
+		return body, nil
+	}
+	mapping := namespaces.Content[0]
+	if mapping.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid rule namespaces: expected a mapping")
+	}
+	allowed := make([]*yaml.Node, 0, len(mapping.Content))
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if tenantValueAllowed(tenantLabels, tenantLabel, mapping.Content[i].Value) {
+			allowed = append(allowed, mapping.Content[i], mapping.Content[i+1])
+		}
+	}
+	mapping.Content = allowed
+	return yaml.Marshal(&namespaces)
+}
+
+// enforceRuleGroup enforces the expression of every rule of a rule group in
+// YAML format. Other fields are kept as they are. Federated rule groups
+// querying other tenants through source_tenants and rules whose labels set
+// the tenant label to a value the tenant labels do not allow are rejected,
+// as their series or alerts would be written to another tenant.
+func enforceRuleGroup(body []byte, enforcer EnforceQL, tenantLabels TenantLabels, tenantLabel string) ([]byte, error) {
+	var group yaml.Node
+	if err := yaml.Unmarshal(body, &group); err != nil {
+		return nil, fmt.Errorf("invalid rule group: %w", err)
+	}
+	if len(group.Content) == 0 || group.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("invalid rule group: expected a mapping")
+	}
+	if mappingValue(group.Content[0], "source_tenants") != nil {
+		return nil, fmt.Errorf("federated rule groups are not allowed")
+	}
+	rules := mappingValue(group.Content[0], "rules")
+	if rules == nil || rules.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("invalid rule group: expected a sequence of rules")
+	}
+	for _, rule := range rules.Content {
+		expr := mappingValue(rule, "expr")
+		if expr == nil || expr.Kind != yaml.ScalarNode {
+			return nil, fmt.Errorf("invalid rule: expected an expression")
+		}
+		enforced, err := enforcer.Enforce(expr.Value, tenantLabels, tenantLabel)
+		if err != nil {
+			return nil, err
+		}
+		expr.Value = enforced
+		if value := mappingValue(mappingValue(rule, "labels"), tenantLabel); value != nil && !tenantValueAllowed(tenantLabels, tenantLabel, value.Value) {
+			return nil, fmt.Errorf("rule labels set %s to %q: %w", tenantLabel, value.Value, unauthorizedLabelError(value.Value))
+		}
+	}
+	return yaml.Marshal(&group)
+}
+
+// mappingValue returns the value of the key of a YAML mapping node, or nil if
+// the node is nil, no mapping or has no such key.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func TestEnforceRuleGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    string
+		enforcer EnforceQL
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "PromQL rules",
+			group: `name: payments
+interval: 1m
+rules:
+  - record: payments:requests:rate5m
+    expr: rate(http_requests_total[5m])
+  - alert: PaymentsDown
+    expr: up{job="api"} == 0
+    for: 5m
+    labels:
+      severity: critical
+`,
+			enforcer: PromQLEnforcer{},
+			want:     []string{`rate(http_requests_total{namespace="payments"}[5m])`, `up{job="api",namespace="payments"} == 0`},
+		},
+		{
+			name: "LogQL rules",
+			group: `name: payments
+rules:
+  - alert: PaymentErrors
+    expr: sum(rate({app="api"} |= "error" [5m])) > 10
+`,
+			enforcer: LogQLEnforcer{},
+			want:     []string{`sum(rate(({app="api", namespace="payments"} |= "error") [5m])) > 10`},
+		},
+		{
+			name: "Other tenant",
+			group: `name: payments
+rules:
+  - record: billing:up
+    expr: up{namespace="billing"}
+`,
+			enforcer: PromQLEnforcer{},
+			wantErr:  true,
+		},
+		{
+			name: "Tenant label of the namespace",
+			group: `name: payments
+rules:
+  - record: payments:up
+    expr: up
+    labels:
+      namespace: payments
+`,
+			enforcer: PromQLEnforcer{},
+			want:     []string{`up{namespace="payments"}`},
+		},
+		{
+			name: "Tenant label of another tenant",
+			group: `name: payments
+rules:
+  - record: billing:up
+    expr: up
+    labels:
+      namespace: billing
+`,
+			enforcer: PromQLEnforcer{},
+			wantErr:  true,
+		},
+		{
+			name: "Federated rule group",
+			group: `name: payments
+source_tenants: [billing]
+rules:
+  - record: up:sum
+    expr: sum(up)
+`,
+			enforcer: PromQLEnforcer{},
+			wantErr:  true,
+		},
+		{
+			name:     "No rules",
+			group:    `name: payments`,
+			enforcer: PromQLEnforcer{},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enforced, err := enforceRuleGroup([]byte(tt.group), tt.enforcer, NewTenantLabels("payments"), "namespace")
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var group struct {
+				Name  string
+				Rules []map[string]any
+			}
+			assert.NoError(t, yaml.Unmarshal(enforced, &group))
+			assert.Equal(t, "payments", group.Name)
+			var exprs []string
+			for _, rule := range group.Rules {
+				exprs = append(exprs, rule["expr"].(string))
+			}
+			assert.Equal(t, tt.want, exprs)
+		})
+	}
+}
+
+func TestRuleScope(t *testing.T) {
+	scope, err := ruleScope(NewTenantLabels("payments", "team-*"), "namespace", "team-a")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"team-a"}, scope.Strings())
+
+	// the namespace is a literal value, never a pattern or an exclusion
+	for _, namespace := range []string{"~.*", "!payments", `{cluster="prod-eu"}`} {
+		scope, err = ruleScope(NewTenantLabels("#cluster-wide"), "namespace", namespace)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{namespace}, scope.Strings())
+		assert.Nil(t, scope.Excluded)
+	}
+
+	_, err = ruleScope(NewTenantLabels("#cluster-wide"), "namespace", "\xff")
+	assert.Error(t, err)
+
+	// tuple grants keep their other labels
+	tuples := NewTenantLabels(`{cluster="prod-eu", namespace="payments"}`, `{cluster="dev"}`, `{cluster="prod-us", namespace="billing"}`)
+	assert.True(t, tenantValueAllowed(tuples, "namespace", "payments"))
+	scope, err = ruleScope(tuples, "namespace", "payments")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`{cluster="dev", namespace="payments"}`, `{cluster="prod-eu", namespace="payments"}`}, scope.Strings())
+	enforced, err := PromQLEnforcer{}.Enforce("up", scope, "namespace")
+	assert.NoError(t, err)
+	assert.Contains(t, enforced, `cluster="prod-eu"`)
+	assert.NotContains(t, enforced, "prod-us")
+}
+
+func TestWithRuler(t *testing.T) {
+	app, tokens := setupTestMain()
+	var method, path, body string
+	mimir := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		b, _ := io.ReadAll(r.Body)
+		body = string(b)
+		if r.Method == http.MethodGet {
+			_, _ = io.WriteString(w, `allowed_user:
+    - name: up
+      rules:
+        - record: up:sum
+          expr: sum(up{tenant_id="allowed_user"})
+other:
+    - name: up
+      rules:
+        - record: up:sum
+          expr: sum(up{tenant_id="other"})
+`)
+		}
+	}))
+	defer mimir.Close()
+	app.Cfg.Thanos.URL = mimir.URL
+	app.Cfg.Thanos.TenantLabel = "tenant_id"
+	app.Cfg.Loki.URL = mimir.URL
+	app.Cfg.Loki.TenantLabel = "tenant_id"
+	app.WithRoutes()
+
+	serve := func(method, path, requestBody string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(requestBody))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// the thanos url does not serve the mimir ruler api
+	method = ""
+	rr := serve(http.MethodGet, "/prometheus/config/v1/rules", "")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Empty(t, method)
+
+	app.Cfg.Thanos.URL = "http://localhost:1"
+	app.Cfg.Thanos.RulerURL = mimir.URL
+	app.WithRoutes()
+
+	rr = serve(http.MethodGet, "/prometheus/config/v1/rules", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	var namespaces map[string]any
+	assert.NoError(t, yaml.Unmarshal(rr.Body.Bytes(), &namespaces))
+	assert.Contains(t, namespaces, "allowed_user")
+	assert.NotContains(t, namespaces, "other")
+
+	rr = serve(http.MethodPost, "/prometheus/config/v1/rules/allowed_user", "name: up\nrules:\n  - record: up:sum\n    expr: sum(up)\n")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.MethodPost, method)
+	assert.Contains(t, body, `sum(up{tenant_id="allowed_user"})`)
+
+	rr = serve(http.MethodPost, "/prometheus/config/v1/rules/allowed_user", "name: up\nrules:\n  - record: up:sum\n    expr: sum(up{tenant_id=\"also_allowed_user\"})\n")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(http.MethodPost, "/prometheus/config/v1/rules/other", "name: up\nrules:\n  - record: up:sum\n    expr: sum(up)\n")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(http.MethodDelete, "/prometheus/config/v1/rules/other/up", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(http.MethodDelete, "/prometheus/config/v1/rules/allowed_user/up", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, http.MethodDelete, method)
+	assert.Equal(t, "/prometheus/config/v1/rules/allowed_user/up", path)
+
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/other", "")
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+
+	rr = serve(http.MethodGet, "/loki/api/v1/rules/allowed_user/up", "")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "/loki/api/v1/rules/allowed_user/up", path)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var tailSessionsActive = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "multena_loki_tail_sessions",
+	Help: "Number of active Loki tail sessions.",
+})
+
+// tailWriteTimeout is the time allowed to write a close message to either
+// side of a tail session.
+const tailWriteTimeout = time.Second
+
+// tailSessions counts the active tail sessions per user.
+type tailSessions struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// acquire registers a tail session of the user and reports whether the user
+// was below the limit. A limit of 0 allows any number of sessions.
+func (s *tailSessions) acquire(user string, limit int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if limit > 0 && s.active[user] >= limit {
+		return false
+	}
+	s.active[user]++
+	tailSessionsActive.Inc()
+	return true
+}
+
+// release unregisters a tail session of the user.
+func (s *tailSessions) release(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.active[user]--
+	if s.active[user] <= 0 {
+		delete(s.active, user)
+	}
+	tailSessionsActive.Dec()
+}
+
+// tailHandler returns the handler of the Loki tail WebSocket endpoint. The
+// query parameter is enforced before the connection is upgraded, then the
+// messages of the session are proxied between the client and Loki. Sessions
+// are closed when the token of the user expires or the maximum duration of the
+// Loki config is reached, and the number of concurrent sessions per user is
+// limited. Sessions are opened on the upstream serving the tenants the query
+// selects, queries selecting tenants of several upstreams are rejected.
+func tailHandler(a *App) func(http.ResponseWriter, *http.Request) {
+	upstreams := a.lokiUpstreams()
+	sessions := &tailSessions{active: make(map[string]int)}
+	upgrader := websocket.Upgrader{
+		// clients authenticate with the Authorization header, which browsers
+		// cannot set on cross-origin WebSocket requests
+		CheckOrigin: func(*http.Request) bool { return true },
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		oauthToken, labels, skip, ok := authorizeRequest(w, r, DatasourceLogs, a)
+		if !ok {
+			return
+		}
+		r, enforce, ok := applyTenancy(w, r, DatasourceLogs, labels, skip, a)
+		if !ok {
+			return
+		}
+		targets := upstreams.routeUser(labels, skip, a.Cfg.Loki.TenantLabel, oauthToken.Groups)
+		if enforce {
+			if err := enforceRequest(r, LogQLEnforcer(struct{}{}), labels, a.Cfg.Loki.TenantLabel, "query"); err != nil {
+				logAndWriteError(w, http.StatusForbidden, err, "")
+				return
+			}
+			// the enforced query selects the tenants of the session
+			routed, err := upstreams.route(r, "query", LogQLEnforcer(struct{}{}), a.Cfg.Loki.TenantLabel, oauthToken.Groups)
+			if err != nil {
+				logAndWriteError(w, http.StatusBadRequest, err, "")
+				return
+			}
+			targets = routed
+		}
+		target, err := upstreams.single(targets, a.Cfg.Loki.TenantLabel)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+		if !websocket.IsWebSocketUpgrade(r) {
+			logAndWriteError(w, http.StatusBadRequest, errors.New("tail requires a WebSocket upgrade"), "")
+			return
+		}
+		_ = setActorHeaderLogQL(r, oauthToken, a)
+
+		user := tailUser(oauthToken)
+		if !sessions.acquire(user, a.Cfg.Loki.TailMaxSessions) {
+			logAndWriteError(w, http.StatusTooManyRequests, fmt.Errorf("user %s reached the limit of %d tail sessions", user, a.Cfg.Loki.TailMaxSessions), "")
+			return
+		}
+		defer sessions.release(user)
+
+		upstream, resp, err := dialTail(r, target, a)
+		if err != nil {
+			if resp != nil {
+				// forward the rejection of Loki, e.g. of an invalid query
+				defer resp.Body.Close()
+				body, _ := io.ReadAll(resp.Body)
+				logAndWriteError(w, resp.StatusCode, fmt.Errorf("%s", body), "")
+				return
+			}
+			logAndWriteError(w, http.StatusBadGateway, err, "")
+			return
+		}
+		responseHeader := http.Header{}
+		if protocol := upstream.Subprotocol(); protocol != "" {
+			responseHeader.Set("Sec-Websocket-Protocol", protocol)
+		}
+		client, err := upgrader.Upgrade(w, r, responseHeader)
+		if err != nil {
+			// the upgrader wrote the error response
+			_ = upstream.Close()
+			return
+		}
+
+		deadline, reason := tailDeadline(oauthToken, a.Cfg.Loki.TailMaxDuration, time.Now())
+		log.Debug().Str("user", user).Time("deadline", deadline).Msg("Tail session started")
+		proxyTail(client, upstream, deadline, reason)
+		log.Debug().Str("user", user).Msg("Tail session ended")
+	}
+}
+
+// tailUser returns the name the tail sessions of a user are counted by.
+func tailUser(token OAuthToken) string {
+	switch {
+	case token.PreferredUsername != "":
+		return token.PreferredUsername
+	case token.Email != "":
+		return token.Email
+	default:
+		return token.Subject
+	}
+}
+
+// tailDeadline returns the time a tail session has to be closed at and the
+// reason sent to the client, which is the earlier of the expiry of the token
+// and the end of the maximum duration. The deadline is zero if neither is set.
+func tailDeadline(token OAuthToken, maxDuration time.Duration, now time.Time) (time.Time, string) {
+	var deadline time.Time
+	reason := ""
+	if maxDuration > 0 {
+		deadline, reason = now.Add(maxDuration), "maximum tail duration reached"
+	}
+	if token.ExpiresAt != nil && (deadline.IsZero() || token.ExpiresAt.Before(deadline)) {
+		deadline, reason = token.ExpiresAt.Time, "token expired"
+	}
+	return deadline, reason
+}
+
+// dialTail opens the WebSocket connection of the enforced tail request to
+// the Loki upstream. The headers of the client are forwarded except for those of the
+// WebSocket handshake, which the dialer sets itself.
+func dialTail(r *http.Request, up upstream, a *App) (*websocket.Conn, *http.Response, error) {
+	target := *up.url.JoinPath(r.URL.Path)
+	target.RawQuery = r.URL.RawQuery
+	switch target.Scheme {
+	case "https":
+		target.Scheme = "wss"
+	default:
+		target.Scheme = "ws"
+	}
+
+	upstreamRequest := (&http.Request{Header: r.Header.Clone()}).WithContext(r.Context())
+	for _, header := range []string{"Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Content-Length"} {
+		upstreamRequest.Header.Del(header)
+	}
+	setHeaders(upstreamRequest, up.tls, up.headers, a.ServiceAccountToken)
+
+	dialer := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 45 * time.Second,
+		TLSClientConfig:  http.DefaultTransport.(*http.Transport).TLSClientConfig,
+	}
+	if transport, ok := up.transport.(*http.Transport); ok {
+		dialer.TLSClientConfig = transport.TLSClientConfig
+	}
+	return dialer.DialContext(r.Context(), target.String(), upstreamRequest.Header)
+}
+
+// proxyTail copies the messages of a tail session between the client and
+// Loki until either side closes the connection, whose close message is passed
+// on to the other side, or the deadline is reached, which closes the session
+// with the reason.
+func proxyTail(client, upstream *websocket.Conn, deadline time.Time, reason string) {
+	defer client.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		copyMessages(client, upstream)
+		done <- struct{}{}
+	}()
+	go func() {
+		copyMessages(upstream, client)
+		done <- struct{}{}
+	}()
+
+	var expired <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-done:
+	case <-expired:
+		log.Debug().Str("reason", reason).Msg("Closing tail session")
+		closeTail(client, websocket.ClosePolicyViolation, reason)
+		closeTail(upstream, websocket.CloseNormalClosure, "")
+	}
+}
+
+// copyMessages copies the messages read from src to dst until src fails. If
+// src was closed with a close message, it is passed on to dst.
+func copyMessages(dst, src *websocket.Conn) {
+	for {
+		messageType, message, err := src.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseAbnormalClosure {
+				closeTail(dst, closeErr.Code, closeErr.Text)
+			} else {
+				closeTail(dst, websocket.CloseGoingAway, "")
+			}
+			return
+		}
+		if err := dst.WriteMessage(messageType, message); err != nil {
+			return
+		}
+	}
+}
+
+// closeTail sends a close message and closes the connection.
+func closeTail(conn *websocket.Conn, code int, text string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, text), time.Now().Add(tailWriteTimeout))
+	_ = conn.Close()
+}
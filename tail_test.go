@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTailDeadline(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	deadline, _ := tailDeadline(OAuthToken{}, 0, now)
+	assert.True(t, deadline.IsZero())
+
+	deadline, reason := tailDeadline(OAuthToken{}, time.Hour, now)
+	assert.Equal(t, now.Add(time.Hour), deadline)
+	assert.Equal(t, "maximum tail duration reached", reason)
+
+	token := OAuthToken{RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(now.Add(time.Minute))}}
+	deadline, reason = tailDeadline(token, time.Hour, now)
+	assert.Equal(t, now.Add(time.Minute), deadline)
+	assert.Equal(t, "token expired", reason)
+
+	deadline, reason = tailDeadline(token, time.Second, now)
+	assert.Equal(t, now.Add(time.Second), deadline)
+	assert.Equal(t, "maximum tail duration reached", reason)
+}
+
+func TestTailHandler(t *testing.T) {
+	app, tokens := setupTestMain()
+	queries := make(chan string, 10)
+	var orgID atomic.Value
+	upgrader := websocket.Upgrader{}
+	loki := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/loki/api/v1/tail", r.URL.Path)
+		queries <- r.URL.Query().Get("query")
+		orgID.Store(r.Header.Get(orgIDHeader))
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"streams":[]}`))
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	defer loki.Close()
+	app.Cfg.Loki.URL = loki.URL
+	app.Cfg.Loki.TenantLabel = "tenant_id"
+	app.Cfg.Loki.TailMaxSessions = 1
+	app.Cfg.Loki.TailMaxDuration = time.Minute
+	app.WithRoutes()
+	proxy := httptest.NewServer(app.e)
+	defer proxy.Close()
+
+	dial := func(query string) (*websocket.Conn, *http.Response, error) {
+		header := http.Header{"Authorization": {"Bearer " + tokens["userTenant"]}}
+		target := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/loki/api/v1/tail?query=" + query
+		return websocket.DefaultDialer.Dial(target, header)
+	}
+
+	t.Run("Forbidden", func(t *testing.T) {
+		_, resp, err := dial(`{tenant_id="other"}`)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("Enforced", func(t *testing.T) {
+		conn, _, err := dial(`{app="api"}`)
+		assert.NoError(t, err)
+		defer conn.Close()
+		assert.Equal(t, `{app="api", tenant_id=~"allowed_user|also_allowed_user"}`, <-queries)
+		_, message, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		assert.Equal(t, `{"streams":[]}`, string(message))
+
+		// the user is limited to a single session
+		_, resp, err := dial(`{app="api"}`)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	})
+
+	t.Run("MaxDuration", func(t *testing.T) {
+		app.Cfg.Loki.TailMaxDuration = 100 * time.Millisecond
+		defer func() { app.Cfg.Loki.TailMaxDuration = time.Minute }()
+
+		// the previous session is released once it is closed
+		var conn *websocket.Conn
+		assert.Eventually(t, func() bool {
+			var err error
+			conn, _, err = dial(`{app="api"}`)
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		defer conn.Close()
+		<-queries
+		_, _, err := conn.ReadMessage()
+		assert.NoError(t, err)
+		_, _, err = conn.ReadMessage()
+		closeErr, ok := err.(*websocket.CloseError)
+		assert.True(t, ok)
+		assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+		assert.Equal(t, "maximum tail duration reached", closeErr.Text)
+	})
+
+	t.Run("OrgID", func(t *testing.T) {
+		defer func() { app.Cfg.Loki.TenancyMode = "" }()
+		// the org ID of the client is never forwarded, the configured one is sent in label mode
+		for mode, expected := range map[TenancyMode]string{TenancyModeLabel: "application", TenancyModeOrgID: "allowed_user|also_allowed_user"} {
+			app.Cfg.Loki.TenancyMode = mode
+			app.WithRoutes()
+			orgIDProxy := httptest.NewServer(app.e)
+			header := http.Header{"Authorization": {"Bearer " + tokens["userTenant"]}, orgIDHeader: {"other"}}
+			target := "ws" + strings.TrimPrefix(orgIDProxy.URL, "http") + "/loki/api/v1/tail?query=" + `{app="api"}`
+			conn, _, err := websocket.DefaultDialer.Dial(target, header)
+			assert.NoError(t, err)
+			<-queries
+			assert.Equal(t, expected, orgID.Load(), mode)
+			_ = conn.Close()
+			orgIDProxy.Close()
+		}
+	})
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// TenancyMode selects how the tenants of a user are enforced on the requests
+// to a datasource: by the tenant label in queries and writes, by the
+// X-Scope-OrgID header of the native tenancy of Mimir, Cortex and Loki, or
+// by both.
+type TenancyMode string
+
+const (
+	// TenancyModeLabel enforces the tenant label, it is the default.
+	TenancyModeLabel TenancyMode = "label"
+	// TenancyModeOrgID sends the tenants of the user as org IDs instead of
+	// enforcing the tenant label.
+	TenancyModeOrgID TenancyMode = "org_id"
+	// TenancyModeLabelAndOrgID sends the org IDs and enforces the tenant label.
+	TenancyModeLabelAndOrgID TenancyMode = "label_and_org_id"
+)
+
+// orgIDHeader is the header Mimir, Cortex and Loki read the tenant of a
+// request from. Several tenants are joined with "|" for query federation.
+const orgIDHeader = "X-Scope-OrgID"
+
+// orgIDKey is the context key of the org ID resolved for a request.
+type orgIDKey struct{}
+
+// validate returns an error if the tenancy mode is unknown.
+func (m TenancyMode) validate() error {
+	switch m {
+	case "", TenancyModeLabel, TenancyModeOrgID, TenancyModeLabelAndOrgID:
+		return nil
+	}
+	return fmt.Errorf("unknown tenancy mode %s", m)
+}
+
+// usesOrgID reports whether the org IDs of the user are sent upstream.
+func (m TenancyMode) usesOrgID() bool {
+	return m == TenancyModeOrgID || m == TenancyModeLabelAndOrgID
+}
+
+// enforcesLabels reports whether the tenant label is enforced.
+func (m TenancyMode) enforcesLabels() bool {
+	return m != TenancyModeOrgID
+}
+
+// tenancyMode returns the tenancy mode of the datasource. Only the Thanos and
+// Loki configs select one, every other datasource enforces the tenant label.
+func (a *App) tenancyMode(datasource Datasource) TenancyMode {
+	switch datasource {
+	case DatasourceMetrics:
+		return a.Cfg.Thanos.TenancyMode
+	case DatasourceLogs:
+		return a.Cfg.Loki.TenancyMode
+	}
+	return TenancyModeLabel
+}
+
+// OrgID returns the org ID of the tenant labels: the allowed literal values,
+// sorted and joined with "|". Patterns, tuples and cluster-wide access cannot
+// be listed as org IDs and result in an error.
+func (t TenantLabels) OrgID() (string, error) {
+	if t.ClusterWide || len(t.Patterns) > 0 || len(t.Tuples) > 0 {
+		return "", errors.New("tenancy mode org_id requires literal tenant label values, patterns, tuples and cluster-wide access cannot be sent as org ID")
+	}
+	orgIDs := make([]string, 0, len(t.Values))
+	for value := range t.Values {
+		if !t.Allowed(value) {
+			continue
+		}
+		if value == "" || strings.Contains(value, "|") {
+			return "", fmt.Errorf("tenant label value %q is not a valid org ID", value)
+		}
+		orgIDs = append(orgIDs, value)
+	}
+	if len(orgIDs) == 0 {
+		return "", errors.New("no org ID allowed for user")
+	}
+	sort.Strings(orgIDs)
+	return strings.Join(orgIDs, "|"), nil
+}
+
+// applyTenancy applies the tenancy mode of the datasource to the request. The
+// X-Scope-OrgID header of the client is always removed, so only the
+// configured headers can set it in label mode. If the mode uses org IDs and
+// enforcement is not skipped for the user, the org ID of the tenant labels is
+// set on the returned request, setHeaders gives it precedence over the
+// configured headers. Users skipping enforcement get the configured header,
+// if any. It returns the request to forward and whether the tenant label has
+// to be enforced, which is neither the case if enforcement is skipped for the
+// user nor if the mode only uses org IDs. If the org ID cannot be resolved,
+// the error response is written and false is returned.
+func applyTenancy(w http.ResponseWriter, r *http.Request, datasource Datasource, labels TenantLabels, skip bool, a *App) (*http.Request, bool, bool) {
+	r.Header.Del(orgIDHeader)
+	mode := a.tenancyMode(datasource)
+	if !mode.usesOrgID() {
+		return r, !skip, true
+	}
+	if !skip {
+		orgID, err := labels.OrgID()
+		if err != nil {
+			logAndWriteError(w, http.StatusForbidden, err, "")
+			return r, false, false
+		}
+		r = r.WithContext(context.WithValue(r.Context(), orgIDKey{}, orgID))
+		r.Header.Set(orgIDHeader, orgID)
+	}
+	return r, !skip && mode.enforcesLabels(), true
+}
+
+// setOrgIDHeader sets the org ID resolved by applyTenancy for the request,
+// if any, overriding the configured headers.
+func setOrgIDHeader(r *http.Request) {
+	if orgID, ok := r.Context().Value(orgIDKey{}).(string); ok {
+		r.Header.Set(orgIDHeader, orgID)
+	}
+}
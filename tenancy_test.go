@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTenantLabelsOrgID(t *testing.T) {
+	excluded := NewTenantLabels("b", "a", "c")
+	excluded.Excluded = &TenantLabels{}
+	_ = excluded.Excluded.Add("c")
+
+	cases := []struct {
+		name   string
+		labels TenantLabels
+		orgID  string
+		err    bool
+	}{
+		{"Single", NewTenantLabels("a"), "a", false},
+		{"Federated", NewTenantLabels("b", "a"), "a|b", false},
+		{"Excluded", excluded, "a|b", false},
+		{"Pattern", NewTenantLabels("a", "team-*"), "", true},
+		{"Tuple", NewTenantLabels(`{cluster="prod", namespace="a"}`), "", true},
+		{"Cluster_wide", NewTenantLabels("#cluster-wide"), "", true},
+		{"Separator", NewTenantLabels("a|b"), "", true},
+		{"Empty", NewTenantLabels(), "", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			orgID, err := tc.labels.OrgID()
+			assert.Equal(t, tc.err, err != nil)
+			assert.Equal(t, tc.orgID, orgID)
+		})
+	}
+}
+
+func TestTenancyMode(t *testing.T) {
+	app, tokens := setupTestMain()
+	var orgID, query string
+	thanos := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		orgID = r.Header.Get(orgIDHeader)
+		query = r.URL.Query().Get("query")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = fmt.Fprint(w, `{"status":"success","data":{"resultType":"vector","result":[]}}`)
+	}))
+	defer thanos.Close()
+	app.Cfg.Thanos.URL = thanos.URL
+	app.Cfg.Thanos.Headers = map[string]string{"x-scope-orgid": "admin"}
+
+	serve := func(token string) *httptest.ResponseRecorder {
+		orgID, query = "", ""
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(`up`), nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[token])
+		req.Header.Set(orgIDHeader, "other")
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Label", func(t *testing.T) {
+		app.WithRoutes()
+		rr := serve("userTenant")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "admin", orgID)
+		assert.Equal(t, `up{tenant_id=~"allowed_user|also_allowed_user"}`, query)
+
+		// the org ID of the client is not forwarded
+		app.Cfg.Thanos.Headers = nil
+		app.WithRoutes()
+		defer func() { app.Cfg.Thanos.Headers = map[string]string{"x-scope-orgid": "admin"} }()
+		rr = serve("userTenant")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "", orgID)
+	})
+
+	t.Run("OrgID", func(t *testing.T) {
+		app.Cfg.Thanos.TenancyMode = TenancyModeOrgID
+		app.WithRoutes()
+		rr := serve("userTenant")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "allowed_user|also_allowed_user", orgID)
+		assert.Equal(t, `up`, query)
+
+		// users skipping enforcement get the configured org ID
+		app.Cfg.Admin.Bypass = true
+		app.Cfg.Admin.Group = "admins"
+		defer func() { app.Cfg.Admin.Bypass = false }()
+		rr = serve("adminUserToken")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "admin", orgID)
+	})
+
+	t.Run("LabelAndOrgID", func(t *testing.T) {
+		app.Cfg.Thanos.TenancyMode = TenancyModeLabelAndOrgID
+		app.WithRoutes()
+		rr := serve("groupTenant")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "allowed_group1|also_allowed_group1", orgID)
+		assert.Equal(t, `up{tenant_id=~"allowed_group1|also_allowed_group1"}`, query)
+	})
+}
+
+func TestApplyTenancy(t *testing.T) {
+	app, _ := setupTestMain()
+	app.Cfg.Thanos.TenancyMode = TenancyModeOrgID
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/query", nil)
+	ctx := req.Context()
+
+	applied, enforce, ok := applyTenancy(httptest.NewRecorder(), req, DatasourceMetrics, NewTenantLabels("a"), false, &app)
+	assert.True(t, ok)
+	assert.False(t, enforce)
+	assert.Equal(t, ctx, req.Context(), "the request of the caller is not replaced")
+	applied.Header.Del(orgIDHeader)
+	setOrgIDHeader(applied)
+	assert.Equal(t, "a", applied.Header.Get(orgIDHeader))
+}
@@ -0,0 +1,646 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// TenantLabels holds the tenant label values a user is allowed to query.
+// Literal values are kept in a map for fast lookups, while pattern grants
+// (globs like "team-a-*" or regular expressions like "^team-a-.*") are kept
+// as compiled regular expressions and are injected as regex matchers.
+// Tuples are grants spanning multiple labels, like
+// {cluster="prod-eu", namespace="payments"}, keyed by their canonical form.
+// ClusterWide grants every value, Excluded holds the values and patterns
+// that are denied even if another entry or ClusterWide grants them.
+type TenantLabels struct {
+	Values      map[string]bool
+	Patterns    map[string]*regexp.Regexp
+	Tuples      map[string][]*labels.Matcher
+	ClusterWide bool
+	Excluded    *TenantLabels
+}
+
+// NewTenantLabels creates TenantLabels from the given values. Values that are
+// patterns are compiled, invalid patterns are ignored.
+func NewTenantLabels(values ...string) TenantLabels {
+	t := TenantLabels{Values: make(map[string]bool, len(values))}
+	for _, value := range values {
+		_ = t.Add(value)
+	}
+	return t
+}
+
+// Add adds a literal value, a pattern or a tuple to the tenant labels.
+// The value "#cluster-wide" grants every value, values prefixed with "!" are
+// exclusions. It returns an error if the value cannot be parsed.
+func (t *TenantLabels) Add(value string) error {
+	if value == "#cluster-wide" {
+		t.ClusterWide = true
+		return nil
+	}
+	if strings.HasPrefix(value, "!") {
+		excluded := strings.TrimPrefix(value, "!")
+		if isTuple(excluded) || strings.HasPrefix(excluded, "!") || excluded == "#cluster-wide" {
+			return fmt.Errorf("invalid exclusion %s: only label values and patterns can be excluded", value)
+		}
+		if t.Excluded == nil {
+			t.Excluded = &TenantLabels{}
+		}
+		return t.Excluded.Add(excluded)
+	}
+	if isTuple(value) {
+		key, tuple, err := parseTuple(value)
+		if err != nil {
+			return err
+		}
+		if t.Tuples == nil {
+			t.Tuples = make(map[string][]*labels.Matcher)
+		}
+		t.Tuples[key] = tuple
+		return nil
+	}
+	if !isPattern(value) {
+		if t.Values == nil {
+			t.Values = make(map[string]bool)
+		}
+		t.Values[value] = true
+		return nil
+	}
+	expr, re, err := compilePattern(value)
+	if err != nil {
+		return err
+	}
+	if t.Patterns == nil {
+		t.Patterns = make(map[string]*regexp.Regexp)
+	}
+	t.Patterns[expr] = re
+	return nil
+}
+
+// Merge adds all values, patterns, tuples and exclusions of other to the tenant labels.
+func (t *TenantLabels) Merge(other TenantLabels) {
+	t.ClusterWide = t.ClusterWide || other.ClusterWide
+	if other.Excluded != nil {
+		if t.Excluded == nil {
+			t.Excluded = &TenantLabels{}
+		}
+		t.Excluded.Merge(*other.Excluded)
+	}
+	for value := range other.Values {
+		if t.Values == nil {
+			t.Values = make(map[string]bool)
+		}
+		t.Values[value] = true
+	}
+	for expr, re := range other.Patterns {
+		if t.Patterns == nil {
+			t.Patterns = make(map[string]*regexp.Regexp)
+		}
+		t.Patterns[expr] = re
+	}
+	for key, tuple := range other.Tuples {
+		if t.Tuples == nil {
+			t.Tuples = make(map[string][]*labels.Matcher)
+		}
+		t.Tuples[key] = tuple
+	}
+}
+
+// Empty reports whether the tenant labels grant no value at all.
+func (t TenantLabels) Empty() bool {
+	return !t.ClusterWide && len(t.Values) == 0 && len(t.Patterns) == 0 && len(t.Tuples) == 0
+}
+
+// Skip reports whether enforcement can be skipped, which is the case for
+// cluster-wide access without exclusions.
+func (t TenantLabels) Skip() bool {
+	return t.ClusterWide && t.Excluded == nil
+}
+
+// Allowed reports whether the given label value is granted, either by a
+// literal value, by one of the patterns or by cluster-wide access, and is
+// not excluded.
+func (t TenantLabels) Allowed(value string) bool {
+	if t.Excluded != nil && t.Excluded.Allowed(value) {
+		return false
+	}
+	if t.ClusterWide || t.Values[value] {
+		return true
+	}
+	for _, re := range t.Patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Strings returns the sorted literal values followed by the sorted pattern
+// expressions, the sorted tuples, cluster-wide access and the exclusions.
+func (t TenantLabels) Strings() []string {
+	values := MapKeysToArray(t.Values)
+	sort.Strings(values)
+	patterns := MapKeysToArray(t.Patterns)
+	sort.Strings(patterns)
+	tuples := MapKeysToArray(t.Tuples)
+	sort.Strings(tuples)
+	strs := append(append(values, patterns...), tuples...)
+	if t.ClusterWide {
+		strs = append(strs, "#cluster-wide")
+	}
+	if t.Excluded != nil {
+		for _, excluded := range t.Excluded.Strings() {
+			strs = append(strs, "!"+excluded)
+		}
+	}
+	return strs
+}
+
+// Matcher returns the label matcher that restricts the label name to the
+// granted values. A single literal value results in an equality matcher,
+// everything else in a regex matcher with the literal values escaped.
+func (t TenantLabels) Matcher(name string) *labels.Matcher {
+	if len(t.Values) == 1 && len(t.Patterns) == 0 {
+		return labels.MustNewMatcher(labels.MatchEqual, name, MapKeysToArray(t.Values)[0])
+	}
+	values := MapKeysToArray(t.Values)
+	sort.Strings(values)
+	for i, value := range values {
+		values[i] = regexp.QuoteMeta(value)
+	}
+	patterns := MapKeysToArray(t.Patterns)
+	sort.Strings(patterns)
+	return labels.MustNewMatcher(labels.MatchRegexp, name, strings.Join(append(values, patterns...), "|"))
+}
+
+// ExclusionMatcher returns the negative label matcher removing the excluded
+// values, or nil if nothing is excluded.
+func (t TenantLabels) ExclusionMatcher(name string) *labels.Matcher {
+	if t.Excluded == nil {
+		return nil
+	}
+	matcher := t.Excluded.Matcher(name)
+	if matcher.Type == labels.MatchEqual {
+		return labels.MustNewMatcher(labels.MatchNotEqual, name, matcher.Value)
+	}
+	return labels.MustNewMatcher(labels.MatchNotRegexp, name, matcher.Value)
+}
+
+// SelectorStrings returns the selectors selecting everything the tenant
+// labels grant, used for requests without a query. Cluster-wide access
+// selects every non-empty value, tuples may need more than one selector.
+func (t TenantLabels) SelectorStrings(name string) []string {
+	var selectors [][]*labels.Matcher
+	switch {
+	case t.ClusterWide:
+		selectors = [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, name, ".+")}}
+	case len(t.Tuples) > 0:
+		selectors = t.Selectors(name)
+	default:
+		selectors = [][]*labels.Matcher{{t.Matcher(name)}}
+	}
+	strs := make([]string, 0, len(selectors))
+	for _, selector := range selectors {
+		if exclusion := t.ExclusionMatcher(name); exclusion != nil {
+			selector = append(append([]*labels.Matcher{}, selector...), exclusion)
+		}
+		strs = append(strs, matchersString(selector))
+	}
+	return strs
+}
+
+// CheckExclusions returns an error if a positive matcher on the tenant label
+// explicitly asks for an excluded value.
+func (t TenantLabels) CheckExclusions(matchers []*labels.Matcher, name string) error {
+	if t.Excluded == nil {
+		return nil
+	}
+	for _, matcher := range matchers {
+		if matcher.Name != name {
+			continue
+		}
+		// regexes that cannot be enumerated are restricted by the exclusion matcher
+		values, _ := matcherValues(matcher)
+		for _, value := range values {
+			if t.Excluded.Allowed(value) {
+				return fmt.Errorf("user not allowed with tenant label %s", value)
+			}
+		}
+	}
+	return nil
+}
+
+// isPattern reports whether a labels.yaml key or value is a pattern. Values
+// starting with "^" are regular expressions, values containing "*" or "?"
+// are globs.
+func isPattern(value string) bool {
+	return strings.HasPrefix(value, "^") || strings.ContainsAny(value, "*?")
+}
+
+// compilePattern translates a glob or regular expression into an unanchored
+// regular expression usable in PromQL and LogQL regex matchers, and compiles
+// its fully anchored form for matching label values.
+func compilePattern(pattern string) (string, *regexp.Regexp, error) {
+	var expr string
+	if strings.HasPrefix(pattern, "^") {
+		expr = strings.TrimSuffix(strings.TrimPrefix(pattern, "^"), "$")
+	} else {
+		var sb strings.Builder
+		for _, r := range pattern {
+			switch r {
+			case '*':
+				sb.WriteString(".*")
+			case '?':
+				sb.WriteString(".")
+			default:
+				sb.WriteString(regexp.QuoteMeta(string(r)))
+			}
+		}
+		expr = sb.String()
+	}
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid pattern %s: %w", pattern, err)
+	}
+	return expr, re, nil
+}
+
+// isTuple reports whether a labels.yaml value is a tuple grant written as a
+// selector, e.g. {cluster="prod-eu", namespace="payments"}.
+func isTuple(value string) bool {
+	return strings.HasPrefix(value, "{")
+}
+
+// parseTuple parses a tuple grant into its matchers sorted by label name and
+// returns them along with their canonical form. Only equality and regex
+// matchers are allowed as a tuple grants label values.
+func parseTuple(value string) (string, []*labels.Matcher, error) {
+	matchers, err := parser.ParseMetricSelector(value)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid tuple %s: %w", value, err)
+	}
+	seen := make(map[string]bool, len(matchers))
+	for _, matcher := range matchers {
+		if matcher.Type != labels.MatchEqual && matcher.Type != labels.MatchRegexp {
+			return "", nil, fmt.Errorf("invalid tuple %s: only = and =~ matchers are allowed", value)
+		}
+		if seen[matcher.Name] {
+			return "", nil, fmt.Errorf("invalid tuple %s: duplicate label %s", value, matcher.Name)
+		}
+		seen[matcher.Name] = true
+	}
+	sort.Slice(matchers, func(i, j int) bool { return matchers[i].Name < matchers[j].Name })
+	return matchersString(matchers), matchers, nil
+}
+
+// matchersString renders matchers as a selector.
+func matchersString(matchers []*labels.Matcher) string {
+	parts := make([]string, 0, len(matchers))
+	for _, matcher := range matchers {
+		parts = append(parts, matcher.String())
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// Selectors returns the union of label combinations the tenant labels grant,
+// one matcher list per alternative. Literal values and patterns form one
+// alternative on the tenant label. Tuples that only differ in the tenant
+// label are merged into one alternative, so a query is only split where the
+// grants cannot be expressed as a single selector.
+func (t TenantLabels) Selectors(tenantLabel string) [][]*labels.Matcher {
+	type group struct {
+		rest   []*labels.Matcher
+		values TenantLabels
+	}
+	groups := make(map[string]*group)
+	if len(t.Values) > 0 || len(t.Patterns) > 0 {
+		values := NewTenantLabels()
+		values.Merge(TenantLabels{Values: t.Values, Patterns: t.Patterns})
+		groups[""] = &group{values: values}
+	}
+	var selectors [][]*labels.Matcher
+	for _, key := range sortedKeys(t.Tuples) {
+		tuple := t.Tuples[key]
+		var tenant *labels.Matcher
+		var rest []*labels.Matcher
+		for _, matcher := range tuple {
+			if matcher.Name == tenantLabel {
+				tenant = matcher
+				continue
+			}
+			rest = append(rest, matcher)
+		}
+		if tenant == nil {
+			selectors = append(selectors, tuple)
+			continue
+		}
+		restKey := ""
+		if len(rest) > 0 {
+			restKey = matchersString(rest)
+		}
+		g, ok := groups[restKey]
+		if !ok {
+			g = &group{rest: rest}
+			groups[restKey] = g
+		}
+		value := tenant.Value
+		if tenant.Type == labels.MatchRegexp {
+			value = "^" + value
+		}
+		if err := g.values.Add(value); err != nil {
+			selectors = append(selectors, tuple)
+		}
+	}
+	var merged [][]*labels.Matcher
+	for _, key := range sortedKeys(groups) {
+		g := groups[key]
+		merged = append(merged, append(append([]*labels.Matcher{}, g.rest...), g.values.Matcher(tenantLabel)))
+	}
+	return append(merged, selectors...)
+}
+
+// RestrictSelectors returns the matcher lists a selector of a query has to be
+// replaced with so that it only selects granted label combinations. The
+// query's matchers are combined with every granted alternative they can
+// match, alternatives contradicting the query are dropped. An error is
+// returned if the query asks for a label value no alternative grants, or has
+// a regex whose values cannot be enumerated on a label the grants restrict.
+func RestrictSelectors(queryMatchers []*labels.Matcher, selectors [][]*labels.Matcher) ([][]*labels.Matcher, error) {
+	for _, query := range queryMatchers {
+		values, ok := matcherValues(query)
+		if !ok {
+			if selectorsRestrict(selectors, query.Name) {
+				return nil, fmt.Errorf("regex %s cannot be checked against the tenant labels, list the values of %s as alternatives", query, query.Name)
+			}
+			continue
+		}
+		for _, value := range values {
+			if !anySelectorAllows(selectors, query.Name, value) {
+				return nil, fmt.Errorf("user not allowed with tenant label %s", value)
+			}
+		}
+	}
+
+	var restricted [][]*labels.Matcher
+	for _, selector := range selectors {
+		matchers := append([]*labels.Matcher{}, queryMatchers...)
+		compatible := true
+		for _, granted := range selector {
+			redundant := false
+			for _, query := range queryMatchers {
+				if query.Name != granted.Name {
+					continue
+				}
+				values, _ := matcherValues(query)
+				if values == nil {
+					continue
+				}
+				if !slices.ContainsFunc(values, granted.Matches) {
+					compatible = false
+				}
+				redundant = redundant || query.Type == labels.MatchEqual
+			}
+			if !redundant {
+				matchers = append(matchers, granted)
+			}
+		}
+		if compatible {
+			restricted = append(restricted, matchers)
+		}
+	}
+	if len(restricted) == 0 {
+		return nil, fmt.Errorf("user not allowed with tenant labels %s", matchersString(queryMatchers))
+	}
+	return restricted, nil
+}
+
+// RestrictSelector restricts the matchers of a single selector, which cannot
+// be replaced with a union of selectors, to the tenant labels: exclusions are
+// checked, tuple grants have to be narrowed to one alternative by the
+// matchers, other grants restrict the selector like RestrictMatchers and the
+// exclusion matcher is appended.
+func (t TenantLabels) RestrictSelector(matchers []*labels.Matcher, name string) ([]*labels.Matcher, error) {
+	if err := t.CheckExclusions(matchers, name); err != nil {
+		return nil, err
+	}
+	switch {
+	case t.ClusterWide:
+		// every value except the exclusions is granted
+	case len(t.Tuples) > 0:
+		restricted, err := RestrictSelectors(matchers, t.Selectors(name))
+		if err != nil {
+			return nil, err
+		}
+		if len(restricted) > 1 {
+			return nil, fmt.Errorf("selector %s matches multiple tuple grants, add a matcher selecting one of them", matchersString(matchers))
+		}
+		matchers = restricted[0]
+	default:
+		var err error
+		matchers, err = t.RestrictMatchers(matchers, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if exclusion := t.ExclusionMatcher(name); exclusion != nil {
+		matchers = append(matchers, exclusion)
+	}
+	return matchers, nil
+}
+
+// RestrictMatchers restricts the matchers of a selector to the granted values
+// of the tenant label. Equality matchers have to ask for a granted value.
+// Regex matchers listing alternatives have to ask for granted values only,
+// other regex matchers are intersected with the granted values. Negative
+// matchers are kept, but do not restrict the selector to granted values, so
+// the tenant label matcher is added unless a positive matcher restricts it.
+func (t TenantLabels) RestrictMatchers(matchers []*labels.Matcher, name string) ([]*labels.Matcher, error) {
+	restricted := make([]*labels.Matcher, 0, len(matchers)+1)
+	positive := false
+	for _, matcher := range matchers {
+		if matcher.Name != name {
+			restricted = append(restricted, matcher)
+			continue
+		}
+		switch matcher.Type {
+		case labels.MatchEqual:
+			if !t.Allowed(matcher.Value) {
+				return nil, unauthorizedLabelError(matcher.Value)
+			}
+			restricted = append(restricted, matcher)
+			positive = true
+		case labels.MatchRegexp:
+			intersection, err := t.intersect(matcher)
+			if err != nil {
+				return nil, err
+			}
+			restricted = append(restricted, intersection...)
+			positive = true
+		default:
+			restricted = append(restricted, matcher)
+		}
+	}
+	if !positive {
+		restricted = append(restricted, t.Matcher(name))
+	}
+	return restricted, nil
+}
+
+// intersect returns the matchers selecting the granted values a regex matcher
+// selects. A regex listing alternatives is kept if every alternative is
+// granted. Any other regex is evaluated against the granted literal values
+// and replaced with the ones it matches. Pattern grants cannot be enumerated,
+// so with pattern grants the regex is kept and combined with the granted
+// values and patterns.
+func (t TenantLabels) intersect(matcher *labels.Matcher) ([]*labels.Matcher, error) {
+	if alternatives := matcher.SetMatches(); len(alternatives) > 0 {
+		for _, value := range alternatives {
+			if !t.Allowed(value) {
+				return nil, unauthorizedLabelError(value)
+			}
+		}
+		return []*labels.Matcher{matcher}, nil
+	}
+
+	granted := TenantLabels{Values: make(map[string]bool), Patterns: t.Patterns}
+	for value := range t.Values {
+		if matcher.Matches(value) && t.Allowed(value) {
+			granted.Values[value] = true
+		}
+	}
+	switch {
+	case len(granted.Patterns) > 0:
+		return []*labels.Matcher{matcher, granted.Matcher(matcher.Name)}, nil
+	case len(granted.Values) == 0:
+		return nil, unauthorizedLabelError(matcher.Value)
+	default:
+		return []*labels.Matcher{granted.Matcher(matcher.Name)}, nil
+	}
+}
+
+// AllowsLabelSet reports whether the tenant labels grant a label set, e.g.
+// the labels of an alert, considering tuples and exclusions.
+func (t TenantLabels) AllowsLabelSet(set map[string]string, name string) bool {
+	if t.Excluded != nil && t.Excluded.Allowed(set[name]) {
+		return false
+	}
+	if t.ClusterWide {
+		return true
+	}
+	for _, selector := range t.Selectors(name) {
+		if !slices.ContainsFunc(selector, func(granted *labels.Matcher) bool { return !granted.Matches(set[granted.Name]) }) {
+			return true
+		}
+	}
+	return false
+}
+
+// Confines returns an error unless the matchers, e.g. of a silence, only
+// select label sets the tenant labels grant. The tenant label values they
+// select have to be enumerable, so the matchers need an equality matcher or
+// a regex matcher listing alternatives on the tenant label, and on every
+// other label of a tuple grant.
+func (t TenantLabels) Confines(matchers []*labels.Matcher, name string) error {
+	enumerated := make(map[string][]string)
+	for _, matcher := range matchers {
+		if _, ok := enumerated[matcher.Name]; ok {
+			continue
+		}
+		switch matcher.Type {
+		case labels.MatchEqual:
+			enumerated[matcher.Name] = []string{matcher.Value}
+		case labels.MatchRegexp:
+			if values := matcher.SetMatches(); len(values) > 0 {
+				enumerated[matcher.Name] = values
+			}
+		}
+	}
+	values, ok := enumerated[name]
+	if !ok {
+		return fmt.Errorf("matchers %s have to select values of %s", matchersString(matchers), name)
+	}
+	for _, value := range values {
+		if t.Excluded != nil && t.Excluded.Allowed(value) {
+			return unauthorizedLabelError(value)
+		}
+	}
+	if t.ClusterWide {
+		return nil
+	}
+	for _, selector := range t.Selectors(name) {
+		confined := true
+		for _, granted := range selector {
+			values, ok := enumerated[granted.Name]
+			confined = confined && ok && !slices.ContainsFunc(values, func(value string) bool { return !granted.Matches(value) })
+		}
+		if confined {
+			return nil
+		}
+	}
+	return fmt.Errorf("matchers %s are not confined to the tenant labels of the user", matchersString(matchers))
+}
+
+// unauthorizedLabelError is returned by RestrictMatchers for a tenant label
+// value that is not granted.
+type unauthorizedLabelError string
+
+func (e unauthorizedLabelError) Error() string {
+	return fmt.Sprintf("user not allowed with tenant label %s", string(e))
+}
+
+// matcherValues returns the values a positive matcher asks for, the
+// alternatives of a regex matcher like in intersect. It returns nil for
+// negative matchers and false for regexes whose values cannot be enumerated,
+// e.g. "pay.*|billing".
+func matcherValues(matcher *labels.Matcher) ([]string, bool) {
+	switch matcher.Type {
+	case labels.MatchEqual:
+		return []string{matcher.Value}, true
+	case labels.MatchRegexp:
+		values := matcher.SetMatches()
+		return values, len(values) > 0
+	default:
+		return nil, true
+	}
+}
+
+// selectorsRestrict reports whether one of the alternatives has a matcher on
+// the label.
+func selectorsRestrict(selectors [][]*labels.Matcher, name string) bool {
+	for _, selector := range selectors {
+		if slices.ContainsFunc(selector, func(granted *labels.Matcher) bool { return granted.Name == name }) {
+			return true
+		}
+	}
+	return false
+}
+
+// anySelectorAllows reports whether at least one alternative either does not
+// restrict the label or grants the value for it.
+func anySelectorAllows(selectors [][]*labels.Matcher, name, value string) bool {
+	for _, selector := range selectors {
+		allowed := true
+		for _, granted := range selector {
+			if granted.Name == name && !granted.Matches(value) {
+				allowed = false
+			}
+		}
+		if allowed {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := MapKeysToArray(m)
+	sort.Strings(keys)
+	return keys
+}
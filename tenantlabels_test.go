@@ -0,0 +1,251 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompilePattern(t *testing.T) {
+	cases := []struct {
+		name     string
+		pattern  string
+		expected string
+		matches  []string
+		misses   []string
+		wantErr  bool
+	}{
+		{
+			name:     "Glob",
+			pattern:  "team-a-*",
+			expected: "team-a-.*",
+			matches:  []string{"team-a-", "team-a-frontend"},
+			misses:   []string{"team-b-frontend", "xteam-a-frontend"},
+		},
+		{
+			name:     "Glob with single character and dots",
+			pattern:  "team.?",
+			expected: "team\\..",
+			matches:  []string{"team.a"},
+			misses:   []string{"teamxa", "team.ab"},
+		},
+		{
+			name:     "Regex",
+			pattern:  "^sre-.*",
+			expected: "sre-.*",
+			matches:  []string{"sre-oncall"},
+			misses:   []string{"not-sre-oncall"},
+		},
+		{
+			name:     "Anchored regex",
+			pattern:  "^(dev|prod)$",
+			expected: "(dev|prod)",
+			matches:  []string{"dev", "prod"},
+			misses:   []string{"devprod", "test"},
+		},
+		{
+			name:    "Invalid regex",
+			pattern: "^sre-(",
+			wantErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, re, err := compilePattern(tc.pattern)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, expr)
+			for _, m := range tc.matches {
+				assert.True(t, re.MatchString(m), m)
+			}
+			for _, m := range tc.misses {
+				assert.False(t, re.MatchString(m), m)
+			}
+		})
+	}
+}
+
+func TestTenantLabels(t *testing.T) {
+	a := assert.New(t)
+
+	tl := NewTenantLabels("payments", "team-a-*", "web.shop")
+	a.Equal(map[string]bool{"payments": true, "web.shop": true}, tl.Values)
+	a.Len(tl.Patterns, 1)
+	a.False(tl.Empty())
+
+	a.True(tl.Allowed("payments"))
+	a.True(tl.Allowed("team-a-frontend"))
+	a.True(tl.Allowed("web.shop"))
+	a.False(tl.Allowed("webxshop"))
+	a.False(tl.Allowed("team-b-frontend"))
+
+	a.Equal(`namespace=~"payments|web\\.shop|team-a-.*"`, tl.Matcher("namespace").String())
+	a.Equal(`namespace="payments"`, NewTenantLabels("payments").Matcher("namespace").String())
+	a.Equal([]string{"payments", "web.shop", "team-a-.*"}, tl.Strings())
+
+	merged := NewTenantLabels("other")
+	merged.Merge(tl)
+	a.True(merged.Allowed("other"))
+	a.True(merged.Allowed("team-a-backend"))
+
+	// merged literal values stay literal
+	merged = NewTenantLabels()
+	merged.Merge(TenantLabels{Values: map[string]bool{"!payments": true, "team-b-*": true}})
+	a.Equal(map[string]bool{"!payments": true, "team-b-*": true}, merged.Values)
+	a.Nil(merged.Excluded)
+	a.Empty(merged.Patterns)
+
+	a.True(NewTenantLabels().Empty())
+	a.Error((&TenantLabels{}).Add("^("))
+}
+
+func TestTenantLabelsSelectors(t *testing.T) {
+	a := assert.New(t)
+
+	tl := NewTenantLabels(
+		`{cluster="prod-eu", namespace="payments"}`,
+		`{namespace="billing", cluster="prod-eu"}`,
+		`{cluster="prod-us", namespace=~"team-a-.*"}`,
+		`{cluster="dev"}`,
+		"shared",
+	)
+	a.Len(tl.Tuples, 4)
+	a.Contains(tl.Strings(), `{cluster="prod-eu", namespace="billing"}`)
+
+	var selectors []string
+	for _, selector := range tl.Selectors("namespace") {
+		selectors = append(selectors, matchersString(selector))
+	}
+	a.Equal([]string{
+		`{namespace="shared"}`,
+		`{cluster="prod-eu", namespace=~"billing|payments"}`,
+		`{cluster="prod-us", namespace=~"team-a-.*"}`,
+		`{cluster="dev"}`,
+	}, selectors)
+
+	a.Error((&TenantLabels{}).Add(`{cluster!="prod"}`))
+	a.Error((&TenantLabels{}).Add(`{cluster="a", cluster="b"}`))
+	a.Error((&TenantLabels{}).Add(`{cluster=}`))
+}
+
+func TestRestrictSelectors(t *testing.T) {
+	selectors := NewTenantLabels(
+		`{cluster="prod-eu", namespace="payments"}`,
+		`{cluster="prod-us", namespace="billing"}`,
+	).Selectors("namespace")
+
+	cases := []struct {
+		name     string
+		query    string
+		expected []string
+		wantErr  bool
+	}{
+		{
+			name:     "No tenant matchers",
+			query:    `{job="api"}`,
+			expected: []string{`{job="api", cluster="prod-eu", namespace="payments"}`, `{job="api", cluster="prod-us", namespace="billing"}`},
+		},
+		{
+			name:     "Narrowed by cluster",
+			query:    `{cluster="prod-us"}`,
+			expected: []string{`{cluster="prod-us", namespace="billing"}`},
+		},
+		{
+			name:    "Narrowed by namespace regex",
+			query:   `{namespace=~"payments|other"}`,
+			wantErr: true,
+		},
+		{
+			name:    "Narrowed by namespace alternatives",
+			query:   `{namespace=~"billing|other-billing"}`,
+			wantErr: true,
+		},
+		{
+			name:     "Narrowed by granted namespace alternatives",
+			query:    `{namespace=~"payments|billing", cluster="prod-eu"}`,
+			expected: []string{`{namespace=~"payments|billing", cluster="prod-eu", namespace="payments"}`},
+		},
+		{
+			name:    "Regex alternatives that cannot be enumerated",
+			query:   `{namespace=~"pay.*|billing"}`,
+			wantErr: true,
+		},
+		{
+			name:     "Regex on a label the grants do not restrict",
+			query:    `{job=~"api.*|web"}`,
+			expected: []string{`{job=~"api.*|web", cluster="prod-eu", namespace="payments"}`, `{job=~"api.*|web", cluster="prod-us", namespace="billing"}`},
+		},
+		{
+			name:    "Not granted combination",
+			query:   `{cluster="prod-eu", namespace="billing"}`,
+			wantErr: true,
+		},
+		{
+			name:     "Negative matchers are kept",
+			query:    `{cluster!="prod-eu"}`,
+			expected: []string{`{cluster!="prod-eu", cluster="prod-eu", namespace="payments"}`, `{cluster!="prod-eu", cluster="prod-us", namespace="billing"}`},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			matchers, err := parser.ParseMetricSelector(tc.query)
+			assert.NoError(t, err)
+			restricted, err := RestrictSelectors(matchers, selectors)
+			if tc.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			var got []string
+			for _, r := range restricted {
+				got = append(got, matchersString(r))
+			}
+			assert.Equal(t, tc.expected, got)
+		})
+	}
+}
+
+func TestTenantLabelsExclusions(t *testing.T) {
+	a := assert.New(t)
+
+	tl := NewTenantLabels("#cluster-wide", "!vault", "!kube-*")
+	a.False(tl.Empty())
+	a.False(tl.Skip())
+	a.True(tl.Allowed("payments"))
+	a.False(tl.Allowed("vault"))
+	a.False(tl.Allowed("kube-system"))
+	a.Equal([]string{"#cluster-wide", "!vault", "!kube-.*"}, tl.Strings())
+	a.Equal(`namespace!~"vault|kube-.*"`, tl.ExclusionMatcher("namespace").String())
+	a.Equal([]string{`{namespace=~".+", namespace!~"vault|kube-.*"}`}, tl.SelectorStrings("namespace"))
+
+	for query, allowed := range map[string]bool{
+		`{namespace=~"payments|web"}`:         true,
+		`{namespace!="vault"}`:                true,
+		`{namespace="vault"}`:                 false,
+		`{namespace=~"payments|kube-system"}`: false,
+	} {
+		matchers, err := parser.ParseMetricSelector(query)
+		a.NoError(err)
+		a.Equal(allowed, tl.CheckExclusions(matchers, "namespace") == nil, query)
+	}
+
+	a.True(NewTenantLabels("#cluster-wide").Skip())
+	a.Nil(NewTenantLabels("payments").ExclusionMatcher("namespace"))
+
+	// deny wins over grants of other entries
+	merged := NewTenantLabels("payments", "vault")
+	merged.Merge(NewTenantLabels("!vault"))
+	a.True(merged.Allowed("payments"))
+	a.False(merged.Allowed("vault"))
+	a.Equal(`namespace!="vault"`, merged.ExclusionMatcher("namespace").String())
+
+	for _, invalid := range []string{"!!vault", "!#cluster-wide", `!{cluster="prod"}`} {
+		a.Error((&TenantLabels{}).Add(invalid), invalid)
+	}
+}
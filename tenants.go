@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// tenantsKey is the top level key of labels.yaml holding the tenant hierarchy.
+const tenantsKey = "#tenants"
+
+// tenantRefPrefix marks label values referencing a node of the tenant
+// hierarchy, e.g. "#tenant acme".
+const tenantRefPrefix = "#tenant "
+
+// TenantHierarchy maps every node of the tenant hierarchy to the flattened
+// label values of the node and all of its descendants.
+//
+// Nodes are defined under the '#tenants' key of labels.yaml, each with
+// optional children and label values. Nodes can be children of several
+// parents and are granted with '#tenant <node>'.
+type TenantHierarchy map[string][]string
+
+// parseTenants parses and flattens the tenant hierarchy of the raw labels.yaml
+// content. It returns an error for unknown keys, unknown children, invalid
+// label values and cycles.
+func parseTenants(raw map[string]map[string]any, namespaces *NamespaceInformer) (TenantHierarchy, error) {
+	children := make(map[string][]string)
+	labels := make(map[string][]string)
+	for node, value := range raw[tenantsKey] {
+		definition, ok := value.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("invalid definition of tenant %s", node)
+		}
+		children[node] = nil
+		for key, items := range definition {
+			values, err := stringList(items)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s of tenant %s: %w", key, node, err)
+			}
+			switch key {
+			case "children":
+				children[node] = values
+			case "labels":
+				for _, label := range values {
+					if isTenantRef(label) {
+						return nil, fmt.Errorf("invalid label %s of tenant %s: use children to reference tenants", label, node)
+					}
+					if err := validateLabel(label, namespaces); err != nil {
+						return nil, err
+					}
+				}
+				labels[node] = values
+			default:
+				return nil, fmt.Errorf("unknown key %s of tenant %s", key, node)
+			}
+		}
+	}
+	for node, nodeChildren := range children {
+		for _, child := range nodeChildren {
+			if _, ok := children[child]; !ok {
+				return nil, fmt.Errorf("unknown child %s of tenant %s", child, node)
+			}
+		}
+	}
+
+	hierarchy := make(TenantHierarchy, len(children))
+	var flatten func(node string, path []string) ([]string, error)
+	flatten = func(node string, path []string) ([]string, error) {
+		if flattened, ok := hierarchy[node]; ok {
+			return flattened, nil
+		}
+		if slices.Contains(path, node) {
+			return nil, fmt.Errorf("cycle in tenant hierarchy: %s", strings.Join(append(path, node), " -> "))
+		}
+		values := make(map[string]bool)
+		for _, label := range labels[node] {
+			values[label] = true
+		}
+		for _, child := range children[node] {
+			flattened, err := flatten(child, append(path, node))
+			if err != nil {
+				return nil, err
+			}
+			for _, label := range flattened {
+				values[label] = true
+			}
+		}
+		flattened := MapKeysToArray(values)
+		sort.Strings(flattened)
+		hierarchy[node] = flattened
+		return flattened, nil
+	}
+	for _, node := range sortedKeys(children) {
+		if _, err := flatten(node, nil); err != nil {
+			return nil, err
+		}
+	}
+	return hierarchy, nil
+}
+
+// isTenantRef reports whether a label value references a tenant, optionally
+// prefixed with "!" for an exclusion.
+func isTenantRef(value string) bool {
+	return strings.HasPrefix(strings.TrimPrefix(value, "!"), tenantRefPrefix)
+}
+
+// Expand returns the label values granted by a label value. A tenant
+// reference is replaced with the flattened label values of the tenant,
+// excluded ones if the reference is an exclusion. Other values are returned
+// as they are.
+func (h TenantHierarchy) Expand(value string) ([]string, error) {
+	if !isTenantRef(value) {
+		return []string{value}, nil
+	}
+	prefix := ""
+	if strings.HasPrefix(value, "!") {
+		prefix = "!"
+	}
+	flattened, ok := h[strings.TrimPrefix(value, prefix+tenantRefPrefix)]
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant in %s", value)
+	}
+	values := make([]string, len(flattened))
+	for i, label := range flattened {
+		values[i] = prefix + label
+	}
+	return values, nil
+}
+
+// validateGrants returns an error if a grant references an unknown tenant.
+func (h TenantHierarchy) validateGrants(labels map[string]map[string]bool, scoped map[Datasource]map[string]map[string]bool) error {
+	all := []map[string]map[string]bool{labels}
+	for _, datasourceLabels := range scoped {
+		all = append(all, datasourceLabels)
+	}
+	for _, subjects := range all {
+		for subject, values := range subjects {
+			for value := range values {
+				if _, err := h.Expand(value); err != nil {
+					return fmt.Errorf("invalid label of %s: %w", subject, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// stringList converts a YAML list of strings.
+func stringList(value any) ([]string, error) {
+	items, ok := value.([]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a list")
+	}
+	values := make([]string, 0, len(items))
+	for _, item := range items {
+		s, ok := item.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected a list of strings")
+		}
+		values = append(values, s)
+	}
+	return values, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTenants(t *testing.T) {
+	raw := map[string]map[string]any{
+		tenantsKey: {
+			"acme": map[string]any{
+				"children": []any{"team-payments", "team-shop"},
+			},
+			"team-payments": map[string]any{
+				"labels":   []any{"payments", "payments-dev"},
+				"children": []any{"shared"},
+			},
+			"team-shop": map[string]any{
+				"labels":   []any{"shop-*"},
+				"children": []any{"shared"},
+			},
+			"shared": map[string]any{
+				"labels": []any{"monitoring"},
+			},
+		},
+		"acme-admins": {"#tenant acme": true},
+	}
+	tenants, err := parseTenants(raw, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, TenantHierarchy{
+		"acme":          {"monitoring", "payments", "payments-dev", "shop-*"},
+		"team-payments": {"monitoring", "payments", "payments-dev"},
+		"team-shop":     {"monitoring", "shop-*"},
+		"shared":        {"monitoring"},
+	}, tenants)
+
+	expanded, err := tenants.Expand("!#tenant team-shop")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"!monitoring", "!shop-*"}, expanded)
+	expanded, err = tenants.Expand("payments")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"payments"}, expanded)
+	_, err = tenants.Expand("#tenant unknown")
+	assert.Error(t, err)
+
+	assert.NoError(t, tenants.validateGrants(map[string]map[string]bool{"acme-admins": {"#tenant acme": true}}, nil))
+	assert.Error(t, tenants.validateGrants(nil, map[Datasource]map[string]map[string]bool{
+		DatasourceLogs: {"group": {"#tenant unknown": true}},
+	}))
+
+	cases := []struct {
+		name    string
+		tenants map[string]any
+	}{
+		{
+			name: "Cycle",
+			tenants: map[string]any{
+				"a": map[string]any{"children": []any{"b"}},
+				"b": map[string]any{"children": []any{"c"}},
+				"c": map[string]any{"children": []any{"a"}},
+			},
+		},
+		{
+			name:    "Self reference",
+			tenants: map[string]any{"a": map[string]any{"children": []any{"a"}}},
+		},
+		{
+			name:    "Unknown child",
+			tenants: map[string]any{"a": map[string]any{"children": []any{"b"}}},
+		},
+		{
+			name:    "Unknown key",
+			tenants: map[string]any{"a": map[string]any{"namespaces": []any{"b"}}},
+		},
+		{
+			name:    "Invalid label",
+			tenants: map[string]any{"a": map[string]any{"labels": []any{"^a-("}}},
+		},
+		{
+			name:    "Tenant reference as label",
+			tenants: map[string]any{"a": map[string]any{"labels": []any{"#tenant b"}}, "b": map[string]any{}},
+		},
+		{
+			name:    "No list",
+			tenants: map[string]any{"a": map[string]any{"labels": "payments"}},
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseTenants(map[string]map[string]any{tenantsKey: tc.tenants}, nil)
+			assert.Error(t, err)
+		})
+	}
+}
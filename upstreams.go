@@ -0,0 +1,705 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+
+	logqlv2 "github.com/observatorium/api/logql/v2"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// upstream is an upstream requests of a datasource can be sent to. Upstreams
+// with mutual TLS have their own transport presenting their own client
+// certificate, the others use the default transport.
+type upstream struct {
+	url       *url.URL
+	tls       bool
+	headers   map[string]string
+	tenants   TenantLabels
+	groups    []string
+	transport http.RoundTripper
+}
+
+// reverseProxy returns a reverse proxy to the upstream.
+func (up upstream) reverseProxy() *httputil.ReverseProxy {
+	proxy := httputil.NewSingleHostReverseProxy(up.url)
+	if up.transport != nil {
+		proxy.Transport = up.transport
+	}
+	return proxy
+}
+
+// client returns the HTTP client of the upstream.
+func (up upstream) client() *http.Client {
+	if up.transport == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: up.transport}
+}
+
+// upstreamRouter routes the requests of a datasource to the upstreams serving
+// the tenants they select. Tenants that are not routed to another upstream
+// are served by the default upstream of the user, the upstream of one of the
+// groups of the user or the fallback, the URL of the datasource. Queries
+// selecting tenants of several upstreams are sent to each of them and their
+// responses are merged, unless fan-out is rejected.
+type upstreamRouter struct {
+	fallback     upstream
+	upstreams    []upstream
+	rejectFanOut bool
+}
+
+// newUpstreamRouter returns the upstreamRouter of the fallback of a
+// datasource and the additional upstreams configured for it. The requests
+// to an upstream are sent to the URL urlOf returns for its config, e.g. its
+// remote write URL, or to the URL of the config if urlOf is nil. Upstreams
+// without such URL have none and cannot serve requests, see single.
+func newUpstreamRouter(fallback upstream, configs []UpstreamConfig, urlOf func(UpstreamConfig) string, rejectFanOut bool) *upstreamRouter {
+	router := &upstreamRouter{fallback: fallback, rejectFanOut: rejectFanOut}
+	for _, config := range configs {
+		tenants := NewTenantLabels()
+		for _, tenant := range config.Tenants {
+			if err := tenants.Add(tenant); err != nil {
+				log.Fatal().Err(err).Str("url", config.URL).Msg("Error parsing upstream tenants")
+			}
+		}
+		rawURL := config.URL
+		if urlOf != nil {
+			rawURL = urlOf(config)
+		}
+		var upstreamURL *url.URL
+		if rawURL != "" {
+			upstreamURL = parseUpstreamURL(rawURL)
+		}
+		router.upstreams = append(router.upstreams, upstream{
+			url:       upstreamURL,
+			tls:       config.UseMutualTLS,
+			headers:   config.Headers,
+			tenants:   tenants,
+			groups:    config.Groups,
+			transport: newUpstreamTransport(config),
+		})
+	}
+	return router
+}
+
+// newUpstreamTransport returns the transport of an upstream with mutual TLS,
+// a copy of the default transport whose TLS config only holds the client
+// certificate of the upstream. A shared TLS config would present the first
+// certificate the server accepts, which is not necessarily the upstream's.
+// Upstreams without mutual TLS use the default transport, nil is returned.
+func newUpstreamTransport(config UpstreamConfig) http.RoundTripper {
+	if !config.UseMutualTLS {
+		return nil
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = nil
+	cert, err := tls.LoadX509KeyPair(config.Cert, config.Key)
+	if err != nil {
+		log.Error().Err(err).Str("url", config.URL).Msg("Error while loading upstream certificate")
+		return transport
+	}
+	log.Debug().Str("path", config.Cert).Str("url", config.URL).Msg("Adding upstream certificate")
+	transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+	return transport
+}
+
+func parseUpstreamURL(rawURL string) *url.URL {
+	upstreamURL, err := url.Parse(rawURL)
+	if err != nil {
+		log.Fatal().Err(err).Str("url", rawURL).Msg("Error parsing URL")
+	}
+	return upstreamURL
+}
+
+// thanosUpstreams returns the upstreamRouter of the Thanos config.
+func (a *App) thanosUpstreams() *upstreamRouter {
+	fallback := upstream{url: parseUpstreamURL(a.Cfg.Thanos.URL), tls: a.Cfg.Thanos.UseMutualTLS, headers: a.Cfg.Thanos.Headers}
+	return newUpstreamRouter(fallback, a.Cfg.Thanos.Upstreams, nil, a.Cfg.Thanos.RejectFanOut)
+}
+
+// thanosRemoteWriteUpstreams returns the upstreamRouter of the remote write
+// URLs of the Thanos config, which default to the URLs.
+func (a *App) thanosRemoteWriteUpstreams() *upstreamRouter {
+	rawURL := a.Cfg.Thanos.RemoteWriteURL
+	if rawURL == "" {
+		rawURL = a.Cfg.Thanos.URL
+	}
+	fallback := upstream{url: parseUpstreamURL(rawURL), tls: a.Cfg.Thanos.UseMutualTLS, headers: a.Cfg.Thanos.Headers}
+	return newUpstreamRouter(fallback, a.Cfg.Thanos.Upstreams, func(config UpstreamConfig) string {
+		if config.RemoteWriteURL != "" {
+			return config.RemoteWriteURL
+		}
+		return config.URL
+	}, a.Cfg.Thanos.RejectFanOut)
+}
+
+// thanosRulerUpstreams returns the upstreamRouter of the Mimir ruler URLs of
+// the Thanos config. Upstreams without ruler URL serve no ruler API.
+func (a *App) thanosRulerUpstreams() *upstreamRouter {
+	config := UpstreamConfig{
+		URL:          a.Cfg.Thanos.RulerURL,
+		UseMutualTLS: a.Cfg.Thanos.RulerUseMutualTLS,
+		Cert:         a.Cfg.Thanos.RulerCert,
+		Key:          a.Cfg.Thanos.RulerKey,
+		Headers:      a.Cfg.Thanos.RulerHeaders,
+	}
+	fallback := upstream{url: parseUpstreamURL(config.URL), tls: config.UseMutualTLS, headers: config.Headers, transport: newUpstreamTransport(config)}
+	return newUpstreamRouter(fallback, a.Cfg.Thanos.Upstreams, func(config UpstreamConfig) string { return config.RulerURL }, a.Cfg.Thanos.RejectFanOut)
+}
+
+// lokiUpstreams returns the upstreamRouter of the Loki config.
+func (a *App) lokiUpstreams() *upstreamRouter {
+	fallback := upstream{url: parseUpstreamURL(a.Cfg.Loki.URL), tls: a.Cfg.Loki.UseMutualTLS, headers: a.Cfg.Loki.Headers}
+	return newUpstreamRouter(fallback, a.Cfg.Loki.Upstreams, nil, a.Cfg.Loki.RejectFanOut)
+}
+
+// all returns every upstream, the fallback last.
+func (u *upstreamRouter) all() []upstream {
+	return append(append([]upstream{}, u.upstreams...), u.fallback)
+}
+
+// route returns the upstreams a request has to be sent to, the upstreams
+// serving the tenant label values the queries in the matchWord parameter
+// select, see targets. Requests with a query whose values cannot be
+// enumerated, e.g. without a matcher on the tenant label, or without any
+// query are sent to every upstream that may serve them, see candidates.
+func (u *upstreamRouter) route(r *http.Request, matchWord string, enforcer EnforceQL, tenantLabel string, groups []string) ([]upstream, error) {
+	if len(u.upstreams) == 0 {
+		return []upstream{u.fallback}, nil
+	}
+	queries, err := requestQueries(r, matchWord)
+	if err != nil {
+		return nil, err
+	}
+	return u.routeQueries(queries, enforcer, tenantLabel, groups), nil
+}
+
+// routeQueries returns the upstreams serving the tenants the enforced
+// queries select, or the candidates if they cannot be enumerated.
+func (u *upstreamRouter) routeQueries(queries []string, enforcer EnforceQL, tenantLabel string, groups []string) []upstream {
+	if len(u.upstreams) == 0 {
+		return []upstream{u.fallback}
+	}
+	if len(queries) == 0 {
+		return u.candidates(groups)
+	}
+	var values []string
+	for _, query := range queries {
+		selected, ok := selectedTenantValues(enforcer, query, tenantLabel)
+		if !ok {
+			return u.candidates(groups)
+		}
+		values = append(values, selected...)
+	}
+	return u.targets(values, groups)
+}
+
+// routeSelectors returns the upstreams serving the tenant label values the
+// selectors select, like route does for the selectors of queries.
+func (u *upstreamRouter) routeSelectors(selectors [][]*labels.Matcher, tenantLabel string, groups []string) []upstream {
+	if len(u.upstreams) == 0 {
+		return []upstream{u.fallback}
+	}
+	if len(selectors) == 0 {
+		return u.candidates(groups)
+	}
+	var values []string
+	for _, selector := range selectors {
+		selected, ok := selectorTenantValues(selector, tenantLabel)
+		if !ok {
+			return u.candidates(groups)
+		}
+		values = append(values, selected...)
+	}
+	return u.targets(values, groups)
+}
+
+// routeUser returns the upstreams serving the tenants of a user, for
+// requests whose tenants are not enforced, e.g. in org_id mode. Users
+// skipping enforcement are served by their default upstream.
+func (u *upstreamRouter) routeUser(tenantLabels TenantLabels, skip bool, tenantLabel string, groups []string) []upstream {
+	if skip {
+		return []upstream{u.all()[u.defaultIndex(groups)]}
+	}
+	return u.routeSelectors(tenantLabels.Selectors(tenantLabel), tenantLabel, groups)
+}
+
+// single returns the only target of a request that cannot be sent to
+// several upstreams, e.g. a push, or an error if there are several or the
+// target has no URL for the request.
+func (u *upstreamRouter) single(targets []upstream, tenantLabel string) (upstream, error) {
+	if len(targets) > 1 {
+		return upstream{}, fmt.Errorf("request selects tenants of %d upstreams, send the tenants of each upstream in a separate request or select them with a matcher on %s", len(targets), tenantLabel)
+	}
+	if targets[0].url == nil {
+		return upstream{}, errors.New("the upstream of the requested tenants does not serve this API")
+	}
+	return targets[0], nil
+}
+
+// defaultIndex returns the index in all of the default upstream of a user,
+// the first upstream with one of the groups of the user or the fallback.
+func (u *upstreamRouter) defaultIndex(groups []string) int {
+	for i, up := range u.upstreams {
+		if slices.ContainsFunc(up.groups, func(group string) bool { return ContainsIgnoreCase(groups, group) }) {
+			return i
+		}
+	}
+	return len(u.upstreams)
+}
+
+// targets returns the upstreams serving the tenant label values, see index,
+// or the default upstream of the user if there are none.
+func (u *upstreamRouter) targets(values []string, groups []string) []upstream {
+	selected := make([]bool, len(u.upstreams)+1)
+	for _, value := range values {
+		selected[u.index(value, groups)] = true
+	}
+	if !slices.Contains(selected, true) {
+		selected[u.defaultIndex(groups)] = true
+	}
+	return u.selected(selected)
+}
+
+// candidates returns the upstreams that may serve a request whose tenant
+// label values cannot be enumerated: every upstream listing tenants and the
+// default upstream of the user.
+func (u *upstreamRouter) candidates(groups []string) []upstream {
+	selected := make([]bool, len(u.upstreams)+1)
+	for i, up := range u.upstreams {
+		selected[i] = !up.tenants.Empty()
+	}
+	selected[u.defaultIndex(groups)] = true
+	return u.selected(selected)
+}
+
+func (u *upstreamRouter) selected(selected []bool) []upstream {
+	var targets []upstream
+	for i, up := range u.all() {
+		if selected[i] {
+			targets = append(targets, up)
+		}
+	}
+	return targets
+}
+
+// index returns the index in all of the upstream serving a tenant label
+// value. The tenants of the upstreams take precedence: a value is served by
+// the first upstream listing it, values no upstream lists by the default
+// upstream of the user.
+func (u *upstreamRouter) index(value string, groups []string) int {
+	for i, up := range u.upstreams {
+		if up.tenants.Allowed(value) {
+			return i
+		}
+	}
+	return u.defaultIndex(groups)
+}
+
+// serve sends a request to the upstreams serving it. A single upstream
+// streams its response back, filtered by the array filters if set. If
+// buffer is set, the response is filtered before it is served instead, so a
+// failing filter, e.g. a verification query of a label response, is
+// reported with status 502 rather than cutting off a response with status
+// 200. The responses of several upstreams are merged, see fanOut.
+func (u *upstreamRouter) serve(w http.ResponseWriter, r *http.Request, matchWord string, enforcer EnforceQL, tenantLabel string, groups []string, a *App, arrays map[string]arrayFilter, buffer bool) {
+	targets, err := u.route(r, matchWord, enforcer, tenantLabel, groups)
+	if err != nil {
+		logAndWriteError(w, http.StatusBadRequest, err, "")
+		return
+	}
+	if len(targets) > 1 {
+		if u.rejectFanOut {
+			logAndWriteError(w, http.StatusBadRequest, fmt.Errorf("query selects tenants of %d upstreams, select the tenants of a single upstream with a matcher on %s", len(targets), tenantLabel), "")
+			return
+		}
+		fanOut(w, r, targets, a, arrays)
+		return
+	}
+
+	target := targets[0]
+	if arrays != nil && buffer {
+		target.streamUpAndFilter(w, r, a, func(body []byte) ([]byte, error) {
+			var filtered bytes.Buffer
+			err := filterJSONArrays(bytes.NewReader(body), &filtered, arrays)
+			return filtered.Bytes(), err
+		})
+		return
+	}
+	if arrays != nil {
+		target.streamUpAndRewrite(w, r, a, func(body io.Reader, out io.Writer) error {
+			return filterJSONArrays(body, out, arrays)
+		})
+		return
+	}
+	target.streamUp(w, r, a)
+}
+
+// requestQueries returns the values of the matchWord parameter of the URL and
+// the form of a request. The body of the request is restored after reading.
+func requestQueries(r *http.Request, matchWord string) ([]string, error) {
+	queries := r.URL.Query()[matchWord]
+	if r.Method != http.MethodPost || r.Body == nil {
+		return queries, nil
+	}
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+	return append(queries, form[matchWord]...), nil
+}
+
+// selectedTenantValues returns the tenant label values a PromQL or LogQL
+// query selects and whether they could be enumerated, which needs an equality
+// matcher or a regex matcher listing alternatives on the tenant label in every
+// selector.
+func selectedTenantValues(enforcer EnforceQL, query string, tenantLabel string) ([]string, bool) {
+	var selectors [][]*labels.Matcher
+	switch enforcer.(type) {
+	case PromQLEnforcer:
+		expr, err := parser.ParseExpr(query)
+		if err != nil {
+			return nil, false
+		}
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if vector, ok := node.(*parser.VectorSelector); ok {
+				selectors = append(selectors, vector.LabelMatchers)
+			}
+			return nil
+		})
+	case LogQLEnforcer:
+		expr, err := logqlv2.ParseExpr(query)
+		if err != nil {
+			return nil, false
+		}
+		expr.Walk(func(expr interface{}) {
+			if stream, ok := expr.(*logqlv2.StreamMatcherExpr); ok {
+				selectors = append(selectors, stream.Matchers())
+			}
+		})
+	}
+	if len(selectors) == 0 {
+		return nil, false
+	}
+
+	var values []string
+	for _, selector := range selectors {
+		selected, ok := selectorTenantValues(selector, tenantLabel)
+		if !ok {
+			return nil, false
+		}
+		values = append(values, selected...)
+	}
+	return values, true
+}
+
+// selectorTenantValues returns the tenant label values the matchers of a
+// selector select, if they can be enumerated.
+func selectorTenantValues(matchers []*labels.Matcher, tenantLabel string) ([]string, bool) {
+	var candidates []string
+	for _, matcher := range matchers {
+		if matcher.Name != tenantLabel {
+			continue
+		}
+		if matcher.Type == labels.MatchEqual {
+			candidates = []string{matcher.Value}
+			break
+		}
+		if matcher.Type == labels.MatchRegexp && len(matcher.SetMatches()) > 0 {
+			candidates = matcher.SetMatches()
+			break
+		}
+	}
+	if candidates == nil {
+		return nil, false
+	}
+
+	values := candidates[:0:0]
+	for _, value := range candidates {
+		selected := true
+		for _, matcher := range matchers {
+			selected = selected && (matcher.Name != tenantLabel || matcher.Matches(value))
+		}
+		if selected {
+			values = append(values, value)
+		}
+	}
+	return values, true
+}
+
+// upstreamStatusError is the error of an upstream that did not answer a
+// fanned out request with status 200, its response is passed on.
+type upstreamStatusError struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+func (e upstreamStatusError) Error() string {
+	return fmt.Sprintf("upstream answered with status %d: %s", e.status, e.body)
+}
+
+// fanOut sends a request to several upstreams and serves the merged JSON
+// responses, filtered by the array filters if set. If an upstream fails, its
+// error is returned instead.
+func fanOut(w http.ResponseWriter, r *http.Request, targets []upstream, a *App, arrays map[string]arrayFilter) {
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(r.Body)
+		if err != nil {
+			logAndWriteError(w, http.StatusBadRequest, err, "")
+			return
+		}
+	}
+
+	responses := make([][]byte, len(targets))
+	errs := make([]error, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses[i], errs[i] = fetchUpstream(r, body, target, a)
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		var statusErr upstreamStatusError
+		if errors.As(err, &statusErr) {
+			w.Header().Set("Content-Type", statusErr.contentType)
+			w.WriteHeader(statusErr.status)
+			_, _ = w.Write(statusErr.body)
+			return
+		}
+		if err != nil {
+			logAndWriteError(w, http.StatusBadGateway, err, "")
+			return
+		}
+	}
+
+	merged, err := mergeResponses(responses)
+	if err != nil {
+		status := http.StatusBadGateway
+		if errors.As(err, new(duplicateSeriesError)) {
+			status = http.StatusBadRequest
+		}
+		logAndWriteError(w, status, err, "")
+		return
+	}
+	if arrays != nil {
+		var filtered bytes.Buffer
+		if err := filterJSONArrays(bytes.NewReader(merged), &filtered, arrays); err != nil {
+			logAndWriteError(w, http.StatusBadGateway, err, "")
+			return
+		}
+		merged = filtered.Bytes()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(merged)))
+	_, _ = w.Write(merged)
+}
+
+// fetchUpstream sends a copy of the request with the body to an upstream and
+// returns the body of its response.
+func fetchUpstream(r *http.Request, body []byte, target upstream, a *App) ([]byte, error) {
+	// the string of the joined URL has a leading slash, even if the upstream URL has no path
+	targetURL, err := url.Parse(target.url.JoinPath(r.URL.Path).String())
+	if err != nil {
+		return nil, err
+	}
+	targetURL.RawQuery = r.URL.RawQuery
+	req := r.Clone(r.Context())
+	req.RequestURI = ""
+	req.Host = ""
+	req.URL = targetURL
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Del("Accept-Encoding")
+	req.Header.Del("Connection")
+	setHeaders(req, target.tls, target.headers, a.ServiceAccountToken)
+
+	resp, err := target.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, upstreamStatusError{status: resp.StatusCode, contentType: resp.Header.Get("Content-Type"), body: respBody}
+	}
+	return respBody, nil
+}
+
+// duplicateSeriesError is returned if several upstreams return a series or
+// stream with the same labels, which is the case for aggregations across
+// tenants of several upstreams. They cannot be merged, as every upstream
+// only aggregated its own series.
+type duplicateSeriesError string
+
+func (e duplicateSeriesError) Error() string {
+	return fmt.Sprintf("series %s returned by several upstreams, aggregations across upstreams are not supported", string(e))
+}
+
+// summedFields are the fields whose numbers are added when responses are
+// merged, the statistics of Prometheus and Loki queries and the fields of
+// the Loki index statistics. Other numbers, e.g. timestamps, are kept from
+// the first response.
+var summedFields = map[string]bool{"data.stats": true, "streams": true, "chunks": true, "bytes": true, "entries": true}
+
+// mergeResponses merges the JSON responses of the Prometheus and Loki query,
+// series and label APIs of several upstreams. Objects are merged by key,
+// arrays are concatenated without duplicates and sorted if they hold strings,
+// e.g. label names, and the numbers of summedFields are added. Scalar and
+// string results cannot be merged.
+func mergeResponses(responses [][]byte) ([]byte, error) {
+	var merged any
+	for _, response := range responses {
+		decoder := json.NewDecoder(bytes.NewReader(response))
+		decoder.UseNumber()
+		var value any
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("invalid upstream response: %w", err)
+		}
+		var err error
+		if merged, err = mergeJSON(merged, value, "", false); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(merged)
+}
+
+// mergeJSON merges the JSON value b into a. Path is the path of the values,
+// sum whether their numbers are added.
+func mergeJSON(a, b any, path string, sum bool) (any, error) {
+	if a == nil {
+		return b, nil
+	}
+	if b == nil {
+		return a, nil
+	}
+	switch a := a.(type) {
+	case map[string]any:
+		b, ok := b.(map[string]any)
+		if !ok {
+			return a, nil
+		}
+		if resultType := a["resultType"]; resultType == "scalar" || resultType == "string" {
+			return nil, fmt.Errorf("%s results of several upstreams cannot be merged", resultType)
+		}
+		for key, value := range b {
+			keyPath := key
+			if path != "" {
+				keyPath = path + "." + key
+			}
+			merged, err := mergeJSON(a[key], value, keyPath, sum || summedFields[keyPath])
+			if err != nil {
+				return nil, err
+			}
+			a[key] = merged
+		}
+		return a, nil
+	case []any:
+		b, ok := b.([]any)
+		if !ok {
+			return a, nil
+		}
+		return mergeArrays(a, b)
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok || !sum {
+			return a, nil
+		}
+		return addNumbers(a, b), nil
+	default:
+		return a, nil
+	}
+}
+
+// mergeArrays concatenates two arrays without duplicates. Series and streams
+// with the same labels are an error.
+func mergeArrays(a, b []any) ([]any, error) {
+	merged := make([]any, 0, len(a)+len(b))
+	seen := make(map[string]bool, len(a)+len(b))
+	series := make(map[string]bool)
+	strs := true
+	for _, elements := range [][]any{a, b} {
+		for _, element := range elements {
+			raw, err := json.Marshal(element)
+			if err != nil {
+				return nil, err
+			}
+			if seen[string(raw)] {
+				continue
+			}
+			seen[string(raw)] = true
+			if key, ok := seriesKey(element); ok {
+				if series[key] {
+					return nil, duplicateSeriesError(key)
+				}
+				series[key] = true
+			}
+			_, isString := element.(string)
+			strs = strs && isString
+			merged = append(merged, element)
+		}
+	}
+	if strs {
+		sort.Slice(merged, func(i, j int) bool { return merged[i].(string) < merged[j].(string) })
+	}
+	return merged, nil
+}
+
+// seriesKey returns the labels of an element of a query result, the metric
+// of a Prometheus series or the stream of a Loki stream.
+func seriesKey(element any) (string, bool) {
+	fields, ok := element.(map[string]any)
+	if !ok {
+		return "", false
+	}
+	for _, field := range []string{"metric", "stream"} {
+		if set, ok := fields[field]; ok {
+			raw, err := json.Marshal(set)
+			return string(raw), err == nil
+		}
+	}
+	return "", false
+}
+
+// addNumbers adds two JSON numbers, as integers if both are integers.
+func addNumbers(a, b json.Number) json.Number {
+	if x, err := a.Int64(); err == nil {
+		if y, err := b.Int64(); err == nil {
+			return json.Number(strconv.FormatInt(x+y, 10))
+		}
+	}
+	x, _ := a.Float64()
+	y, _ := b.Float64()
+	return json.Number(strconv.FormatFloat(x+y, 'g', -1, 64))
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSelectedTenantValues(t *testing.T) {
+	cases := []struct {
+		name     string
+		enforcer EnforceQL
+		query    string
+		values   []string
+		ok       bool
+	}{
+		{"PromQL", PromQLEnforcer(struct{}{}), `sum(rate(http_requests_total{namespace="a"}[5m])) / up{namespace=~"a|b"}`, []string{"a", "a", "b"}, true},
+		{"PromQL_narrowed", PromQLEnforcer(struct{}{}), `up{namespace=~"a|b", namespace!="b"}`, []string{"a"}, true},
+		{"PromQL_without_tenant", PromQLEnforcer(struct{}{}), `up`, nil, false},
+		{"PromQL_pattern", PromQLEnforcer(struct{}{}), `up{namespace=~"team-.*"}`, nil, false},
+		{"PromQL_one_selector_without_tenant", PromQLEnforcer(struct{}{}), `up{namespace="a"} or up`, nil, false},
+		{"LogQL", LogQLEnforcer(struct{}{}), `sum(count_over_time({namespace="b", app="api"} |= "error" [5m]))`, []string{"b"}, true},
+		{"Invalid", LogQLEnforcer(struct{}{}), `{`, nil, false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			values, ok := selectedTenantValues(tc.enforcer, tc.query, "namespace")
+			assert.Equal(t, tc.ok, ok)
+			assert.Equal(t, tc.values, values)
+		})
+	}
+}
+
+func TestMergeResponses(t *testing.T) {
+	cases := []struct {
+		name      string
+		responses []string
+		expected  string
+		err       string
+	}{
+		{
+			name:      "Label_values",
+			responses: []string{`{"status":"success","data":["b","c"]}`, `{"status":"success","data":["a","b"]}`},
+			expected:  `{"status":"success","data":["a","b","c"]}`,
+		},
+		{
+			name: "Vector",
+			responses: []string{
+				`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"namespace":"a"},"value":[1,"1"]}]}}`,
+				`{"status":"success","data":{"resultType":"vector","result":[{"metric":{"namespace":"b"},"value":[1,"2"]}]},"warnings":["partial"]}`,
+			},
+			expected: `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"namespace":"a"},"value":[1,"1"]},{"metric":{"namespace":"b"},"value":[1,"2"]}]},"warnings":["partial"]}`,
+		},
+		{
+			name:      "Empty",
+			responses: []string{`{"status":"success","data":[]}`, `{"status":"success","data":null}`},
+			expected:  `{"status":"success","data":[]}`,
+		},
+		{
+			name:      "Index_stats",
+			responses: []string{`{"streams":1,"chunks":2,"bytes":1.5,"entries":4}`, `{"streams":2,"chunks":3,"bytes":2,"entries":5}`},
+			expected:  `{"streams":3,"chunks":5,"bytes":3.5,"entries":9}`,
+		},
+		{
+			name: "Stats",
+			responses: []string{
+				`{"status":"success","data":{"resultType":"streams","result":[],"stats":{"summary":{"totalBytesProcessed":10,"execTime":0.5}}},"limit":100,"ts":1700000000}`,
+				`{"status":"success","data":{"resultType":"streams","result":[],"stats":{"summary":{"totalBytesProcessed":5,"execTime":0.25}}},"limit":100,"ts":1700000001}`,
+			},
+			expected: `{"status":"success","data":{"resultType":"streams","result":[],"stats":{"summary":{"totalBytesProcessed":15,"execTime":0.75}}},"limit":100,"ts":1700000000}`,
+		},
+		{
+			name: "Aggregation",
+			responses: []string{
+				`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"1"]}]}}`,
+				`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1,"2"]}]}}`,
+			},
+			err: "series {} returned by several upstreams, aggregations across upstreams are not supported",
+		},
+		{
+			name: "Scalar",
+			responses: []string{
+				`{"status":"success","data":{"resultType":"scalar","result":[1,"1"]}}`,
+				`{"status":"success","data":{"resultType":"scalar","result":[1,"2"]}}`,
+			},
+			err: "scalar results of several upstreams cannot be merged",
+		},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			responses := make([][]byte, 0, len(tc.responses))
+			for _, response := range tc.responses {
+				responses = append(responses, []byte(response))
+			}
+			merged, err := mergeResponses(responses)
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.JSONEq(t, tc.expected, string(merged))
+		})
+	}
+}
+
+func TestNewUpstreamTransport(t *testing.T) {
+	assert.Nil(t, newUpstreamTransport(UpstreamConfig{URL: "http://upstream.invalid"}))
+
+	transport, ok := newUpstreamTransport(UpstreamConfig{URL: "https://upstream.invalid", UseMutualTLS: true, Cert: "missing.crt", Key: "missing.key"}).(*http.Transport)
+	assert.True(t, ok)
+	assert.NotSame(t, http.DefaultTransport, transport)
+	assert.NotNil(t, transport.TLSClientConfig)
+	assert.Empty(t, transport.TLSClientConfig.Certificates)
+	if defaultTLS := http.DefaultTransport.(*http.Transport).TLSClientConfig; defaultTLS != nil {
+		assert.NotSame(t, defaultTLS, transport.TLSClientConfig)
+	}
+}
+
+func TestUpstreamRouting(t *testing.T) {
+	app, tokens := setupTestMain()
+	var mu sync.Mutex
+	var queries []string
+	upstreamServer := func(namespace string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			queries = append(queries, namespace+" "+r.URL.Query().Get("query"))
+			mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = fmt.Fprintf(w, `{"status":"success","data":{"resultType":"vector","result":[{"metric":{"tenant_id":%q},"value":[1,"1"]}]}}`, namespace)
+		}))
+	}
+	fallback := upstreamServer("allowed_user")
+	defer fallback.Close()
+	dedicated := upstreamServer("also_allowed_user")
+	defer dedicated.Close()
+	app.Cfg.Thanos.URL = fallback.URL
+	app.Cfg.Thanos.Upstreams = []UpstreamConfig{{URL: dedicated.URL, Tenants: []string{"also_allowed_*"}, Groups: []string{"group1"}}}
+	app.WithRoutes()
+
+	serve := func(token, query string) *httptest.ResponseRecorder {
+		queries = nil
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/query?query="+url.QueryEscape(query), nil)
+		req.Header.Set("Authorization", "Bearer "+tokens[token])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := serve("userTenant", `up{tenant_id="allowed_user"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{`allowed_user up{tenant_id="allowed_user"}`}, queries)
+
+	rr = serve("userTenant", `up{tenant_id="also_allowed_user"}`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{`also_allowed_user up{tenant_id="also_allowed_user"}`}, queries)
+
+	rr = serve("userTenant", `up`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Len(t, queries, 2)
+	assert.JSONEq(t, `{"status":"success","data":{"resultType":"vector","result":[
+		{"metric":{"tenant_id":"also_allowed_user"},"value":[1,"1"]},
+		{"metric":{"tenant_id":"allowed_user"},"value":[1,"1"]}]}}`, rr.Body.String())
+
+	// members of group1 are served by the dedicated upstream only
+	rr = serve("groupTenant", `up`)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, []string{`also_allowed_user up{tenant_id=~"allowed_group1|also_allowed_group1"}`}, queries)
+
+	t.Run("Remote read", func(t *testing.T) {
+		read := func(matchers ...*prompb.LabelMatcher) *httptest.ResponseRecorder {
+			queries = nil
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/read", bytes.NewReader(readRequest(t, matchers)))
+			req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+			rr := httptest.NewRecorder()
+			app.e.ServeHTTP(rr, req)
+			return rr
+		}
+		rr := read(&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "tenant_id", Value: "also_allowed_user"})
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"also_allowed_user "}, queries)
+
+		rr = read(&prompb.LabelMatcher{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"})
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, queries)
+	})
+
+	t.Run("Rules", func(t *testing.T) {
+		queries = nil
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/rules", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens["groupTenant"])
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"also_allowed_user "}, queries)
+	})
+
+	t.Run("RejectFanOut", func(t *testing.T) {
+		app.Cfg.Thanos.RejectFanOut = true
+		app.WithRoutes()
+		defer func() {
+			app.Cfg.Thanos.RejectFanOut = false
+			app.WithRoutes()
+		}()
+
+		rr := serve("userTenant", `up`)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, queries)
+
+		rr = serve("userTenant", `up{tenant_id="also_allowed_user"}`)
+		assert.Equal(t, http.StatusOK, rr.Code)
+	})
+}
+
+func TestUpstreamRouterTargets(t *testing.T) {
+	router := newUpstreamRouter(upstream{url: parseUpstreamURL("http://fallback")}, []UpstreamConfig{
+		{URL: "http://payments", Tenants: []string{"payments"}, Groups: []string{"team-payments"}},
+		{URL: "http://billing", Tenants: []string{"billing-*"}},
+		{URL: "http://team-web", Groups: []string{"team-web"}},
+	}, nil, false)
+	hosts := func(targets []upstream) []string {
+		var hosts []string
+		for _, target := range targets {
+			hosts = append(hosts, target.url.Host)
+		}
+		return hosts
+	}
+
+	assert.Equal(t, []string{"payments"}, hosts(router.targets([]string{"payments"}, nil)))
+	assert.Equal(t, []string{"fallback"}, hosts(router.targets([]string{"web"}, nil)))
+	// values no upstream lists are served by the upstream of the groups of the user
+	assert.Equal(t, []string{"payments"}, hosts(router.targets([]string{"web"}, []string{"team-payments"})))
+	assert.Equal(t, []string{"team-web"}, hosts(router.targets(nil, []string{"team-web"})))
+	// the tenants of the upstreams take precedence over the groups
+	assert.Equal(t, []string{"billing"}, hosts(router.targets([]string{"billing-eu"}, []string{"team-payments"})))
+	assert.Equal(t, []string{"payments", "billing"}, hosts(router.targets([]string{"billing-eu", "web"}, []string{"team-payments"})))
+
+	assert.Equal(t, []string{"payments", "billing", "fallback"}, hosts(router.candidates(nil)))
+	assert.Equal(t, []string{"payments", "billing", "team-web"}, hosts(router.candidates([]string{"team-web"})))
+
+	_, err := router.single(router.targets([]string{"payments", "billing-eu"}, nil), "namespace")
+	assert.Error(t, err)
+	target, err := router.single(router.targets([]string{"billing-eu"}, nil), "namespace")
+	assert.NoError(t, err)
+	assert.Equal(t, "billing", target.url.Host)
+}
+
+func TestWriteRouting(t *testing.T) {
+	app, tokens := setupTestMain()
+	var mu sync.Mutex
+	var requests []string
+	upgrader := websocket.Upgrader{}
+	upstreamServer := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, name+" "+r.URL.Path)
+			mu.Unlock()
+			if websocket.IsWebSocketUpgrade(r) {
+				if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+					_ = conn.Close()
+				}
+			}
+		}))
+	}
+	fallback := upstreamServer("fallback")
+	defer fallback.Close()
+	dedicated := upstreamServer("dedicated")
+	defer dedicated.Close()
+	upstreams := []UpstreamConfig{{URL: dedicated.URL, RulerURL: dedicated.URL, Tenants: []string{"also_allowed_*"}}}
+	app.Cfg.Thanos.URL = fallback.URL
+	app.Cfg.Thanos.RulerURL = fallback.URL
+	app.Cfg.Thanos.Upstreams = upstreams
+	app.Cfg.Loki.URL = fallback.URL
+	app.Cfg.Loki.Upstreams = upstreams
+	app.Cfg.OTLP.TenantAttribute = "k8s.namespace.name"
+	app.WithRoutes()
+	proxy := httptest.NewServer(app.e)
+	defer proxy.Close()
+
+	serve := func(method, path, contentType string, body []byte) *httptest.ResponseRecorder {
+		requests = nil
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+tokens["userTenant"])
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		rr := httptest.NewRecorder()
+		app.e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("Remote write", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/api/v1/receive", "", writeRequest(t, labels.FromStrings("__name__", "up", "tenant_id", "also_allowed_user")))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"dedicated /api/v1/receive"}, requests)
+
+		rr = serve(http.MethodPost, "/api/v1/receive", "", writeRequest(t, labels.FromStrings("__name__", "up", "tenant_id", "allowed_user")))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"fallback /api/v1/receive"}, requests)
+
+		rr = serve(http.MethodPost, "/api/v1/receive", "", writeRequest(t,
+			labels.FromStrings("__name__", "up", "tenant_id", "allowed_user"),
+			labels.FromStrings("__name__", "up", "tenant_id", "also_allowed_user")))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, requests)
+	})
+
+	t.Run("Push", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/loki/api/v1/push", "application/json", []byte(`{"streams":[{"stream":{"tenant_id":"also_allowed_user"},"values":[["1700000000000000000","line"]]}]}`))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"dedicated /loki/api/v1/push"}, requests)
+
+		rr = serve(http.MethodPost, "/loki/api/v1/push", "application/json", []byte(`{"streams":[
+			{"stream":{"tenant_id":"allowed_user"},"values":[["1700000000000000000","line"]]},
+			{"stream":{"tenant_id":"also_allowed_user"},"values":[["1700000000000000000","line"]]}]}`))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, requests)
+	})
+
+	t.Run("OTLP", func(t *testing.T) {
+		rr := serve(http.MethodPost, "/otlp/v1/logs", "application/x-protobuf", protobufOTLPRequest("also_allowed_user"))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"dedicated /otlp/v1/logs"}, requests)
+
+		rr = serve(http.MethodPost, "/otlp/v1/metrics", "application/x-protobuf", protobufOTLPRequest("allowed_user"))
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"fallback /otlp/v1/metrics"}, requests)
+
+		rr = serve(http.MethodPost, "/otlp/v1/logs", "application/x-protobuf", protobufOTLPRequest("allowed_user", "also_allowed_user"))
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, requests)
+	})
+
+	t.Run("Ruler", func(t *testing.T) {
+		rr := serve(http.MethodGet, "/prometheus/config/v1/rules/also_allowed_user/up", "", nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"dedicated /prometheus/config/v1/rules/also_allowed_user/up"}, requests)
+
+		rr = serve(http.MethodDelete, "/loki/api/v1/rules/allowed_user/up", "", nil)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, []string{"fallback /loki/api/v1/rules/allowed_user/up"}, requests)
+
+		// the rules of all tenants of the user are on several upstreams
+		rr = serve(http.MethodGet, "/loki/api/v1/rules", "", nil)
+		assert.Equal(t, http.StatusBadRequest, rr.Code)
+		assert.Empty(t, requests)
+	})
+
+	t.Run("Tail", func(t *testing.T) {
+		dial := func(query string) (*http.Response, error) {
+			requests = nil
+			header := http.Header{"Authorization": {"Bearer " + tokens["userTenant"]}}
+			target := "ws" + strings.TrimPrefix(proxy.URL, "http") + "/loki/api/v1/tail?query=" + url.QueryEscape(query)
+			conn, resp, err := websocket.DefaultDialer.Dial(target, header)
+			if err == nil {
+				_ = conn.Close()
+			}
+			return resp, err
+		}
+		_, err := dial(`{tenant_id="also_allowed_user"}`)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"dedicated /loki/api/v1/tail"}, requests)
+
+		resp, err := dial(`{app="api"}`)
+		assert.Error(t, err)
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Empty(t, requests)
+	})
+}